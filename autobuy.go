@@ -3,11 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
-	"math"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,15 +14,12 @@ import (
 	clog "gopkg.in/clog.v1"
 )
 
-func init() {
-	if err := clog.New(clog.CONSOLE, clog.ConsoleConfig{
-		Level:      clog.TRACE,
-		BufferSize: 100},
-	); err != nil {
-		fmt.Printf("init console log failed. error %+v.", err)
-		os.Exit(1)
-	}
-}
+// exit code for cron wrappers
+const (
+	exitSuccess = 0 // all the goods bought
+	exitFailure = 1 // nothing bought
+	exitPartial = 2 // some of the goods bought
+)
 
 const (
 	AreaBeijing                      = "1_72_2799_0"
@@ -32,110 +28,311 @@ const (
 )
 
 var (
-	area   = flag.String("area", AreaHunanShaoyangShaodongChengqu, "ship location string, default to Beijing")
-	period = flag.Int("period", 500, "the refresh period when out of stock, unit: ms.")
-	rush   = flag.Bool("rush", false, "continue to refresh when out of stock.")
-	order  = flag.Bool("order", false, "submit the order to JingDong when get the Goods.")
-	goods  = flag.String("goods", "", `the goods you want to by, find it from JD website. 
+	area    = flag.String("area", AreaBeijing, "ship location string, default to Beijing")
+	period  = flag.Int("period", 500, "the refresh period when out of stock, unit: ms.")
+	rush    = flag.Bool("rush", false, "continue to refresh when out of stock.")
+	order   = flag.Bool("order", false, "submit the order to JingDong when get the Goods.")
+	plan    = flag.String("plan", "", "the plan file describing the goods to buy, JSON, YAML or TOML, take precedence over -goods.")
+	account = flag.String("account", "", "the account to use, each account has its own cookies.")
+	jsonOut = flag.Bool("json", false, "print the result as JSON for scripting, same as -output json.")
+	output  = flag.String("output", outputText, "the format of the result: text, json or table, logs go to stderr except text.")
+
+	watch   = flag.Bool("watch", false, "only watch the price and stock of the goods without login, same as the watch command.")
+	drop    = flag.Float64("drop", 0, "with watch, alert when the price dropped by the percent since started.")
+	restock = flag.Bool("restock", false, "with watch, alert when the goods turns to be in stock.")
+	history = flag.String("history", "jd.history.jsonl", "the file to record the price and stock seen, empty to disable.")
+	days    = flag.Int("days", 0, "with history, only the records of the last days, 0 for all.")
+	histMax = flag.Int("history-max", 100, "the size of the history file to rotate at, unit: MB, 0 for no limit.")
+	listen  = flag.String("listen", "127.0.0.1:8080", "with serve, the address of the HTTP control API.")
+	token   = flag.String("token", "", "with serve, the bearer token required by the HTTP API and metrics, empty for no auth.")
+	metrics = flag.String("metrics", "", "with watch, serve the Prometheus metrics at http://addr/metrics, empty to disable.")
+
+	dataDir      = flag.String("data-dir", "", "where the cookies and QR code saved, default to the current directory.")
+	proxy        = flag.String("proxy", "", "the proxy URL of the requests, http://, https:// or socks5://, default to $HTTPS_PROXY.")
+	timeout      = flag.Duration("timeout", 10*time.Second, "the timeout of each request.")
+	timeouts     = flag.String("timeouts", "", "the timeout by endpoint, the host or URL prefix, e.g. trade.jd.com/shopping/order/submitOrder.action=3s,c0.3.cn=2s.")
+	keepAlive    = flag.Duration("keep-alive", 30*time.Second, "the TCP keep-alive period of the connections.")
+	maxIdleConns = flag.Int("max-idle-conns", 16, "the idle connections kept for each host.")
+	idleTimeout  = flag.Duration("idle-timeout", 90*time.Second, "how long the idle connections kept.")
+	noHTTP2      = flag.Bool("no-http2", false, "do not try HTTP/2 for https.")
+	warmUp       = flag.Duration("warmup", 0, "connect to JingDong this long before the start time of the goods, 0 to disable.")
+	record       = flag.String("record", "", "save the requests and responses to the directory, the cookies and tokens hidden.")
+	replay       = flag.String("replay", "", "serve the responses recorded in the directory instead of JingDong.")
+	rate         = flag.Float64("rate", 10, "the requests per second to each host, shared by all accounts, 0 for no limit.")
+	burst        = flag.Int("burst", 10, "the requests to each host allowed at once.")
+	retryScan    = flag.Int("retry-scan", 50, "times to check the QR code scanned before giving up, about 3 seconds each.")
+	retrySeckill = flag.Int("retry-seckill", 60, "times to fetch the seckill URL or submit the seckill order before giving up.")
+	retryBudget  = flag.Int("retry-budget", 10, "with rush, the consecutive failures of polling the price and stock allowed before giving up.")
+	logLevel     = flag.String("log-level", "trace", "the lowest level logged: trace, info, warn or error.")
+	logFile      = flag.String("log-file", "", "write the logs to the file instead of the console.")
+	traceReqs    = flag.Bool("trace", false, "log each request at trace level: method, URL with the tokens hidden, status and latency.")
+	logFormat    = flag.String("log-format", logText, "the format of the logs: text, or json with the fields such as sku, step and latency.")
+
+	webhook    = flag.String("webhook", "", "notify purchase events by POST JSON to the URL.")
+	notifyExec = flag.String("notify-exec", "", "notify purchase events by running the command, with the event as JSON on stdin.")
+	smtpAddr   = flag.String("smtp", "", "notify purchase events by email, the SMTP server host:port.")
+	smtpUser   = flag.String("smtp-user", "", "the SMTP username, also used as the sender.")
+	smtpPass   = flag.String("smtp-pass", "", "the SMTP password.")
+	mailTo     = flag.String("mail-to", "", "the email receivers, sperated by comma(,).")
+
+	policy = flag.String("policy", "", `how to submit the order with multiple goods, override the plan:
+	all:   submit only when all the required goods are ready (default)
+	any:   submit the goods ready
+	split: submit one order for each goods as soon as it is ready`)
+	strategy = flag.String("strategy", "", `when to put the goods into the cart, override the plan:
+	cart:    add to cart first, then wait the price and stock (default)
+	monitor: wait the price and stock, then add to cart and submit at once`)
+	goods = flag.String("goods", "", `the goods you want to by, find it from JD website. 
 	Single Goods:
 		produceID(:expectNum:expectPrice)
 	Multiple Goods:
 		produceID(:expectNum:expectPrice),produceID(:expectNum:expectPrice)`)
 )
 
+var (
+	limiter     *core.RateLimiter
+	limiterOnce sync.Once
+)
+
+// command is one sub command of autobuy, args are the arguments left after
+// the flags parsed
+//
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands = []*command{
+	{"login", "login [-account name]                 scan the QR code if the cookies are not valid", cmdLogin},
+	{"logout", "logout [-account name]                clean the cookies", cmdLogout},
+	{"whoami", "whoami [-account name]                show whether logged in and the nick name", cmdWhoami},
+	{"cart", "cart [list | clear | select sku...]   show, empty or check only the goods of the cart", cmdCart},
+	{"sku", "sku (detail | price | stock) sku...   show the goods, price or stock in -area", cmdSKU},
+	{"watch", "watch [sku...]                        watch the price and stock without login", cmdWatch},
+	{"rush", "rush [sku...]                         buy the goods of -goods or -plan, the default command", cmdRush},
+	{"order", "order [preview | submit]              preview or submit the order of goods checked", cmdOrder},
+	{"bench", "bench sku[:num] [runs]                dry run the pipeline without submitting, show the time of each step", cmdBench},
+	{"selfcheck", "selfcheck sku [add]                   check whether the pages still match the parsers, add to check gate.action", cmdSelfCheck},
+	{"history", "history [sku...]                      show the price and stock history recorded", cmdHistory},
+	{"serve", "serve [-listen addr]                  run as daemon with the HTTP API and dashboard", cmdServe},
+	{"config", "config [show | validate | path]        show or check the settings of the config file, env and flags", cmdConfig},
+}
+
 func main() {
-	flag.Parse()
-	defer clog.Shutdown()
+	flag.Usage = usage
 
-	gs := parseGoods(*goods)
-	clog.Trace("[Area: %+v, Goods: %+v, Period: %+v, Rush: %+v, Order: %+v]",
-		*area, gs, *period, *rush, *order)
+	args := parseArgs(os.Args[1:])
+	loadErrs = loadConfig()
 
-	jd := core.NewJingDong(core.JDConfig{
-		Period:     time.Millisecond * time.Duration(*period),
-		ShipArea:   *area,
-		AutoRush:   *rush,
-		AutoSubmit: *order,
-	})
+	// config validate report the problems itself
+	if len(args) == 0 || args[0] != "config" {
+		errs := append(loadErrs, validateConfig()...)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(exitFailure)
+		}
+	}
 
-	go func() {
-		signals := make(chan os.Signal, 1)
-		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGTSTP)
-
-		// t := time.NewTimer(10 * time.Second)
-		// select {
-		// case <-t.C:
-		// 	clog.Error(0, "30秒内仍没完成订单，退出。")
-		// 	t.Stop()
-		// 	break
-		// case
-		<-signals
-		signal.Stop(signals)
-		// }
+	if err := initLog(); err != nil {
+		fmt.Fprintf(os.Stderr, "init log failed. error %+v.\n", err)
+		os.Exit(exitFailure)
+	}
 
-		jd.Release()
+	if len(args) > 0 {
+		for _, cmd := range commands {
+			if cmd.name == args[0] {
+				os.Exit(finish(cmd.run(args[1:])))
+			}
+		}
 
-		os.Exit(0)
-	}()
+		// the goods ID is the only argument allowed without command
+		if args[0] == "" || args[0][0] < '0' || args[0][0] > '9' {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+			usage()
+			os.Exit(exitFailure)
+		}
+	}
+
+	// no command for compatibility: autobuy -goods 2567304 -order
+	if *watch {
+		os.Exit(finish(cmdWatch(args)))
+	}
+	os.Exit(finish(cmdRush(args)))
+}
+
+// usage print the commands and flags
+//
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags] [args]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
 
-	if err := jd.Login(); err == nil {
-		jd.CartDetails()
-		fmt.Println()
-		jd.RushBuy(gs)
+// parseArgs parse the flags, which can be mixed with the arguments, the
+// arguments returned
+//
+func parseArgs(args []string) []string {
+	lst := make([]string, 0)
+	for {
+		flag.CommandLine.Parse(args)
+		if flag.NArg() == 0 {
+			return lst
+		}
+		lst = append(lst, flag.Arg(0))
+		args = flag.Args()[1:]
 	}
-	jd.Release()
+}
 
+// isSet check whether the flag is set in command line, not by the config
+// file or the environment variables
+//
+func isSet(name string) bool {
+	return sources[name] == sourceFlag
 }
 
-// parseGoods parse the input goods list. Support to input multiple goods sperated
-// by comma(,). With an (:count) after goods ID to specify the count of each goods.
+// fail log the error, and return exitFailure
 //
-// Example as following:
+func fail(format string, args ...interface{}) int {
+	logf(core.LevelError, format, args...)
+	return exitFailure
+}
+
+// finish flush the logs after the command returned, and return the exit code
 //
-//   2567304				single goods with default count 1, and any price
-//   2567304:3				single goods with count 3, and any price
-//   2567304,3133851:4		multiple goods with defferent count 1, 4, and any price
-//   2567304:2:300,3133851:5:200	...
+func finish(code int) int {
+	clog.Shutdown()
+	return code
+}
+
+// onSignal call fn once interrupted
+//
+func onSignal(fn func()) {
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+		<-signals
+		signal.Stop(signals)
+		fn()
+	}()
+}
+
+// config return the JingDong options from flags
 //
-func parseGoods(goods string) []*core.ExpectProduct {
-	lst := make([]*core.ExpectProduct, 0)
-	if goods == "" {
-		return lst
+func config(account string, store *core.History) core.JDConfig {
+	c := core.JDConfig{
+		Period:     time.Millisecond * time.Duration(*period),
+		ShipArea:   *area,
+		AutoRush:   *rush,
+		AutoSubmit: *order,
+		Account:    account,
+		Notifiers:  notifiers(),
+		History:    store,
+		DataDir:    *dataDir,
+		Proxy:      *proxy,
+		Timeout:    *timeout,
+		Retry:      core.RetryPolicy{Scan: *retryScan, Seckill: *retrySeckill, Budget: *retryBudget},
+		Limiter:    rateLimiter(),
+		Logger:     logger,
+
+		TraceRequests: *traceReqs,
+		Transport: core.TransportOption{
+			KeepAlive:           *keepAlive,
+			MaxIdleConnsPerHost: *maxIdleConns,
+			IdleConnTimeout:     *idleTimeout,
+			DisableHTTP2:        *noHTTP2,
+			WarmUp:              *warmUp,
+			Record:              *record,
+			Replay:              *replay,
+		},
 	}
 
-	var err error
-	for _, good := range strings.Split(goods, ",") {
-		pair := strings.Split(good, ":")
-		id := strings.Trim(pair[0], " ")
-		num := 1
-		if len(pair) > 1 {
-			v, err := strconv.ParseInt(pair[1], 10, 32)
-			if err != nil {
-				panic(err)
-			}
-			num = int(v)
+	// validated by config validate, the invalid ones ignored
+	c.Transport.Timeouts, _ = parseTimeouts(*timeouts)
+
+	// the account settings of the config file, unless given by flags
+	if a := accounts[account]; a != nil {
+		if a.Area != "" && !isSet("area") {
+			c.ShipArea = a.Area
 		}
-		if num < 1 {
-			panic("not a valid product count value")
+		if a.Proxy != "" && !isSet("proxy") {
+			c.Proxy = a.Proxy
 		}
+	}
+	return c
+}
 
-		price := math.MaxFloat64
-		if len(pair) > 2 {
-			price, err = strconv.ParseFloat(pair[2], 64)
-			if err != nil {
-				panic(err)
-			}
+// rateLimiter return the limiter shared by all accounts
+//
+func rateLimiter() *core.RateLimiter {
+	limiterOnce.Do(func() {
+		limiter = core.NewRateLimiter(*rate, *burst)
+	})
+	return limiter
+}
+
+// parseTimeouts parse the -timeouts, endpoint=duration sperated by comma(,)
+//
+func parseTimeouts(str string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	if str == "" {
+		return timeouts, nil
+	}
+
+	for _, item := range strings.Split(str, ",") {
+		pair := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("invalid timeout %q, endpoint=duration expected", item)
 		}
-		if price < 0 {
-			panic("not a valid price count value")
+		d, err := time.ParseDuration(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %s", item, err)
 		}
+		timeouts[pair[0]] = d
+	}
+	return timeouts, nil
+}
 
-		lst = append(lst, &core.ExpectProduct{
-			ID:    id,
-			Num:   num,
-			Price: price,
-		})
+// openHistory open the history store, nil if disabled or failed
+//
+func openHistory() *core.History {
+	if *history == "" {
+		return nil
 	}
 
+	store, err := core.OpenHistory(*history)
+	if err != nil {
+		logf(core.LevelError, "打开价格库存记录失败: %s", err)
+		return nil
+	}
+	store.MaxSize = int64(*histMax) << 20
+	return store
+}
+
+// notifiers create the notifiers from flags
+//
+func notifiers() []core.Notifier {
+	lst := make([]core.Notifier, 0)
+	if *webhook != "" {
+		lst = append(lst, &core.WebhookNotifier{URL: *webhook})
+	}
+	if *notifyExec != "" {
+		args := strings.Fields(*notifyExec)
+		// the settings such as JD_SMTP_PASS are not for the command
+		lst = append(lst, &core.CommandNotifier{Command: args[0], Args: args[1:], HideEnv: []string{envPrefix}})
+	}
+	if *smtpAddr != "" && *mailTo != "" {
+		lst = append(lst, &core.EmailNotifier{
+			Addr:     *smtpAddr,
+			Username: *smtpUser,
+			Password: *smtpPass,
+			To:       strings.Split(*mailTo, ","),
+		})
+	}
 	return lst
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monotone/go-jd/core"
+)
+
+// cmdBench dry run the purchase pipeline of the goods without submitting,
+// show the time spent by each step
+//
+func cmdBench(args []string) int {
+	if len(args) < 1 {
+		return fail("用法: bench sku[:num] [runs]")
+	}
+
+	pair := strings.Split(args[0], ":")
+	ID, count := strings.TrimSpace(pair[0]), 1
+	if len(pair) > 1 {
+		v, err := strconv.Atoi(pair[1])
+		if err != nil || v < 1 {
+			return fail("无效的商品数量: %s", args[0])
+		}
+		count = v
+	}
+	runs := 5
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 1 {
+			return fail("无效的测试次数: %s", args[1])
+		}
+		runs = v
+	}
+
+	jd, err := session(true)
+	if err != nil {
+		return fail("登录失败: %s", err)
+	}
+	defer jd.Release()
+
+	r, err := jd.Bench(ID, count, runs)
+	if r != nil && !printResult(r, func(t *table) {
+		t.row("次数", "详情", "购物车", "订单", "合计", "错误")
+		for i, run := range r.Runs {
+			t.row(i+1, ms(run.Detail), ms(run.Cart), ms(run.Order), ms(run.Total), run.Error)
+		}
+		t.row()
+		t.row("步骤", "次数", "失败", "平均", "最大", "新连接")
+		for _, step := range sortedSteps(r.Steps) {
+			s := r.Steps[step]
+			t.row(step, s.Count, s.Errors, ms(s.Mean()), ms(s.Max), s.Conns)
+		}
+	}) {
+		r.Log(logger)
+	}
+	if err != nil {
+		return fail("测试失败: %s", err)
+	}
+	return exitSuccess
+}
+
+// ms round the duration to milliseconds
+//
+func ms(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
+
+// sortedSteps return the names of the steps in order
+//
+func sortedSteps(steps map[string]*core.StepStats) []string {
+	names := make([]string, 0, len(steps))
+	for step := range steps {
+		names = append(names, step)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/monotone/go-jd/core"
+)
+
+// the settings are layered, the config file, then the environment
+// variables JD_<FLAG>, then the flags, the later takes precedence
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+
+	envPrefix = "JD_"
+)
+
+// AccountConfig override the settings for one account, see Config
+//
+type AccountConfig struct {
+	Area  string `json:"area,omitempty"`  // shipping area of the account
+	Proxy string `json:"proxy,omitempty"` // proxy URL of the account
+}
+
+var (
+	configFile = flag.String("config", "", "the JSON config file, default to go-jd/config.json in the user config dir.")
+
+	// accounts from the config file, keyed by the account name
+	accounts = make(map[string]*AccountConfig)
+
+	// where each flag comes from, for config show
+	sources = make(map[string]string)
+
+	// problems of the config file and the environment variables, only
+	// fatal for the commands other than config
+	loadErrs []error
+
+	areaPattern = regexp.MustCompile(`^\d+([_-]\d+)*$`)
+)
+
+// defaultConfigFile return the config file in the user config dir, which is
+// $XDG_CONFIG_HOME or ~/.config on Linux
+//
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-jd", "config.json")
+}
+
+// configPath return the config file used, and whether it is given
+// explicitly, so that it must exist
+//
+func configPath() (string, bool) {
+	if isSet("config") {
+		return *configFile, true
+	}
+	if v := os.Getenv(envPrefix + "CONFIG"); v != "" {
+		return v, true
+	}
+	return defaultConfigFile(), false
+}
+
+// envName return the environment variable of the flag, JD_SMTP_PASS for
+// -smtp-pass for example
+//
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// loadConfig apply the config file and the environment variables to the
+// flags not set in command line, the problems found are returned
+//
+func loadConfig() []error {
+	errs := make([]error, 0)
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+		sources[f.Name] = sourceFlag
+	})
+
+	set := func(name, value, source string) {
+		if explicit[name] {
+			return
+		}
+		if err := flag.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q for %s: %s", source, value, name, err))
+			return
+		}
+		sources[name] = source
+	}
+
+	if filename, must := configPath(); filename != "" {
+		values, err := readConfig(filename)
+		if err != nil && (must || !os.IsNotExist(err)) {
+			errs = append(errs, err)
+		}
+
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			set(name, values[name], sourceFile)
+		}
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			set(f.Name, v, sourceEnv)
+		}
+	})
+
+	return errs
+}
+
+// readConfig read the config file, the keys are the flag names, plus the
+// accounts:
+//
+//   {
+//     "area": "1_72_2799_0",
+//     "period": 500,
+//     "proxy": "socks5://127.0.0.1:1080",
+//     "timeout": "5s",
+//     "webhook": "https://example.com/hook",
+//     "log-level": "info",
+//     "accounts": {"alice": {"area": "18_1511_1513_40429"}}
+//   }
+//
+func readConfig(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		if name == "accounts" {
+			if err = json.Unmarshal(v, &accounts); err != nil {
+				return nil, fmt.Errorf("%s: accounts: %s", filename, err)
+			}
+			continue
+		}
+
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", filename, name)
+		}
+
+		// strings are unquoted, numbers and bools kept as is
+		var str string
+		if err = json.Unmarshal(v, &str); err != nil {
+			var n json.Number
+			dec := json.NewDecoder(bytes.NewReader(v))
+			dec.UseNumber()
+			if err = dec.Decode(&n); err != nil {
+				str = string(bytes.TrimSpace(v))
+			} else {
+				str = n.String()
+			}
+		}
+		values[name] = str
+	}
+	return values, nil
+}
+
+// validateConfig check the settings loaded
+//
+func validateConfig() []error {
+	errs := make([]error, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(areaPattern.MatchString(*area), "area: invalid area %q", *area)
+	check(*period > 0, "period: must be positive")
+	check(*timeout >= 0, "timeout: must not be negative")
+	if _, err := parseTimeouts(*timeouts); err != nil {
+		errs = append(errs, fmt.Errorf("timeouts: %s", err))
+	}
+	check(*keepAlive >= 0, "keep-alive: must not be negative")
+	check(*maxIdleConns >= 0, "max-idle-conns: must not be negative")
+	check(*idleTimeout >= 0, "idle-timeout: must not be negative")
+	check(*warmUp >= 0, "warmup: must not be negative")
+	check(*record == "" || *replay == "", "record: can not be used with replay")
+	check(*rate >= 0, "rate: must not be negative")
+	check(*burst > 0, "burst: must be positive")
+	check(*retryScan >= 0, "retry-scan: must not be negative")
+	check(*retrySeckill >= 0, "retry-seckill: must not be negative")
+	check(*retryBudget >= 0, "retry-budget: must not be negative")
+	check(*histMax >= 0, "history-max: must not be negative")
+	if *proxy != "" {
+		if err := core.ValidateProxy(*proxy); err != nil {
+			errs = append(errs, fmt.Errorf("proxy: %s", err))
+		}
+	}
+	check(*policy == "" || core.ValidPolicy(*policy), "policy: unknown policy %q", *policy)
+	check(*strategy == "" || core.ValidStrategy(*strategy), "strategy: unknown strategy %q", *strategy)
+
+	switch outputMode() {
+	case outputText, outputJSON, outputTable:
+	default:
+		errs = append(errs, fmt.Errorf("output: unknown format %q", *output))
+	}
+	_, ok := logLevels[*logLevel]
+	check(ok, "log-level: unknown level %q", *logLevel)
+	check(*logFormat == logText || *logFormat == logJSON, "log-format: unknown format %q", *logFormat)
+
+	check(core.ValidAccount(*account), "account: invalid name %q", *account)
+	check((*smtpAddr == "") == (*mailTo == ""), "smtp: both smtp and mail-to required for email")
+	check(*notifyExec == "" || strings.TrimSpace(*notifyExec) != "", "notify-exec: the command must not be blank")
+
+	for name, a := range accounts {
+		check(name != "" && core.ValidAccount(name), "accounts: invalid name %q", name)
+		if a == nil {
+			continue
+		}
+		check(a.Area == "" || areaPattern.MatchString(a.Area), "accounts.%s.area: invalid area %q", name, a.Area)
+		if a.Proxy != "" {
+			if err := core.ValidateProxy(a.Proxy); err != nil {
+				errs = append(errs, fmt.Errorf("accounts.%s.proxy: %s", name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// cmdConfig show the settings and where they come from, or check them
+//
+func cmdConfig(args []string) int {
+	action := "show"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "show":
+		return showConfig()
+	case "validate":
+		filename, _ := configPath()
+		errs := append(loadErrs, validateConfig()...)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			return exitFailure
+		}
+		fmt.Printf("%s: OK\n", filename)
+		return exitSuccess
+	case "path":
+		filename, _ := configPath()
+		fmt.Println(filename)
+		return exitSuccess
+	default:
+		return fail("未知的配置操作: %s", action)
+	}
+}
+
+// settingValue is one setting shown by config show
+//
+type settingValue struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	Env    string `json:"env"`
+}
+
+// showConfig print the effective settings, the secrets masked
+//
+func showConfig() int {
+	lst := make([]*settingValue, 0)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := &settingValue{Name: f.Name, Value: f.Value.String(), Source: sources[f.Name], Env: envName(f.Name)}
+		if v.Source == "" {
+			v.Source = sourceDefault
+		}
+		switch {
+		case (f.Name == "smtp-pass" || f.Name == "token") && v.Value != "":
+			v.Value = "******"
+		case f.Name == "proxy":
+			v.Value = redactURL(v.Value)
+		}
+		lst = append(lst, v)
+	})
+
+	masked := make(map[string]*AccountConfig, len(accounts))
+	for name, a := range accounts {
+		if a != nil {
+			masked[name] = &AccountConfig{Area: a.Area, Proxy: redactURL(a.Proxy)}
+		}
+	}
+
+	filename, _ := configPath()
+	fn := func(t *table) {
+		t.row("设置", "值", "来源", "环境变量")
+		t.row("config", filename, "-", envName("config"))
+		for _, v := range lst {
+			if v.Name != "config" {
+				t.row(v.Name, v.Value, v.Source, v.Env)
+			}
+		}
+		for name, a := range masked {
+			t.row("accounts."+name, fmt.Sprintf("area=%s proxy=%s", a.Area, a.Proxy), sourceFile, "-")
+		}
+	}
+	if !printResult(map[string]interface{}{"file": filename, "settings": lst, "accounts": masked}, fn) {
+		printTable(fn)
+	}
+	return exitSuccess
+}
+
+// redactURL hide the password in the URL
+//
+func redactURL(str string) string {
+	u, err := url.Parse(str)
+	if err != nil || u.User == nil {
+		return str
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
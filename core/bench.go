@@ -0,0 +1,190 @@
+package core
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BenchRun is the duration of each stage of one pipeline run
+//
+type BenchRun struct {
+	Detail time.Duration `json:"detail"` // goods page, price and stock
+	Cart   time.Duration `json:"cart"`   // gate.action or changeNum.action
+	Order  time.Duration `json:"order"`  // best coupons and the order page
+	Total  time.Duration `json:"total"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// BenchReport is the result of Bench
+//
+type BenchReport struct {
+	SKU   string                `json:"sku"`
+	Count int                   `json:"count"`
+	Runs  []*BenchRun           `json:"runs"`
+	Steps map[string]*StepStats `json:"steps"` // latency of the requests by step
+}
+
+// Bench dry run the purchase pipeline of the goods for runs times: load
+// the details, put it into the cart and load the order page, the order is
+// never submitted. The cart is restored at the end: the goods is removed if
+// it was not in the cart before, or changed back to the count before.
+//
+func (jd *JingDong) Bench(ID string, count, runs int) (*BenchReport, error) {
+	if runs <= 0 {
+		runs = 1
+	}
+	if count <= 0 {
+		count = 1
+	}
+
+	jd.cartLock.Lock()
+	defer jd.cartLock.Unlock()
+
+	items, err := jd.CartItems()
+	if err != nil {
+		return nil, err
+	}
+	var item *CartItem
+	for _, it := range items {
+		if it.ID == ID {
+			item = it
+			break
+		}
+	}
+	if item != nil {
+		// the count is changed by the runs, restore it
+		before := item.Count
+		defer func() {
+			if before == count {
+				return
+			}
+			if err := jd.changeCount(ID, before); err != nil {
+				jd.log.Error("恢复购物车内商品(%s)数量失败: %+v", ID, err)
+			}
+		}()
+	} else {
+		defer func() {
+			if err := jd.removeCartItem(ID); err != nil {
+				jd.log.Error("删除购物车内商品(%s)失败: %+v", ID, err)
+			}
+		}()
+	}
+
+	report := &BenchReport{SKU: ID, Count: count, Runs: make([]*BenchRun, 0, runs), Steps: make(map[string]*StepStats)}
+
+	timings := jd.Subscribe(1024, &Timing{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range timings.C {
+			t := e.(*Timing)
+			stats, exist := report.Steps[t.Step]
+			if !exist {
+				stats = &StepStats{}
+				report.Steps[t.Step] = stats
+			}
+			stats.add(t)
+		}
+	}()
+
+	for i := 0; i < runs; i++ {
+		jd.log.Info("第 %d/%d 次测试", i+1, runs)
+		run := jd.benchRun(ID, count, item != nil)
+		if run.Error == "" {
+			item = &CartItem{ID: ID, Count: count}
+		}
+		report.Runs = append(report.Runs, run)
+	}
+
+	timings.Close()
+	<-done
+
+	if allFailed(report.Runs) {
+		return report, errors.New(report.Runs[0].Error)
+	}
+	return report, nil
+}
+
+// removeCartItem remove the goods from the cart if it is there
+//
+func (jd *JingDong) removeCartItem(ID string) error {
+	items, err := jd.CartItems()
+	if err != nil {
+		return err
+	}
+	for _, it := range items {
+		if it.ID == ID {
+			return jd.cartAction(URLRemoveItem, it)
+		}
+	}
+	return nil
+}
+
+// benchRun run the pipeline once, inCart tell whether the goods is in the
+// cart already, so that only the count is changed
+//
+func (jd *JingDong) benchRun(ID string, count int, inCart bool) *BenchRun {
+	run := &BenchRun{}
+	start := time.Now()
+	defer func() {
+		run.Total = time.Since(start)
+	}()
+
+	sku, err := jd.SKUDetail(ID, []string{jd.ShipArea})
+	run.Detail = time.Since(start)
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+
+	stage := time.Now()
+	if inCart {
+		err = jd.changeCount(ID, count)
+	} else {
+		sku.Count = count
+		err = jd.addToCart(sku)
+	}
+	run.Cart = time.Since(stage)
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+
+	stage = time.Now()
+	_, err = jd.OrderPreview()
+	run.Order = time.Since(stage)
+	if err != nil {
+		run.Error = err.Error()
+	}
+	return run
+}
+
+// allFailed tell whether none of the runs succeeded
+//
+func allFailed(runs []*BenchRun) bool {
+	for _, run := range runs {
+		if run.Error == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Log print the runs and the latency of each step to out
+//
+func (r *BenchReport) Log(out Logger) {
+	log := newLogger(out)
+	log.Info(strSeperater)
+	log.Info("测试商品: %s, 数量: %d", r.SKU, r.Count)
+	for i, run := range r.Runs {
+		if run.Error != "" {
+			log.Info("第 %d 次: 失败 %s, 耗时 %s", i+1, run.Error, run.Total.Round(time.Millisecond))
+			continue
+		}
+		log.Info("第 %d 次: 详情 %s, 购物车 %s, 订单 %s, 合计 %s", i+1,
+			run.Detail.Round(time.Millisecond), run.Cart.Round(time.Millisecond),
+			run.Order.Round(time.Millisecond), run.Total.Round(time.Millisecond))
+	}
+	logSteps(log, r.Steps)
+}
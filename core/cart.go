@@ -0,0 +1,181 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const (
+	URLSelectItem = "https://cart.jd.com/selectItem.action"
+	URLCancelItem = "https://cart.jd.com/cancelItem.action"
+	URLRemoveItem = "https://cart.jd.com/removeSkuFromCart.action"
+)
+
+// CartItem is one goods entry of the shopping cart
+//
+type CartItem struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Count    int    `json:"count"`
+	Price    string `json:"price"`
+	Total    string `json:"total"`
+	Selected bool   `json:"selected"` // checked in the cart, will be included in the order
+	PType    string `json:"ptype"`    // from the p-type checkbox, needed by cart actions
+	PromoID  string `json:"promo_id"`
+}
+
+// loadCart download and parse the shopping cart page
+//
+func (jd *JingDong) loadCart() (*goquery.Document, error) {
+	var (
+		err  error
+		req  *http.Request
+		resp *http.Response
+		doc  *goquery.Document
+	)
+
+	if req, err = http.NewRequest("GET", URLCartInfo, nil); err != nil {
+		jd.log.Error("请求（%+v）失败: %+v", URLCartInfo, err)
+		return nil, err
+	}
+
+	if resp, err = jd.client.Do(req); err != nil {
+		jd.log.Error("获取购物车详情错误: %+v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if doc, err = goquery.NewDocumentFromReader(resp.Body); err != nil {
+		jd.log.Error("分析购物车页面错误: %+v.", err)
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// CartItems return the goods list in the shopping cart
+//
+func (jd *JingDong) CartItems() ([]*CartItem, error) {
+	doc, err := jd.loadCart()
+	if err != nil {
+		return nil, err
+	}
+	return parseCartItems(doc), nil
+}
+
+// cartAction post the action of the goods in the shopping cart
+//
+func (jd *JingDong) cartAction(URL string, item *CartItem) error {
+	_, err := jd.getResponse(http.MethodPost, URL, func(URL string) string {
+		u, _ := url.Parse(URL)
+		q := u.Query()
+		q.Set("t", "0")
+		q.Set("venderId", "8888")
+		q.Set("pid", item.ID)
+		q.Set("ptype", item.PType)
+		q.Set("targetId", item.PromoID)
+		q.Set("packId", "0")
+		q.Set("promoID", item.PromoID)
+		q.Set("manFanZeng", item.PromoID)
+		q.Set("outSkus", "")
+		q.Set("random", strconv.FormatFloat(rand.Float64(), 'f', 16, 64))
+		q.Set("locationId", jd.ShipArea)
+		u.RawQuery = q.Encode()
+		return u.String()
+	})
+	return err
+}
+
+// selectCartItem check or uncheck the goods in the shopping cart
+//
+func (jd *JingDong) selectCartItem(item *CartItem, selected bool) error {
+	URL := URLCancelItem
+	if selected {
+		URL = URLSelectItem
+	}
+
+	if err := jd.cartAction(URL, item); err != nil {
+		jd.log.Error("修改商品(%s)选中状态失败: %+v", item.ID, err)
+		return err
+	}
+
+	item.Selected = selected
+
+	action := CartUnselect
+	if selected {
+		action = CartSelect
+	}
+	jd.publish(&CartUpdated{Time: time.Now(), SKU: item.ID, Name: item.Name, Action: action, Count: item.Count})
+	return nil
+}
+
+// reconcileCart make the selection of the shopping cart match the goods
+// list: targeted goods already in the cart are checked, all the others
+// are unchecked so that they will not go into the order.
+//
+func (jd *JingDong) reconcileCart(items []*CartItem, wanted map[string]bool) {
+	for _, item := range items {
+		if item.Selected == wanted[item.ID] {
+			continue
+		}
+
+		if err := jd.selectCartItem(item, wanted[item.ID]); err == nil && !item.Selected {
+			jd.log.Info("取消选中购物车内商品: %s %s", item.ID, item.Name)
+		}
+	}
+}
+
+// SelectCart check only the goods of IDs in the shopping cart, all the
+// others are unchecked
+//
+func (jd *JingDong) SelectCart(IDs []string) error {
+	jd.cartLock.Lock()
+	defer jd.cartLock.Unlock()
+
+	items, err := jd.CartItems()
+	if err != nil {
+		return err
+	}
+
+	inCart := make(map[string]bool)
+	for _, item := range items {
+		inCart[item.ID] = true
+	}
+
+	wanted := make(map[string]bool)
+	for _, ID := range IDs {
+		if !inCart[ID] {
+			return fmt.Errorf("商品 %s 不在购物车内", ID)
+		}
+		wanted[ID] = true
+	}
+	jd.reconcileCart(items, wanted)
+	return nil
+}
+
+// ClearCart remove all the goods from the shopping cart
+//
+func (jd *JingDong) ClearCart() error {
+	jd.cartLock.Lock()
+	defer jd.cartLock.Unlock()
+
+	items, err := jd.CartItems()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err = jd.cartAction(URLRemoveItem, item); err != nil {
+			jd.log.Error("删除购物车内商品(%s)失败: %+v", item.ID, err)
+			return err
+		}
+		jd.log.Info("删除购物车内商品: %s %s", item.ID, item.Name)
+	}
+	return nil
+}
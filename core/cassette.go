@@ -0,0 +1,292 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exchange is one request and its response recorded in the cassette
+// directory, as <seq>-<step>.json with the response body beside it in
+// <seq>-<step>.body. The cookies and tokens are redacted.
+//
+type Exchange struct {
+	Time     time.Time   `json:"time"`
+	Step     string      `json:"step"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header"`
+	Form     string      `json:"form,omitempty"` // the request body if form encoded
+	Status   int         `json:"status"`
+	Response http.Header `json:"response"` // header of the response
+	Body     string      `json:"body"`     // file name of the response body
+}
+
+// key is what the requests replayed are matched by, the query changes
+// each time for the timestamps and random numbers
+//
+func (e *Exchange) key() string {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return e.Method + " " + e.URL
+	}
+	return e.Method + " " + u.Host + u.Path
+}
+
+// cookieHeaders are the headers with the cookie values hidden, the names kept
+var cookieHeaders = []string{"Cookie", "Set-Cookie"}
+
+// credentialHeaders are the headers with the whole values hidden
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization"}
+
+// sensitiveBody match the tokens in the bodies, as JSON field or parameter
+var sensitiveBody = regexp.MustCompile(`(?i)("?(?:ticket|token|trackid|wlfstk_smdl|skey)"?\s*[:=]\s*"?)([^"&'\s,;}<>]+)`)
+
+// Recorder is the RoundTripper saving the requests and responses to Dir,
+// so that the parsing of the pages can be reproduced by Replayer
+//
+type Recorder struct {
+	Dir  string
+	next http.RoundTripper
+	seq  int
+	mu   sync.Mutex
+}
+
+// NewRecorder create the recorder sending the requests by next, the
+// exchanges are appended after those already in dir
+//
+func NewRecorder(dir string, next http.RoundTripper) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Dir: dir, next: next, seq: len(names)}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := &Exchange{
+		Time:   time.Now(),
+		Step:   stepOf(req),
+		Method: req.Method,
+		URL:    redactURL(req.URL),
+		Header: redactHeader(req.Header),
+	}
+	if req.Body != nil && strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		data, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		e.Form = redactQuery(string(data))
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	// saved decoded, so that the body can be used as fixture
+	body := data
+	e.Response = redactHeader(resp.Header)
+	e.Response.Del("Content-Length") // changed by the redaction
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if zr, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+			if body, err = ioutil.ReadAll(zr); err != nil {
+				body = data
+			} else {
+				e.Response.Del("Content-Encoding")
+			}
+		}
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		body = sensitiveBody.ReplaceAll(body, []byte("${1}xxx"))
+	}
+	e.Status = resp.StatusCode
+
+	if err := r.save(e, body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// save write the exchange and the body with the next sequence number
+//
+func (r *Recorder) save(e *Exchange, body []byte) error {
+	r.mu.Lock()
+	r.seq++
+	name := fmt.Sprintf("%04d-%s", r.seq, strings.NewReplacer("/", "_", ":", "_").Replace(e.Step))
+	r.mu.Unlock()
+
+	e.Body = name + ".body"
+	if err := ioutil.WriteFile(filepath.Join(r.Dir, e.Body), body, 0600); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.Dir, name+".json"), data, 0600)
+}
+
+// Replayer is the RoundTripper serving the responses recorded by Recorder
+// instead of JingDong. The requests are matched by the method, host and
+// path, the responses of one endpoint are served in the order recorded,
+// and the last one repeated.
+//
+type Replayer struct {
+	Dir       string
+	exchanges map[string][]*Exchange
+	served    map[string]int
+	mu        sync.Mutex
+}
+
+// NewReplayer load the exchanges in dir
+//
+func NewReplayer(dir string) (*Replayer, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no records in %s", dir)
+	}
+	sort.Strings(names)
+
+	r := &Replayer{Dir: dir, exchanges: make(map[string][]*Exchange), served: make(map[string]int)}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		e := &Exchange{}
+		if err = json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		r.exchanges[e.key()] = append(r.exchanges[e.key()], e)
+	}
+	return r, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Method + " " + req.URL.Host + req.URL.Path
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	r.mu.Lock()
+	lst := r.exchanges[key]
+	i := r.served[key]
+	if i < len(lst)-1 {
+		r.served[key]++
+	}
+	r.mu.Unlock()
+
+	if len(lst) == 0 {
+		return nil, fmt.Errorf("no record of %s", key)
+	}
+	e := lst[i]
+
+	body, err := ioutil.ReadFile(filepath.Join(r.Dir, e.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	// the cookies recorded are redacted, not to overwrite the ones in jar
+	header := http.Header{}
+	for k, v := range e.Response {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Del("Set-Cookie")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// redactHeader return a copy of the header with the cookies and
+// credentials hidden, the cookie names are kept
+//
+func redactHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+
+	for _, k := range cookieHeaders {
+		values := c[http.CanonicalHeaderKey(k)]
+		for i, v := range values {
+			values[i] = redactCookies(v)
+		}
+	}
+	for _, k := range credentialHeaders {
+		values := c[http.CanonicalHeaderKey(k)]
+		for i := range values {
+			values[i] = "xxx"
+		}
+	}
+	return c
+}
+
+// redactCookies hide the values of name=value pairs, the attributes of
+// Set-Cookie such as path and domain kept
+//
+func redactCookies(v string) string {
+	pairs := strings.Split(v, ";")
+	for i, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "path", "domain", "expires", "max-age", "samesite":
+			continue
+		}
+		pairs[i] = kv[0] + "=xxx"
+	}
+	return strings.Join(pairs, ";")
+}
+
+// redactQuery hide the sensitive parameters of the URL encoded string
+//
+func redactQuery(str string) string {
+	q, err := url.ParseQuery(str)
+	if err != nil {
+		return ""
+	}
+	for k := range q {
+		if sensitiveParam(k) {
+			q.Set(k, "xxx")
+		}
+	}
+	return q.Encode()
+}
@@ -0,0 +1,31 @@
+package core
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRedactHeader(t *testing.T) {
+	h := http.Header{
+		"Cookie":              {"thor=secret; pin=alice"},
+		"Set-Cookie":          {"thor=secret; Path=/; Domain=.jd.com"},
+		"Authorization":       {"Bearer a.b=c"},
+		"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+		"Accept":              {"*/*"},
+	}
+	want := http.Header{
+		"Cookie":              {"thor=xxx; pin=xxx"},
+		"Set-Cookie":          {"thor=xxx; Path=/; Domain=.jd.com"},
+		"Authorization":       {"xxx"},
+		"Proxy-Authorization": {"xxx"},
+		"Accept":              {"*/*"},
+	}
+
+	if got := redactHeader(h); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if h.Get("Authorization") != "Bearer a.b=c" {
+		t.Errorf("the original header changed: %v", h)
+	}
+}
@@ -0,0 +1,211 @@
+package core
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is the progress of JingDong operations, one of *StockChanged,
+// *PriceChanged, *CartUpdated, *SubmitAttempt, *OrderPlaced,
+// *SessionExpired, *RushAborted, *Polled, *WatchAlert, *Observation,
+// *Throttled and *Timing.
+//
+type Event interface {
+	When() time.Time
+}
+
+// StockChanged is fired when the stock state of sku seen is different from
+// the last one
+//
+type StockChanged struct {
+	Time         time.Time
+	SKU          string
+	Name         string
+	OldState     string // empty for the first time
+	State        string // 33 : on sale, 34 : out of stock
+	StateName    string
+	OldStateName string
+}
+
+// InStock check whether the sku turns to be on sale
+//
+func (e *StockChanged) InStock() bool {
+	return e.State == "33" && e.OldState != "33"
+}
+
+// PriceChanged is fired when the price of sku seen is different from the
+// last one
+//
+type PriceChanged struct {
+	Time     time.Time
+	SKU      string
+	Name     string
+	OldPrice float64 // 0 for the first time
+	Price    float64
+	Expect   float64 // the expected price, 0 if not rushing
+}
+
+// DropBelow check whether the price drops below the expected
+//
+func (e *PriceChanged) DropBelow() bool {
+	return e.Expect > 0 && e.Price <= e.Expect && (e.OldPrice == 0 || e.OldPrice > e.Expect)
+}
+
+// Cart actions of CartUpdated
+//
+const (
+	CartAdd      = "add"      // added by gate.action
+	CartReuse    = "reuse"    // already in the cart
+	CartCount    = "count"    // count changed
+	CartSelect   = "select"   // checked
+	CartUnselect = "unselect" // unchecked
+)
+
+// CartUpdated is fired when the goods in shopping cart changed
+//
+type CartUpdated struct {
+	Time   time.Time
+	SKU    string
+	Name   string
+	Action string
+	Count  int
+}
+
+// OrderPlaced is fired when the order submitted successfully
+//
+type OrderPlaced struct {
+	Time    time.Time
+	OrderID int64
+	SKUs    []string
+}
+
+// SessionExpired is fired when the cookies not valid anymore, and the QR
+// code is ready to scan
+//
+type SessionExpired struct {
+	Time    time.Time
+	QRImage string // file path of the QR code
+}
+
+// RushAborted is fired when the rush gives up submitting the order
+//
+type RushAborted struct {
+	Time   time.Time
+	Reason string
+}
+
+// Sources of Polled
+//
+const (
+	PollWatch   = "watch"   // one round of Watcher
+	PollMonitor = "monitor" // one poll of Monitor while rushing
+)
+
+// Polled is fired for each round of polling the price and stock
+//
+type Polled struct {
+	Time   time.Time
+	Source string // PollWatch or PollMonitor
+	SKU    string // the goods of Monitor, empty for Watcher
+	Failed bool
+}
+
+// When implement Event
+func (e *StockChanged) When() time.Time { return e.Time }
+
+// When implement Event
+func (e *PriceChanged) When() time.Time { return e.Time }
+
+// When implement Event
+func (e *CartUpdated) When() time.Time { return e.Time }
+
+// When implement Event
+func (e *SubmitAttempt) When() time.Time { return e.Time }
+
+// When implement Event
+func (e *OrderPlaced) When() time.Time { return e.Time }
+
+// When implement Event
+func (e *SessionExpired) When() time.Time { return e.Time }
+
+// When implement Event
+func (e *RushAborted) When() time.Time { return e.Time }
+
+// When implement Event
+func (e *Polled) When() time.Time { return e.Time }
+
+// Subscription receive events from JingDong by channel C. Events are
+// dropped when the subscriber is too slow to keep the buffer not full.
+//
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	kinds   map[reflect.Type]bool // nil for all
+	jd      *JingDong
+	once    sync.Once
+	dropped int64
+}
+
+// Dropped return the count of events dropped since the buffer was full
+//
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close stop receiving events, C is closed
+//
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.jd.subLock.Lock()
+		defer s.jd.subLock.Unlock()
+
+		for i, sub := range s.jd.subs {
+			if sub == s {
+				s.jd.subs = append(s.jd.subs[:i], s.jd.subs[i+1:]...)
+				break
+			}
+		}
+		close(s.ch)
+	})
+}
+
+// Subscribe start receiving events with the buffer size, only the kinds
+// of events given if any, jd.Subscribe(16, &OrderPlaced{}) for example
+//
+func (jd *JingDong) Subscribe(buffer int, kinds ...Event) *Subscription {
+	ch := make(chan Event, buffer)
+	s := &Subscription{C: ch, ch: ch, jd: jd}
+	if len(kinds) > 0 {
+		s.kinds = make(map[reflect.Type]bool, len(kinds))
+		for _, e := range kinds {
+			s.kinds[reflect.TypeOf(e)] = true
+		}
+	}
+
+	jd.subLock.Lock()
+	jd.subs = append(jd.subs, s)
+	jd.subLock.Unlock()
+
+	return s
+}
+
+// publish send the event to all subscribers without blocking
+//
+func (jd *JingDong) publish(e Event) {
+	jd.subLock.RLock()
+	defer jd.subLock.RUnlock()
+
+	for _, s := range jd.subs {
+		if s.kinds != nil && !s.kinds[reflect.TypeOf(e)] {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Observation is one price or stock result seen from JingDong. Price
+// results have no area, stock results have no price.
+//
+type Observation struct {
+	Time      time.Time `json:"time"`
+	SKU       string    `json:"sku"`
+	Area      string    `json:"area,omitempty"`
+	Price     float64   `json:"price,omitempty"` // -1 if not on sale
+	State     string    `json:"state,omitempty"` // 33 : on sale, 34 : out of stock
+	StateName string    `json:"state_name,omitempty"`
+}
+
+// When implement Event
+func (e *Observation) When() time.Time { return e.Time }
+
+// History is the local store of observations: an append-only JSONL file,
+// and an index file beside it with the offset of each record by sku. The
+// index is rebuilt from the JSONL file if missing or behind.
+//
+// Both files are only appended, each record and index line by one write,
+// so the processes sharing the files, such as rush, watch and serve run in
+// the same directory, do not overwrite each other. The records of the
+// others are seen by the index lines they append.
+//
+// With MaxSize, the file is rotated to <name>.1.jsonl when full, replacing
+// the older one, so at most two files are kept. Both are queried.
+//
+type History struct {
+	MaxSize int64 // bytes of the JSONL file to rotate at, 0 for no limit
+
+	filename string
+	readOnly bool
+	data     *os.File
+	idx      *os.File           // nil if read only and missing
+	idxPos   int64              // bytes of the index loaded
+	offsets  map[string][]int64 // sku -> offsets of records
+	prev     *History           // the rotated file, nil if none
+	mu       sync.Mutex
+}
+
+// OpenHistory open or create the history store to record
+//
+func OpenHistory(filename string) (*History, error) {
+	h := &History{filename: filename}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// OpenHistoryReadOnly open the history store to query, nothing written
+// or truncated. The index behind is completed in memory only.
+//
+func OpenHistoryReadOnly(filename string) (*History, error) {
+	h := &History{filename: filename, readOnly: true}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// indexFile return the index file of the JSONL file
+//
+func indexFile(filename string) string {
+	return strings.TrimSuffix(filename, ".jsonl") + ".idx"
+}
+
+// rotatedFile return the JSONL file rotated to
+//
+func rotatedFile(filename string) string {
+	return strings.TrimSuffix(filename, ".jsonl") + ".1.jsonl"
+}
+
+// open the files and the rotated one
+//
+func (h *History) open() error {
+	if err := h.openFiles(); err != nil {
+		return err
+	}
+
+	prev := &History{filename: rotatedFile(h.filename), readOnly: true}
+	if err := prev.openFiles(); err != nil {
+		if !os.IsNotExist(err) {
+			h.close()
+			return err
+		}
+		prev = nil
+	}
+	h.prev = prev
+	return nil
+}
+
+// openFiles open the files and load the index
+//
+func (h *History) openFiles() error {
+	var err error
+	h.offsets = make(map[string][]int64)
+	h.idx, h.idxPos, h.prev = nil, 0, nil
+
+	if h.readOnly {
+		if h.data, err = os.Open(h.filename); err != nil {
+			return err
+		}
+		if h.idx, err = os.Open(indexFile(h.filename)); err != nil && !os.IsNotExist(err) {
+			h.data.Close()
+			return err
+		}
+	} else {
+		if h.data, err = os.OpenFile(h.filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+		if h.idx, err = os.OpenFile(indexFile(h.filename), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			h.data.Close()
+			return err
+		}
+	}
+
+	if err = h.load(); err != nil {
+		h.close()
+		return fmt.Errorf("%s: %s", h.filename, err)
+	}
+	return nil
+}
+
+// load read the index, and index the records not indexed yet
+//
+func (h *History) load() error {
+	last := int64(-1)
+	if h.idx != nil {
+		data, err := ioutil.ReadAll(h.idx)
+		if err != nil {
+			return err
+		}
+		// the last line may be still being written
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+		h.idxPos = int64(len(data))
+		last = h.parseIndex(data)
+	}
+
+	fi, err := h.data.Stat()
+	if err != nil {
+		return err
+	}
+
+	start := int64(0)
+	if last >= fi.Size() {
+		// the index does not match the records, such as the JSONL file
+		// replaced by hand, rebuild it
+		h.offsets = make(map[string][]int64)
+		if !h.readOnly {
+			if err = h.idx.Truncate(0); err != nil {
+				return err
+			}
+			h.idxPos = 0
+		}
+		last = -1
+	} else if last >= 0 {
+		start = last
+	}
+	if _, err = h.data.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(h.data)
+	off := start
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			break // incomplete record, may be still being written
+		}
+		if err != nil {
+			return err
+		}
+
+		cur := off
+		off += int64(len(line))
+		if cur == last {
+			continue
+		}
+
+		var o Observation
+		if json.Unmarshal(line, &o) != nil || o.SKU == "" {
+			continue
+		}
+		if err = h.index(o.SKU, cur); err != nil {
+			return err
+		}
+	}
+
+	return h.readIndex()
+}
+
+// parseIndex add the offsets of the index lines, the biggest returned
+//
+func (h *History) parseIndex(data []byte) int64 {
+	last := int64(-1)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		off, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		h.offsets[fields[0]] = append(h.offsets[fields[0]], off)
+		if off > last {
+			last = off
+		}
+	}
+	return last
+}
+
+// readIndex load the index lines appended since loaded, by this process
+// or the others
+//
+func (h *History) readIndex() error {
+	if h.idx == nil {
+		return nil
+	}
+	fi, err := h.idx.Stat()
+	if err != nil || fi.Size() <= h.idxPos {
+		return err
+	}
+
+	data := make([]byte, fi.Size()-h.idxPos)
+	n, err := h.idx.ReadAt(data, h.idxPos)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	data = data[:n]
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	h.idxPos += int64(len(data))
+	h.parseIndex(data)
+	return nil
+}
+
+// index add the offset of record to the index file, loaded back by
+// readIndex, or to the memory only if read only
+//
+func (h *History) index(sku string, off int64) error {
+	if h.readOnly {
+		h.offsets[sku] = append(h.offsets[sku], off)
+		return nil
+	}
+	_, err := fmt.Fprintf(h.idx, "%s %d\n", sku, off)
+	return err
+}
+
+// reopenRotated reopen the files if rotated by another process, h.mu held
+//
+func (h *History) reopenRotated() error {
+	fi, err := os.Stat(h.filename)
+	if err != nil {
+		return nil // removed, keep the ones opened
+	}
+	cur, err := h.data.Stat()
+	if err != nil || os.SameFile(fi, cur) {
+		return err
+	}
+	h.close()
+	return h.open()
+}
+
+// refresh catch up the records of the other processes, h.mu held
+//
+func (h *History) refresh() error {
+	if err := h.reopenRotated(); err != nil {
+		return err
+	}
+	return h.readIndex()
+}
+
+// Record append the observation to the store
+//
+func (h *History) Record(o *Observation) error {
+	line, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.readOnly {
+		return fmt.Errorf("%s: opened read only", h.filename)
+	}
+	if err = h.reopenRotated(); err != nil {
+		return err
+	}
+	fi, err := h.data.Stat()
+	if err != nil {
+		return err
+	}
+	if h.MaxSize > 0 && fi.Size() > 0 && fi.Size()+int64(len(line)) > h.MaxSize {
+		if err = h.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// appended at the end whatever the others wrote, which is the offset
+	// after it
+	if _, err = h.data.Write(line); err != nil {
+		return err
+	}
+	end, err := h.data.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return h.index(o.SKU, end-int64(len(line)))
+}
+
+// rotate move the files full to <name>.1.jsonl and <name>.1.idx, and
+// start the new ones, h.mu held
+//
+func (h *History) rotate() error {
+	h.close()
+
+	old := rotatedFile(h.filename)
+	if err := os.Rename(h.filename, old); err != nil {
+		if e := h.open(); e != nil {
+			return e
+		}
+		return err
+	}
+	if err := os.Rename(indexFile(h.filename), indexFile(old)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return h.open()
+}
+
+// SKUs return all the sku recorded, in the rotated file too
+//
+func (h *History) SKUs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.refresh(); err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(h.offsets))
+	lst := make([]string, 0, len(h.offsets))
+	for _, s := range []*History{h.prev, h} {
+		if s == nil {
+			continue
+		}
+		for sku := range s.offsets {
+			if !seen[sku] {
+				seen[sku] = true
+				lst = append(lst, sku)
+			}
+		}
+	}
+	sort.Strings(lst)
+	return lst
+}
+
+// Query return the observations of sku since the time, in time order, the
+// ones in the rotated file included
+//
+func (h *History) Query(sku string, since time.Time) ([]*Observation, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.refresh(); err != nil {
+		return nil, err
+	}
+
+	lst := make([]*Observation, 0)
+	for _, s := range []*History{h.prev, h} {
+		if s == nil {
+			continue
+		}
+		l, err := s.query(sku, since)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s.filename, err)
+		}
+		lst = append(lst, l...)
+	}
+
+	sort.SliceStable(lst, func(i, j int) bool {
+		return lst[i].Time.Before(lst[j].Time)
+	})
+	return lst, nil
+}
+
+// query return the observations of sku in the file
+//
+func (h *History) query(sku string, since time.Time) ([]*Observation, error) {
+	// the record indexed by two processes at once is read once
+	offsets := append([]int64(nil), h.offsets[sku]...)
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	lst := make([]*Observation, 0, len(offsets))
+	buf := make([]byte, 0, 256)
+	for i, off := range offsets {
+		if i > 0 && off == offsets[i-1] {
+			continue
+		}
+		line, err := h.readLine(off, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		o := &Observation{}
+		if err = json.Unmarshal(line, o); err != nil {
+			return nil, fmt.Errorf("offset %d: %s", off, err)
+		}
+		if !o.Time.Before(since) {
+			lst = append(lst, o)
+		}
+	}
+	return lst, nil
+}
+
+// readLine read the record at offset
+//
+func (h *History) readLine(off int64, buf []byte) ([]byte, error) {
+	buf = buf[:cap(buf)]
+	for {
+		n, err := h.data.ReadAt(buf, off)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return buf[:i], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// Close the store
+//
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.close()
+}
+
+func (h *History) close() error {
+	if h.prev != nil {
+		h.prev.close()
+	}
+	if h.idx != nil {
+		h.idx.Close()
+	}
+	return h.data.Close()
+}
+
+// PricePoint is the price since the time
+//
+type PricePoint struct {
+	Time  time.Time `json:"time"`
+	Price float64   `json:"price"`
+}
+
+// AreaStock is the stock pattern of sku in one area
+//
+type AreaStock struct {
+	Area         string      `json:"area"`
+	Samples      int         `json:"samples"`
+	InStock      int         `json:"in_stock"`      // samples in stock
+	Restocks     []time.Time `json:"restocks"`      // times turned to be in stock
+	RestockHours [24]int     `json:"restock_hours"` // restocks by hour of day, Beijing time
+}
+
+// SKUHistory is the summary of the observations of one sku
+//
+type SKUHistory struct {
+	SKU       string       `json:"sku"`
+	From      time.Time    `json:"from"`
+	To        time.Time    `json:"to"`
+	Prices    []PricePoint `json:"prices"`    // price timeline, only the changes
+	LowPrice  float64      `json:"low_price"` // lowest price ever, 0 if never seen
+	LowAt     time.Time    `json:"low_at"`
+	HighPrice float64      `json:"high_price"`
+	LastPrice float64      `json:"last_price"`
+	Areas     []*AreaStock `json:"areas"`
+}
+
+// Summarize build the summary from the observations of one sku in time
+// order
+//
+func Summarize(sku string, lst []*Observation) *SKUHistory {
+	s := &SKUHistory{SKU: sku, Prices: make([]PricePoint, 0), Areas: make([]*AreaStock, 0)}
+	if len(lst) > 0 {
+		s.From, s.To = lst[0].Time, lst[len(lst)-1].Time
+	}
+
+	areas := make(map[string]*AreaStock)
+	lastState := make(map[string]string)
+	for _, o := range lst {
+		if o.Price > 0 {
+			if s.LastPrice != o.Price {
+				s.Prices = append(s.Prices, PricePoint{Time: o.Time, Price: o.Price})
+			}
+			if s.LowPrice == 0 || o.Price < s.LowPrice {
+				s.LowPrice, s.LowAt = o.Price, o.Time
+			}
+			if o.Price > s.HighPrice {
+				s.HighPrice = o.Price
+			}
+			s.LastPrice = o.Price
+		}
+
+		if o.State == "" {
+			continue
+		}
+		a, exist := areas[o.Area]
+		if !exist {
+			a = &AreaStock{Area: o.Area, Restocks: make([]time.Time, 0)}
+			areas[o.Area] = a
+			s.Areas = append(s.Areas, a)
+		}
+		a.Samples++
+		if o.State == "33" {
+			a.InStock++
+			if prev, seen := lastState[o.Area]; seen && prev != "33" {
+				a.Restocks = append(a.Restocks, o.Time)
+				a.RestockHours[o.Time.In(chinaZone).Hour()]++
+			}
+		}
+		lastState[o.Area] = o.State
+	}
+
+	return s
+}
+
+// startHistory subscribe the observations, and record them to History
+//
+func (jd *JingDong) startHistory() {
+	if jd.History == nil {
+		return
+	}
+
+	jd.historySub = jd.Subscribe(1024, &Observation{})
+	jd.historyDone = make(chan struct{})
+
+	go func() {
+		defer close(jd.historyDone)
+
+		for e := range jd.historySub.C {
+			if o, ok := e.(*Observation); ok {
+				if err := jd.History.Record(o); err != nil {
+					jd.log.Error("保存价格库存记录失败: %+v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopHistory wait the observations in buffer to be recorded
+//
+func (jd *JingDong) stopHistory() {
+	if jd.historySub == nil {
+		return
+	}
+
+	jd.historySub.Close()
+	<-jd.historyDone
+
+	if n := jd.historySub.Dropped(); n > 0 {
+		jd.log.Warn("订阅缓冲已满，%d 个事件未处理，价格库存记录可能不完整", n)
+	}
+}
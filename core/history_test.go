@@ -0,0 +1,153 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// observe return the observation of sku at the minute
+func observe(sku string, minute int) *Observation {
+	t := time.Date(2020, 1, 1, 0, minute, 0, 0, time.UTC)
+	return &Observation{Time: t, SKU: sku, Price: float64(100 + minute)}
+}
+
+func TestHistoryShared(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jd.history.jsonl")
+	a, err := OpenHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := OpenHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// two processes recording the same file by turns
+	for i := 0; i < 10; i++ {
+		h := a
+		if i%2 == 1 {
+			h = b
+		}
+		if err = h.Record(observe("1", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := OpenHistoryReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for name, h := range map[string]*History{"a": a, "b": b, "read only": r} {
+		lst, err := h.Query("1", time.Time{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(lst) != 10 {
+			t.Fatalf("%s: got %d records, want 10", name, len(lst))
+		}
+		for i, o := range lst {
+			if o.Price != float64(100+i) {
+				t.Errorf("%s: record %d price %.0f, want %d", name, i, o.Price, 100+i)
+			}
+		}
+	}
+
+	// opening again keeps the records of both
+	c, err := OpenHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if lst, _ := c.Query("1", time.Time{}); len(lst) != 10 {
+		t.Errorf("reopened: got %d records, want 10", len(lst))
+	}
+}
+
+func TestHistoryRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jd.history.jsonl")
+	h, err := OpenHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.MaxSize = 300
+
+	for i := 0; i < 8; i++ {
+		if err = h.Record(observe("1", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = h.Record(observe("2", 8)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ioutil.ReadFile(rotatedFile(filename)); err != nil {
+		t.Fatalf("not rotated: %v", err)
+	}
+
+	cases := []struct {
+		sku   string
+		since int
+		want  int
+	}{
+		{"1", 0, 8},
+		{"1", 6, 2},
+		{"2", 0, 1},
+		{"3", 0, 0},
+	}
+	for _, c := range cases {
+		lst, err := h.Query(c.sku, observe(c.sku, c.since).Time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lst) != c.want {
+			t.Errorf("%s since %d: got %d records, want %d", c.sku, c.since, len(lst), c.want)
+		}
+	}
+	if skus := h.SKUs(); len(skus) != 2 {
+		t.Errorf("got skus %v, want [1 2]", skus)
+	}
+}
+
+func TestHistoryReadOnly(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jd.history.jsonl")
+	h, err := OpenHistory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err = h.Record(observe("1", 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record without index, and one being written
+	data, _ := ioutil.ReadFile(filename)
+	line := data
+	data = append(data, line...)
+	data = append(data, line[:10]...)
+	if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenHistoryReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if lst, err := r.Query("1", time.Time{}); err != nil || len(lst) != 2 {
+		t.Errorf("got %d records %v, want 2", len(lst), err)
+	}
+	if err = r.Record(observe("1", 1)); err == nil {
+		t.Error("recorded while read only")
+	}
+	if after, _ := ioutil.ReadFile(filename); string(after) != string(data) {
+		t.Error("the file changed by read only")
+	}
+}
@@ -3,9 +3,11 @@ package core
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"mime"
 	"net/http"
@@ -13,6 +15,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -23,7 +26,6 @@ import (
 	"github.com/axgle/mahonia"
 	sjson "github.com/bitly/go-simplejson"
 	"github.com/pkg/errors"
-	clog "gopkg.in/clog.v1"
 )
 
 const (
@@ -35,6 +37,7 @@ const (
 	URLChangeCount = "http://cart.jd.com/changeNum.action"
 	URLCartInfo    = "https://cart.jd.com/cart.action"
 	URLOrderInfo   = "http://trade.jd.com/shopping/order/getOrderInfo.action"
+	URLBestCoupons = "http://trade.jd.com/shopping/dynamic/coupon/getBestVertualCoupons.action"
 	URLSubmitOrder = "http://trade.jd.com/shopping/order/submitOrder.action"
 )
 
@@ -68,32 +71,81 @@ var (
 	strSeperater = strings.Repeat("+", 60)
 )
 
+const (
+	defaultTimeout = 10 * time.Second
+
+	// the QR code expires after about 60 checks on the page
+	scanRetry = 50
+)
+
 // JDConfig ...
 type JDConfig struct {
-	Period     time.Duration // refresh period
-	ShipArea   string        // shipping area
-	AutoRush   bool          // continue rush when out of stock
-	AutoSubmit bool          // whether submit the order
+	Period     time.Duration   // refresh period
+	ShipArea   string          // shipping area
+	AutoRush   bool            // continue rush when out of stock
+	AutoSubmit bool            // whether submit the order
+	Account    string          // account name, each account has its own cookies
+	Notifiers  []Notifier      // notified on purchase events
+	History    *History        // record the price and stock seen, nil to disable
+	NoQRViewer bool            // do not open the QR image, get it by SessionExpired instead
+	DataDir    string          // where the cookies and QR image saved, current directory if empty
+	Proxy      string          // proxy URL of the requests, from the environment if empty
+	Timeout    time.Duration   // timeout of each request, 10s if 0
+	Retry      RetryPolicy     // zero for the default
+	Transport  TransportOption // connection tuning
+	Limiter    *RateLimiter    // share one to limit the requests of all accounts, only back off if nil
+	Logger     Logger          // where the logs go, nothing logged if nil
+
+	// TraceRequests log each request at LevelTrace, with the method, URL
+	// redacted, status and latency
+	TraceRequests bool
+}
+
+// RetryPolicy is how many times to retry before giving up
+//
+type RetryPolicy struct {
+	Scan    int `json:"scan"`    // checks of the QR code scanned, 50 by default, about 3 seconds each
+	Seckill int `json:"seckill"` // fetches of the seckill URL after the buy time, and submits of the seckill order, 60 by default
+	Budget  int `json:"budget"`  // consecutive failures of polling the price and stock allowed, 10 by default, see Monitor
 }
 
 // SKUInfo ...
 type SKUInfo struct {
-	ID          string
-	ExpectPrice float64
-	Price       float64
-	Count       int    // buying count
-	State       string // stock state 33 : on sale, 34 : out of stock
-	StateName   string // "现货" / "无货"
-	Name        string
-	Link        string
+	ID          string   `json:"id"`
+	ExpectPrice float64  `json:"-"`
+	Price       float64  `json:"price"`
+	Count       int      `json:"-"`          // buying count
+	State       string   `json:"state"`      // stock state 33 : on sale, 34 : out of stock
+	StateName   string   `json:"state_name"` // "现货" / "无货"
+	Name        string   `json:"name"`
+	Link        string   `json:"link"`
+	Areas       []string `json:"areas,omitempty"` // areas to check stock
 }
 
 // JingDong wrap jing dong operation
 type JingDong struct {
 	JDConfig
+	log    *logger
 	client *http.Client
 	jar    *SimpleJar
 	token  string
+
+	// cartLock serialize the changes of shopping cart and the submit,
+	// so that one order does not take goods added by others
+	cartLock sync.Mutex
+
+	// event subscribers
+	subLock sync.RWMutex
+	subs    []*Subscription
+
+	// notifySub receive the events for Notifiers
+	notifySub  *Subscription
+	notifyDone chan struct{}
+	notifying  sync.WaitGroup
+
+	// historySub receive the observations for History
+	historySub  *Subscription
+	historyDone chan struct{}
 }
 
 // NewJingDong create an object to wrap JingDong related operation
@@ -101,32 +153,82 @@ type JingDong struct {
 func NewJingDong(option JDConfig) *JingDong {
 	jd := &JingDong{
 		JDConfig: option,
+		log:      newLogger(option.Logger),
+	}
+	if jd.Timeout == 0 {
+		jd.Timeout = defaultTimeout
+	}
+	if jd.Retry.Scan == 0 {
+		jd.Retry.Scan = scanRetry
+	}
+	if jd.Retry.Seckill == 0 {
+		jd.Retry.Seckill = seckillRetry
+	}
+	if jd.Retry.Budget == 0 {
+		jd.Retry.Budget = defaultBudget
+	}
+	if jd.Limiter == nil {
+		jd.Limiter = NewRateLimiter(0, 0)
+	}
+
+	if jd.DataDir != "" {
+		if err := os.MkdirAll(jd.DataDir, 0700); err != nil {
+			jd.log.Error("创建数据目录失败: %s", err)
+		}
 	}
 
 	jd.jar = NewSimpleJar(JarOption{
 		JarType:  JarJson,
-		Filename: cookieFile,
+		Filename: jd.accountFile(cookieFile),
 	})
 
 	if err := jd.jar.Load(); err != nil {
-		clog.Error(0, "加载Cookies失败: %s", err)
+		jd.log.Error("加载Cookies失败: %s", err)
 		jd.jar.Clean()
 	}
 
+	// the timeout is applied by the transport for each endpoint
 	jd.client = &http.Client{
-		Timeout: 10 * time.Second,
-		Jar:     jd.jar,
+		Jar:       jd.jar,
+		Transport: jd.newTransport(),
 	}
 
+	jd.startNotifiers()
+	jd.startHistory()
+
 	return jd
 }
 
+// accountPattern is the account names allowed, as part of the file names
+var accountPattern = regexp.MustCompile(`^[\w.@-]+$`)
+
+// ValidAccount check whether the account name is allowed, empty for the
+// default account
+//
+func ValidAccount(name string) bool {
+	return name == "" || accountPattern.MatchString(name)
+}
+
+// accountFile return the file name for the account in DataDir, jd.cookies
+// is jd.<account>.cookies for example
+//
+func (jd *JingDong) accountFile(name string) string {
+	if jd.Account != "" {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "." + jd.Account + ext
+	}
+	return filepath.Join(jd.DataDir, name)
+}
+
 // Release the resource opened
 //
 func (jd *JingDong) Release() {
+	jd.stopNotifiers()
+	jd.stopHistory()
+
 	if jd.jar != nil {
 		if err := jd.jar.Persist(); err != nil {
-			clog.Error(0, "Failed to persist cookiejar. error %+v.", err)
+			jd.log.Error("Failed to persist cookiejar. error %+v.", err)
 		}
 	}
 }
@@ -144,7 +246,7 @@ func truncate(str string) string {
 
 // if response data compressed by gzip, unzip first
 //
-func responseData(resp *http.Response) []byte {
+func (jd *JingDong) responseData(resp *http.Response) []byte {
 	if resp == nil {
 		return nil
 	}
@@ -152,7 +254,7 @@ func responseData(resp *http.Response) []byte {
 	var reader io.Reader
 	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
-		//clog.Trace("Encoding: %+v", resp.Header.Get("Content-Encoding"))
+		//jd.log.Trace("Encoding: %+v", resp.Header.Get("Content-Encoding"))
 		reader, _ = gzip.NewReader(resp.Body)
 	default:
 		reader = resp.Body
@@ -160,7 +262,7 @@ func responseData(resp *http.Response) []byte {
 
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
-		clog.Error(0, "读取响应数据失败: %+v", err)
+		jd.log.Error("读取响应数据失败: %+v", err)
 		return nil
 	}
 
@@ -188,22 +290,19 @@ func (jd *JingDong) validateLogin(URL string) bool {
 	)
 
 	if req, err = http.NewRequest("GET", URL, nil); err != nil {
-		clog.Info("请求（%+v）失败: %+v", URL, err)
+		jd.log.Info("请求（%+v）失败: %+v", URL, err)
 		return false
 	}
 
-	jd.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+	// a copy of the client, so that the rush going on is not affected
+	client := *jd.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		// disable redirect
 		return http.ErrUseLastResponse
 	}
 
-	defer func() {
-		// restore to default
-		jd.client.CheckRedirect = nil
-	}()
-
-	if resp, err = jd.client.Do(req); err != nil {
-		clog.Info("需要重新登录: %+v", err)
+	if resp, err = client.Do(req); err != nil {
+		jd.log.Info("需要重新登录: %+v", err)
 		return false
 	}
 
@@ -211,14 +310,37 @@ func (jd *JingDong) validateLogin(URL string) bool {
 	data, _ := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		clog.Info("需要重新登录")
+		jd.log.Info("需要重新登录")
 		return false
 	}
 
-	clog.Trace("Response Data: %s", string(data))
+	jd.log.Trace("Response Data: %s", string(data))
 	return true
 }
 
+// LoggedIn check whether the cookies are still valid
+//
+func (jd *JingDong) LoggedIn() bool {
+	return jd.validateLogin(URLForQR[4])
+}
+
+// Nickname return the nick name of the account logged in, from the cookies
+//
+func (jd *JingDong) Nickname() string {
+	name, err := url.QueryUnescape(jd.jar.Get("unick"))
+	if err != nil {
+		return jd.jar.Get("unick")
+	}
+	return name
+}
+
+// Logout clean the cookies, so that the next Login has to scan the QR code
+//
+func (jd *JingDong) Logout() error {
+	jd.jar.Clean()
+	return jd.jar.Persist()
+}
+
 // load the login page
 //
 func (jd *JingDong) loginPage(URL string) error {
@@ -229,14 +351,14 @@ func (jd *JingDong) loginPage(URL string) error {
 	)
 
 	if req, err = http.NewRequest("GET", URL, nil); err != nil {
-		clog.Info("请求（%+v）失败: %+v", URL, err)
+		jd.log.Info("请求（%+v）失败: %+v", URL, err)
 		return err
 	}
 
 	applyCustomHeader(req, DefaultHeaders)
 
 	if resp, err = jd.client.Do(req); err != nil {
-		clog.Info("请求登录页失败: %+v", err)
+		jd.log.Info("请求登录页失败: %+v", err)
 		return err
 	}
 
@@ -261,39 +383,49 @@ func (jd *JingDong) loadQRCode(URL string) (string, error) {
 	u.RawQuery = q.Encode()
 
 	if req, err = http.NewRequest("GET", u.String(), nil); err != nil {
-		clog.Error(0, "请求（%+v）失败: %+v", URL, err)
+		jd.log.Error("请求（%+v）失败: %+v", URL, err)
 		return "", err
 	}
 
 	applyCustomHeader(req, DefaultHeaders)
 	if resp, err = jd.client.Do(req); err != nil {
-		clog.Error(0, "下载二维码失败: %+v", err)
+		jd.log.Error("下载二维码失败: %+v", err)
 		return "", err
 	}
 
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		clog.Error(0, "http status : %d/%s", resp.StatusCode, resp.Status)
+		jd.log.Error("http status : %d/%s", resp.StatusCode, resp.Status)
 	}
 
 	// from mime get QRCode image type
 	//  content-type:image/png
 	//
-	filename := qrCodeFile + ".png"
+	filename := jd.accountFile(qrCodeFile) + ".png"
 	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
-	if typ, e := mime.ExtensionsByType(mt); e == nil {
-		filename = qrCodeFile + typ[0]
+	if typ, e := mime.ExtensionsByType(mt); e == nil && len(typ) > 0 {
+		filename = jd.accountFile(qrCodeFile) + typ[0]
 	}
 
-	dir, _ := os.Getwd()
-	filename = filepath.Join(dir, filename)
-	clog.Trace("QR Image: %s", filename)
+	// the absolute path for the viewer and the notifiers, -data-dir may be
+	// absolute already
+	if abs, e := filepath.Abs(filename); e == nil {
+		filename = abs
+	}
+	jd.log.Trace("QR Image: %s", filename)
 
-	file, _ := os.Create(filename)
-	defer file.Close()
+	file, err := os.Create(filename)
+	if err != nil {
+		jd.log.Error("保存二维码失败: %+v", err)
+		return "", err
+	}
 
-	if _, err = io.Copy(file, resp.Body); err != nil {
-		clog.Error(0, "下载二维码失败: %+v", err)
+	_, err = io.Copy(file, resp.Body)
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		jd.log.Error("下载二维码失败: %+v", err)
 		return "", err
 	}
 
@@ -326,7 +458,7 @@ func (jd *JingDong) waitForScan(URL string) error {
 	u.RawQuery = q.Encode()
 
 	if req, err = http.NewRequest("GET", u.String(), nil); err != nil {
-		clog.Info("请求（%+v）失败: %+v", URL, err)
+		jd.log.Info("请求（%+v）失败: %+v", URL, err)
 		return err
 	}
 
@@ -336,34 +468,30 @@ func (jd *JingDong) waitForScan(URL string) error {
 	applyCustomHeader(req, DefaultHeaders)
 
 	// 页面上是回调60次后二维码失效
-	for retry := 50; retry != 0; retry-- {
+	for retry := jd.Retry.Scan; retry != 0; retry-- {
 		if resp, err = jd.client.Do(req); err != nil {
-			clog.Info("二维码失效：%+v", err)
+			jd.log.Info("二维码失效：%+v", err)
 			break
 		}
 
 		if resp.StatusCode == http.StatusOK {
-			respMsg := string(responseData(resp))
+			respMsg := jd.responseData(resp)
 			resp.Body.Close()
 
-			n1 := strings.Index(respMsg, "(")
-			n2 := strings.Index(respMsg, ")")
-
-			var js *sjson.Json
-			if js, err = sjson.NewJson([]byte(respMsg[n1+1 : n2])); err != nil {
-				clog.Error(0, "解析响应数据失败: %+v", err)
-				clog.Trace("Response data  : %+v", respMsg)
-				clog.Trace("Response Header: %+v", resp.Header)
+			code, msg, ticket, err := parseScanResult(respMsg)
+			if err != nil {
+				jd.log.Error("解析响应数据失败: %+v", err)
+				jd.log.Trace("Response data  : %s", respMsg)
+				jd.log.Trace("Response Header: %+v", resp.Header)
 				break
 			}
 
-			code := js.Get("code").MustInt()
 			if code == 200 {
-				jd.token = js.Get("ticket").MustString()
-				clog.Info("token : %+v", jd.token)
+				jd.token = ticket
+				jd.log.Info("token : %+v", jd.token)
 				break
 			} else {
-				clog.Info("%+v : %s", code, js.Get("msg").MustString())
+				jd.log.Info("%+v : %s", code, msg)
 				time.Sleep(time.Second * 3)
 			}
 		} else {
@@ -394,19 +522,19 @@ func (jd *JingDong) validateQRToken(URL string) error {
 	u.RawQuery = q.Encode()
 
 	if req, err = http.NewRequest("GET", u.String(), nil); err != nil {
-		clog.Info("请求（%+v）失败: %+v", URL, err)
+		jd.log.Info("请求（%+v）失败: %+v", URL, err)
 		return err
 	}
 
 	if resp, err = jd.client.Do(req); err != nil {
-		clog.Error(0, "二维码登陆校验失败: %+v", err)
+		jd.log.Error("二维码登陆校验失败: %+v", err)
 		return nil
 	}
 
 	if resp.StatusCode == http.StatusOK {
-		clog.Info("登陆成功, P3P: %s", resp.Header.Get("P3P"))
+		jd.log.Info("登陆成功, P3P: %s", resp.Header.Get("P3P"))
 	} else {
-		clog.Info("登陆失败")
+		jd.log.Info("登陆失败")
 		err = fmt.Errorf("%+v", resp.Status)
 	}
 
@@ -418,10 +546,10 @@ func (jd *JingDong) validateQRToken(URL string) error {
 // if the cookies file exits, will try cookies first.
 //
 func (jd *JingDong) Login(args ...interface{}) error {
-	clog.Info(strSeperater)
+	jd.log.Info(strSeperater)
 
 	if jd.validateLogin(URLForQR[4]) {
-		clog.Info("无需重新登录")
+		jd.log.Info("无需重新登录")
 		return nil
 	}
 
@@ -430,7 +558,7 @@ func (jd *JingDong) Login(args ...interface{}) error {
 		qrImg string
 	)
 
-	clog.Info("请打开京东手机客户端，准备扫码登陆:")
+	jd.log.Info("请打开京东手机客户端，准备扫码登陆:")
 	jd.jar.Clean()
 
 	if err = jd.loginPage(URLForQR[0]); err != nil {
@@ -441,6 +569,12 @@ func (jd *JingDong) Login(args ...interface{}) error {
 		return err
 	}
 
+	jd.publish(&SessionExpired{Time: time.Now(), QRImage: qrImg})
+
+	if jd.NoQRViewer {
+		return jd.finishLogin()
+	}
+
 	// for different platform
 	var cmd *exec.Cmd
 	switch runtime.GOOS {
@@ -454,15 +588,21 @@ func (jd *JingDong) Login(args ...interface{}) error {
 
 	// just start, do not wait it complete
 	if err = cmd.Start(); err != nil {
-		clog.Info("打开二维码图片失败: %+v.", err)
+		jd.log.Info("打开二维码图片失败: %+v.", err)
 		return err
 	}
 
-	if err = jd.waitForScan(URLForQR[2]); err != nil {
+	return jd.finishLogin()
+}
+
+// finishLogin wait the QR code scanned, and validate the token
+//
+func (jd *JingDong) finishLogin() error {
+	if err := jd.waitForScan(URLForQR[2]); err != nil {
 		return err
 	}
 
-	if err = jd.validateQRToken(URLForQR[3]); err != nil {
+	if err := jd.validateQRToken(URLForQR[3]); err != nil {
 		return err
 	}
 
@@ -473,114 +613,61 @@ func (jd *JingDong) Login(args ...interface{}) error {
 // CartDetails get the shopping cart details
 //
 func (jd *JingDong) CartDetails() error {
-	clog.Info(strSeperater)
-	clog.Info("购物车详情>")
-
-	var (
-		err  error
-		req  *http.Request
-		resp *http.Response
-		doc  *goquery.Document
-	)
-
-	if req, err = http.NewRequest("GET", URLCartInfo, nil); err != nil {
-		clog.Error(0, "请求（%+v）失败: %+v", URLCartInfo, err)
-		return err
-	}
-
-	if resp, err = jd.client.Do(req); err != nil {
-		clog.Error(0, "获取购物车详情错误: %+v", err)
-		return err
-	}
-	defer resp.Body.Close()
+	jd.log.Info(strSeperater)
+	jd.log.Info("购物车详情>")
 
-	if doc, err = goquery.NewDocumentFromReader(resp.Body); err != nil {
-		clog.Error(0, "分析购物车页面错误: %+v.", err)
+	doc, err := jd.loadCart()
+	if err != nil {
 		return err
 	}
 
-	clog.Info("购买  数量  价格      总价      编号      商品")
+	jd.log.Info("购买  数量  价格      总价      编号      商品")
 	cartFormat := "%-6s%-6s%-10s%-10s%-10s%s" // -用来指明左对齐
 
 	// 觉得这里还是要从cart-item-list开始，在下一级是不同的厂商，比如京东自营等。在下一级是店铺shop相关信息和商品列表item-list了。
 	// 商品列表里每个子项是一组，item-suit这种是套装，item-full这种事有折扣的？
-
-	// 这里先清空掉所有的选中（除了套装还没实现）
-
-	// 查找所有class属性包含item-item的div
-	doc.Find("div[class*='item-item item-selected']").Each(func(i int, p *goquery.Selection) {
-		// 购物车太乱，只显示当前选中的商品吧
+	for _, item := range parseCartItems(doc) {
 		check := " -"
-		// checkTag := p.Find("div.cart-checkbox input").Eq(0)
-		// if _, exist := checkTag.Attr("checked"); exist {
-		check = " +"
-		// }
-
-		count := "0"
-		if val, exist := p.Attr("num"); exist {
-			count = val
-		}
-
-		pid := ""
-		if idStr, exist := p.Attr("id"); exist {
-			pid = strings.TrimPrefix(idStr, "product_")
-		}
-
-		price := strings.Trim(p.Find("div.p-price strong").Eq(0).Text(), " ")
-		total := strings.Trim(p.Find("div.p-sum strong").Eq(0).Text(), " ")
-		gname := strings.Trim(p.Find("div.p-name a").Eq(0).Text(), " \n\t")
-		gname = truncate(gname)
-		clog.Info(cartFormat, check, count, price, total, pid, gname)
-
-		val, exist := doc.Find(fmt.Sprintf("input[p-type*='%s_']", pid)).Attr("value")
-		if !exist {
-			return
-		}
-		ss := strings.Split(val, "_")
-		if len(ss) < 2 {
-			return
-		}
-		ptype := ss[1]
-		promoID := "0"
-		if len(ss) > 2 {
-			promoID = ss[2]
+		if item.Selected {
+			check = " +"
 		}
+		jd.log.Info(cartFormat, check, strconv.Itoa(item.Count), item.Price, item.Total, item.ID, item.Name)
+	}
 
-		// 取消选中
-		jd.getResponse(http.MethodPost, "https://cart.jd.com/cancelItem.action", func(URL string) string {
-			u, _ := url.Parse(URL)
-			q := u.Query()
-			q.Set("t", "0")
-			q.Set("venderId", "8888")
-			q.Set("pid", pid)
-			q.Set("ptype", ptype) // TODO: 这个ptype不能是固定的哦
-			q.Set("targetId", promoID)
-			q.Set("packId", "0")
-			q.Set("promoID", promoID)
-			q.Set("manFanZeng", promoID)
-			q.Set("outSkus", "")
-			q.Set("random", strconv.FormatFloat(rand.Float64(), 'f', 16, 64))
-			q.Set("locationId", jd.ShipArea)
-			u.RawQuery = q.Encode()
-			return u.String()
-		})
+	totalCount, totalValue := parseCartTotal(doc)
+	jd.log.Info("总数: %s", totalCount)
+	jd.log.Info("总额: %s", totalValue)
 
-		// TODO: 取消掉所有不相关商品的选中勾选状态
-		// TODO: 如果购物车已经有指定数量的指定商品了，并且是有货的，就直接下单吧
-		// TODO: 检查价格条件是否满足
-	})
+	return nil
+}
 
-	totalCount := strings.Trim(doc.Find("div.amount-sum em").Eq(0).Text(), " ")
-	totalValue := strings.Trim(doc.Find("span.sumPrice em").Eq(0).Text(), " ")
-	clog.Info("总数: %s", totalCount)
-	clog.Info("总额: %s", totalValue)
+// OrderPreview is the summary of the order page, before submitting
+//
+type OrderPreview struct {
+	WarePrice    string `json:"ware_price"`    // 总金额
+	CashBack     string `json:"cash_back"`     // 返现
+	ShipPrice    string `json:"ship_price"`    // 运费
+	ServicePrice string `json:"service_price"` // 服务费
+	CouponPrice  string `json:"coupon_price"`  // 商品优惠
+	FreightPrice string `json:"freight_price"` // 运费优惠
+	Payment      string `json:"payment"`       // 应付总额
+	Phone        string `json:"phone"`
+	Addr         string `json:"addr"`
+}
 
-	return nil
+// OrderPreview load the order page of the goods selected in the cart
+//
+func (jd *JingDong) OrderPreview() (*OrderPreview, error) {
+	doc, err := jd.loadOrder()
+	if err != nil {
+		return nil, err
+	}
+	return parseOrderPreview(doc), nil
 }
 
-// OrderInfo shows the order detail information
+// loadOrder apply the best coupons, then download and parse the order page
 //
-func (jd *JingDong) OrderInfo() error {
+func (jd *JingDong) loadOrder() (*goquery.Document, error) {
 	var (
 		err  error
 		req  *http.Request
@@ -588,15 +675,11 @@ func (jd *JingDong) OrderInfo() error {
 		doc  *goquery.Document
 	)
 
-	clog.Info(strSeperater)
-	clog.Info("订单详情>")
-
 	// 发送使用最有优惠券组合
-	URLBestCoupons := "http://trade.jd.com/shopping/dynamic/coupon/getBestVertualCoupons.action"
 	_, err = jd.getResponse("POST", URLBestCoupons, nil)
 	if err != nil {
-		clog.Error(0, "请求使用最优组合券失败：%s", err.Error())
-		return err
+		jd.log.Error("请求使用最优组合券失败：%s", err.Error())
+		return nil, err
 	}
 
 	u, _ := url.Parse(URLOrderInfo)
@@ -605,70 +688,75 @@ func (jd *JingDong) OrderInfo() error {
 	u.RawQuery = q.Encode()
 
 	if req, err = http.NewRequest("GET", u.String(), nil); err != nil {
-		clog.Error(0, "请求（%+v）失败: %+v", URLCartInfo, err)
-		return err
+		jd.log.Error("请求（%+v）失败: %+v", URLCartInfo, err)
+		return nil, err
 	}
 
 	if resp, err = jd.client.Do(req); err != nil {
-		clog.Error(0, "获取订单页错误: %+v", err)
-		return err
+		jd.log.Error("获取订单页错误: %+v", err)
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 	if doc, err = goquery.NewDocumentFromReader(resp.Body); err != nil {
-		clog.Error(0, "分析订单页错误: %+v.", err)
-		return err
+		jd.log.Error("分析订单页错误: %+v.", err)
+		return nil, err
 	}
 
 	//h, _ := doc.Find("div.order-summary").Html()
-	//clog.Trace("订单页：%s", h)
-
-	if order := doc.Find("div.order-summary").Eq(0); order != nil {
-		warePrice := strings.Trim(order.Find("#warePriceId").Text(), " \t\n")
-		cashBack := strings.Trim(order.Find("#cachBackId").Text(), " \t\n")
-		shipPrice := strings.Trim(order.Find("#freightPriceId").Text(), " \t\n")
-		servicePrice := strings.Trim(order.Find("#serviceFeeId").Text(), " \t\n")
-		couponPrice := strings.Trim(order.Find("#couponPriceId").Text(), " \t\n")
-		freightPrice := strings.Trim(order.Find("#freeFreightPriceId").Text(), " \t\n")
-
-		if !strings.Contains(warePrice, "￥0.00") {
-			clog.Info("　总金额: %s", warePrice)
-		}
-		if !strings.Contains(cashBack, "￥0.00") {
-			clog.Info("　　返现: %s", cashBack)
-		}
-		if !strings.Contains(shipPrice, "￥0.00") {
-			clog.Info("　　运费: %s", shipPrice)
-		}
-		if !strings.Contains(servicePrice, "￥0.00") {
-			clog.Info("　服务费: %s", servicePrice)
-		}
-		if !strings.Contains(couponPrice, "￥0.00") {
-			clog.Info("商品优惠: %s", couponPrice)
-		}
-		if !strings.Contains(freightPrice, "￥0.00") {
-			clog.Info("运费优惠: %s", freightPrice)
-		}
-	}
+	//jd.log.Trace("订单页：%s", h)
+
+	return doc, nil
+}
+
+// OrderInfo shows the order detail information
+//
+func (jd *JingDong) OrderInfo() error {
+	jd.log.Info(strSeperater)
+	jd.log.Info("订单详情>")
 
-	if sum := doc.Find("div.trade-foot").Eq(0); sum != nil {
-		payment := strings.Trim(sum.Find("#sumPayPriceId").Text(), " \t\n")
-		phone := strings.Trim(sum.Find("#sendMobile").Text(), " \t\n")
-		addr := strings.Trim(sum.Find("#sendAddr").Text(), " \t\n")
+	o, err := jd.OrderPreview()
+	if err != nil {
+		return err
+	}
 
-		clog.Info("=======================>> 应付总额: %s", payment)
-		clog.Info("%s", phone)
-		clog.Info("%s", addr)
+	if !strings.Contains(o.WarePrice, "￥0.00") {
+		jd.log.Info("　总金额: %s", o.WarePrice)
+	}
+	if !strings.Contains(o.CashBack, "￥0.00") {
+		jd.log.Info("　　返现: %s", o.CashBack)
 	}
+	if !strings.Contains(o.ShipPrice, "￥0.00") {
+		jd.log.Info("　　运费: %s", o.ShipPrice)
+	}
+	if !strings.Contains(o.ServicePrice, "￥0.00") {
+		jd.log.Info("　服务费: %s", o.ServicePrice)
+	}
+	if !strings.Contains(o.CouponPrice, "￥0.00") {
+		jd.log.Info("商品优惠: %s", o.CouponPrice)
+	}
+	if !strings.Contains(o.FreightPrice, "￥0.00") {
+		jd.log.Info("运费优惠: %s", o.FreightPrice)
+	}
+
+	jd.log.Info("=======================>> 应付总额: %s", o.Payment)
+	jd.log.Info("%s", o.Phone)
+	jd.log.Info("%s", o.Addr)
 
 	return nil
 }
 
-// SubmitOrder ... submit order to JingDong, return orderID or error
+// SubmitOrder ... submit order to JingDong, the result and timing of the
+// attempt returned
 //
-func (jd *JingDong) SubmitOrder() int {
-	clog.Info(strSeperater)
-	clog.Info("提交订单>")
+func (jd *JingDong) SubmitOrder() *SubmitAttempt {
+	jd.log.Info(strSeperater)
+	jd.log.Info("提交订单>")
+
+	attempt := &SubmitAttempt{Time: time.Now(), ResultCode: -1}
+	defer func() {
+		attempt.Elapsed = time.Since(attempt.Time)
+	}()
 
 	data, err := jd.getResponse("POST", URLSubmitOrder, func(URL string) string {
 		queryString := map[string]string{
@@ -690,29 +778,42 @@ func (jd *JingDong) SubmitOrder() int {
 	})
 
 	if err != nil {
-		clog.Error(0, "提交订单失败: %+v", err)
-		return -1
+		jd.log.Error("提交订单失败: %+v", err)
+		attempt.Message = err.Error()
+		return attempt
 	}
 
 	var js *sjson.Json
 	if js, err = sjson.NewJson(data); err != nil {
-		clog.Info("Reponse Data: %s", data)
-		clog.Error(0, "无法解析订单响应数据: %+v", err)
-		return -1
+		jd.log.Info("Reponse Data: %s", data)
+		jd.log.Error("无法解析订单响应数据: %+v", err)
+		attempt.Message = err.Error()
+		return attempt
 	}
 
-	clog.Trace("订单: %s", data)
+	jd.log.Trace("订单: %s", data)
 
 	if succ, _ := js.Get("success").Bool(); succ {
-		orderID, _ := js.Get("orderId").Int64()
-		clog.Info("下单成功，订单号：%d", orderID)
-		return 0
+		attempt.OrderID, _ = js.Get("orderId").Int64()
+		attempt.ResultCode = 0
+		jd.log.With(Fields{"result_code": 0, "latency": time.Since(attempt.Time)}).Info("下单成功，订单号：%d", attempt.OrderID)
+		return attempt
 	}
 
-	res, _ := js.Get("resultCode").Int()
-	msg, _ := js.Get("message").String()
-	clog.Error(0, "下单失败, %d : %s", res, msg)
-	return res
+	attempt.ResultCode = failureCode(js)
+	attempt.Message, _ = js.Get("message").String()
+	jd.log.With(Fields{"result_code": attempt.ResultCode, "latency": time.Since(attempt.Time)}).Error("下单失败, %d : %s", attempt.ResultCode, attempt.Message)
+	return attempt
+}
+
+// failureCode return resultCode of the submit response not succeeded, -1
+// if missing or 0, so that the failure is never taken as success
+//
+func failureCode(js *sjson.Json) int {
+	if code, err := js.Get("resultCode").Int(); err == nil && code != 0 {
+		return code
+	}
+	return -1
 }
 
 // wrap http get/post request
@@ -748,181 +849,312 @@ func (jd *JingDong) getResponse(method, URL string, queryFun func(URL string) st
 		reader = resp.Body
 	}
 
-	return ioutil.ReadAll(reader)
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if throttledBody(resp.Header.Get("Content-Type"), data) {
+		return nil, jd.throttle(resp.Request.URL, "验证页面")
+	}
+	return data, nil
 }
 
-// getPrice return sku price by ID
+// Prices return the price of multiple sku by ID
 //
-//  [{"id":"J_5105046","p":"1999.00","m":"9999.00","op":"1999.00","tpp":"1949.00"}]
-//
-func (jd *JingDong) getPrice(ID string) (float64, error) {
+//	[{"id":"J_5105046","p":"1999.00","m":"9999.00","op":"1999.00","tpp":"1949.00"}]
+func (jd *JingDong) Prices(IDs []string) (map[string]float64, error) {
+	skuIds := make([]string, len(IDs))
+	for i, ID := range IDs {
+		skuIds[i] = "J_" + ID
+	}
+
 	data, err := jd.getResponse("GET", URLGoodsPrice, func(URL string) string {
 		u, _ := url.Parse(URLGoodsPrice)
 		q := u.Query()
 		q.Set("type", "1")
-		q.Set("skuIds", "J_"+ID)
+		q.Set("skuIds", strings.Join(skuIds, ","))
 		q.Set("pduid", strconv.FormatInt(time.Now().Unix()*1000, 10))
 		u.RawQuery = q.Encode()
-		// fmt.Println(u.String())
 		return u.String()
 	})
 
 	if err != nil {
-		clog.Error(0, "获取商品（%s）价格失败: %+v", ID, err)
-		return 0, err
+		jd.log.Error("获取商品（%s）价格失败: %+v", strings.Join(IDs, ","), err)
+		return nil, err
 	}
 
 	var js *sjson.Json
 	if js, err = sjson.NewJson(data); err != nil {
-		clog.Info("Response Data: %s", data)
-		clog.Error(0, "解析响应数据失败: %+v", err)
-		return 0, err
+		jd.log.Info("Response Data: %s", data)
+		jd.log.Error("解析响应数据失败: %+v", err)
+		return nil, err
 	}
 
-	str, err := js.GetIndex(0).Get("p").String()
+	arr, err := js.Array()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	prices := make(map[string]float64, len(arr))
+	for i := range arr {
+		item := js.GetIndex(i)
+		ID := strings.TrimPrefix(item.Get("id").MustString(), "J_")
+		str, err := item.Get("p").String()
+		if err != nil {
+			return nil, err
+		}
+		if prices[ID], err = strconv.ParseFloat(str, 64); err != nil {
+			return nil, err
+		}
+		jd.publish(&Observation{Time: now, SKU: ID, Price: prices[ID]})
+	}
+
+	return prices, nil
+}
+
+// getPrice return sku price by ID
+//
+func (jd *JingDong) getPrice(ID string) (float64, error) {
+	prices, err := jd.Prices([]string{ID})
 	if err != nil {
 		return 0, err
 	}
 
-	return strconv.ParseFloat(str, 64)
+	price, exist := prices[ID]
+	if !exist {
+		return 0, fmt.Errorf("无效响应数据")
+	}
+	return price, nil
+}
+
+// StockState is the stock state of sku
+//
+type StockState struct {
+	State     string `json:"state"` // 33 : on sale, 34 : out of stock
+	StateName string `json:"state_name"`
 }
 
-// stockState return stock state
+// StockStates return stock state of multiple sku in the area
 // http://c0.3.cn/stock?skuId=531065&area=1_72_2799_0&cat=1,1,1&buyNum=1
 // http://c0.3.cn/stock?skuId=531065&area=1_72_2799_0&cat=1,1,1
 // https://c0.3.cn/stocks?type=getstocks&skuIds=4099139&area=1_72_2799_0&_=1499755881870
 //
 // {"3133811":{"StockState":33,"freshEdi":null,"skuState":1,"PopType":0,"sidDely":"40",
-//	"channel":1,"StockStateName":"现货","rid":null,"rfg":0,"ArrivalDate":"",
-//  "IsPurchase":true,"rn":-1}}
-func (jd *JingDong) stockState(ID string) (string, string, error) {
+//
+//		"channel":1,"StockStateName":"现货","rid":null,"rfg":0,"ArrivalDate":"",
+//	 "IsPurchase":true,"rn":-1}}
+func (jd *JingDong) StockStates(IDs []string, area string) (map[string]*StockState, error) {
+	var u *url.URL
 	data, err := jd.getResponse("GET", URLSKUState, func(URL string) string {
-		u, _ := url.Parse(URL)
+		u, _ = url.Parse(URL)
 		q := u.Query()
 		q.Set("type", "getstocks")
-		q.Set("skuIds", ID)
-		q.Set("area", jd.ShipArea)
+		q.Set("skuIds", strings.Join(IDs, ","))
+		q.Set("area", area)
 		q.Set("_", strconv.FormatInt(time.Now().Unix()*1000, 10))
 		//q.Set("cat", "1,1,1")
 		//q.Set("buyNum", strconv.Itoa(1))
 		u.RawQuery = q.Encode()
-		fmt.Println(u.String())
 		return u.String()
 	})
 
 	if err != nil {
-		clog.Error(0, "获取商品（%s）库存失败: %+v", ID, err)
-		return "", "", err
+		jd.log.Error("获取商品（%s）库存失败: %+v", strings.Join(IDs, ","), err)
+		return nil, err
 	}
 
 	// return GBK encoding
 	dec := mahonia.NewDecoder("gbk")
 	decString := dec.ConvertString(string(data))
-	//clog.Trace(decString)
+	//jd.log.Trace(decString)
+
+	// an empty stock instead of the goods asked when throttled
+	if str := strings.TrimSpace(decString); str == "" || str == "{}" {
+		return nil, jd.throttle(u, "库存数据为空")
+	}
 
 	var js *sjson.Json
 	if js, err = sjson.NewJson([]byte(decString)); err != nil {
-		clog.Info("Response Data: %s", data)
-		clog.Error(0, "解析库存数据失败: %+v", err)
+		jd.log.Info("Response Data: %s", data)
+		jd.log.Error("解析库存数据失败: %+v", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	states := make(map[string]*StockState, len(IDs))
+	for _, ID := range IDs {
+		//if sku, exist := js.CheckGet("stock"); exist {
+		if sku, exist := js.CheckGet(ID); exist {
+			state, _ := sku.Get("StockState").Int()
+			stateName, _ := sku.Get("StockStateName").String()
+			states[ID] = &StockState{State: strconv.Itoa(state), StateName: stateName}
+			jd.publish(&Observation{Time: now, SKU: ID, Area: area, State: states[ID].State, StateName: stateName})
+		}
+	}
+
+	return states, nil
+}
+
+// stockState return stock state of sku in the area
+//
+func (jd *JingDong) stockState(ID, area string) (string, string, error) {
+	states, err := jd.StockStates([]string{ID}, area)
+	if err != nil {
 		return "", "", err
 	}
 
-	//if sku, exist := js.CheckGet("stock"); exist {
-	if sku, exist := js.CheckGet(ID); exist {
-		skuState, _ := sku.Get("StockState").Int()
-		skuStateName, _ := sku.Get("StockStateName").String()
-		return strconv.Itoa(skuState), skuStateName, nil
+	if s, exist := states[ID]; exist {
+		return s.State, s.StateName, nil
 	}
 
 	return "", "", fmt.Errorf("无效响应数据")
 }
 
-// skuDetail get sku detail information
+// skuStock return the stock state of sku. With multiple areas, the sku is
+// in stock when any of the areas has stock.
 //
-func (jd *JingDong) skuDetail(ID string) (*SKUInfo, error) {
-	g := &SKUInfo{ID: ID}
+func (jd *JingDong) skuStock(sku *SKUInfo) (string, string, error) {
+	areas := sku.Areas
+	if len(areas) == 0 {
+		areas = []string{jd.ShipArea}
+	}
 
-	// response context encoding by GBK
-	//
+	var (
+		err       error
+		state     string
+		stateName string
+	)
+	for _, area := range areas {
+		if state, stateName, err = jd.stockState(sku.ID, area); err != nil {
+			return "", "", err
+		}
+		if state == "33" {
+			break
+		}
+	}
+
+	return state, stateName, nil
+}
+
+// updatePrice refresh the price of sku, PriceChanged fired if changed
+//
+func (jd *JingDong) updatePrice(sku *SKUInfo) error {
+	price, err := jd.getPrice(sku.ID)
+	if err != nil {
+		return err
+	}
+
+	if price != sku.Price {
+		e := &PriceChanged{
+			Time:     time.Now(),
+			SKU:      sku.ID,
+			Name:     sku.Name,
+			OldPrice: sku.Price,
+			Price:    price,
+		}
+		if sku.ExpectPrice != math.MaxFloat64 {
+			e.Expect = sku.ExpectPrice
+		}
+		jd.publish(e)
+	}
+
+	sku.Price = price
+	return nil
+}
+
+// updateStock refresh the stock state of sku, StockChanged fired if changed
+//
+func (jd *JingDong) updateStock(sku *SKUInfo) error {
+	state, stateName, err := jd.skuStock(sku)
+	if err != nil {
+		return err
+	}
+
+	if state != sku.State {
+		jd.publish(&StockChanged{
+			Time:         time.Now(),
+			SKU:          sku.ID,
+			Name:         sku.Name,
+			OldState:     sku.State,
+			OldStateName: sku.StateName,
+			State:        state,
+			StateName:    stateName,
+		})
+	}
+
+	sku.State, sku.StateName = state, stateName
+	return nil
+}
+
+// skuPage fill the name and cart link of sku from the goods page
+//
+func (jd *JingDong) skuPage(g *SKUInfo) error {
+	doc, err := jd.loadSKUPage(g.ID)
+	if err != nil {
+		return err
+	}
+	g.Name, g.Link = parseSKUPage(doc)
+	return nil
+}
+
+// loadSKUPage download and parse the goods page, encoded by GBK
+//
+func (jd *JingDong) loadSKUPage(ID string) (*goquery.Document, error) {
 	itemURL := fmt.Sprintf("http://item.jd.com/%s.html", ID)
 	data, err := jd.getResponse("GET", itemURL, nil)
 	if err != nil {
-		clog.Error(0, "获取商品页面失败: %+v", err)
+		jd.log.Error("获取商品页面失败: %+v", err)
 		return nil, err
 	}
 
 	doc, err := goquery.NewDocumentFromReader(bytes.NewBuffer(data))
 	if err != nil {
-		clog.Error(0, "解析商品页面失败: %+v", err)
+		jd.log.Error("解析商品页面失败: %+v", err)
 		return nil, err
 	}
+	return doc, nil
+}
 
-	if link, exist := doc.Find("a#InitCartUrl").Attr("href"); exist {
-		g.Link = link
-		if !strings.HasPrefix(link, "https:") { // 恩，加入购物车的链接，必须走https
-			g.Link = "https:" + link
-		}
+// SKUDetail get sku detail information
+//
+func (jd *JingDong) SKUDetail(ID string, areas []string) (*SKUInfo, error) {
+	g := &SKUInfo{ID: ID, Areas: areas}
+	if err := jd.skuPage(g); err != nil {
+		return nil, err
 	}
 
-	dec := mahonia.NewDecoder("gbk")
-	//rd := dec.NewReader()
-
-	g.Name = strings.Trim(dec.ConvertString(doc.Find("div.sku-name").Text()), " \t\n")
-	g.Name = truncate(g.Name)
-
 	// ? 为什么不直接从商品详情页拿价格呢？
-	g.Price, err = jd.getPrice(ID)
-	if err != nil {
+	if err := jd.updatePrice(g); err != nil {
 		return nil, err
 	}
-	g.State, g.StateName, err = jd.stockState(ID)
-	if err != nil {
+	if err := jd.updateStock(g); err != nil {
 		return nil, err
 	}
 
-	clog.Info("编号: %s, 库存: %s, 价格: %.2f, 链接: %s", g.ID, g.StateName, g.Price, g.Link)
+	jd.log.Info("编号: %s, 库存: %s, 价格: %.2f, 链接: %s", g.ID, g.StateName, g.Price, g.Link)
 
 	return g, nil
 }
 
 func (jd *JingDong) changeCount(ID string, count int) error {
 	// 从购物车页面，获取ptype和promoID参数
-	var (
-		err  error
-		req  *http.Request
-		resp *http.Response
-		doc  *goquery.Document
-	)
-
-	if req, err = http.NewRequest("GET", URLCartInfo, nil); err != nil {
-		clog.Error(0, "请求（%+v）失败: %+v", URLCartInfo, err)
-		return err
-	}
-
-	if resp, err = jd.client.Do(req); err != nil {
-		clog.Error(0, "获取购物车详情错误: %+v", err)
+	items, err := jd.CartItems()
+	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if doc, err = goquery.NewDocumentFromReader(resp.Body); err != nil {
-		clog.Error(0, "分析购物车页面错误: %+v.", err)
-		return err
+	var item *CartItem
+	for _, it := range items {
+		if it.ID == ID {
+			item = it
+			break
+		}
 	}
-
-	val, exist := doc.Find(fmt.Sprintf("input[p-type*='%s_']", ID)).Attr("value")
-	if !exist {
+	if item == nil {
 		return errors.Errorf("找不到商品复选框内携带属性")
 	}
-	ss := strings.Split(val, "_")
-	if len(ss) < 2 {
-		return errors.Errorf("商品属性获取失败")
-	}
-	ptype := ss[1]
-	promoID := "0"
-	if len(ss) > 2 {
-		promoID = ss[2]
-	}
+	ptype, promoID := item.PType, item.PromoID
 
 	data, err := jd.getResponse("POST", URLChangeCount, func(URL string) string {
 		u, _ := url.Parse(URL)
@@ -943,13 +1175,13 @@ func (jd *JingDong) changeCount(ID string, count int) error {
 	})
 
 	if err != nil {
-		clog.Error(0, "修改商品数量失败: %+v", err)
+		jd.log.Error("修改商品数量失败: %+v", err)
 		return err
 	}
 
 	js, err := sjson.NewJson(data)
 	if err != nil {
-		// clog.Trace(string(data))
+		// jd.log.Trace(string(data))
 		return errors.Wrap(err, "unmarshal repsonse failed")
 	}
 	c, err := js.Get("pcount").Int()
@@ -960,17 +1192,34 @@ func (jd *JingDong) changeCount(ID string, count int) error {
 		return errors.New("未能设置成期望的数量")
 	}
 
+	jd.publish(&CartUpdated{Time: time.Now(), SKU: ID, Name: item.Name, Action: CartCount, Count: count})
+
 	return nil
 }
 
-func (jd *JingDong) buyGood(sku *SKUInfo) error {
+// addToCart put the goods into shopping cart by gate.action
+//
+func (jd *JingDong) addToCart(sku *SKUInfo) error {
+	doc, err := jd.gate(sku)
+	if err != nil {
+		return err
+	}
+
+	if !parseAddToCart(doc) {
+		return errors.New("找不到加入购物车成功的标记")
+	}
+
+	return jd.changeCount(sku.ID, sku.Count)
+}
+
+// gate send gate.action of the goods, the result page returned
+//
+func (jd *JingDong) gate(sku *SKUInfo) (*goquery.Document, error) {
 	var (
 		err  error
 		data []byte
 		doc  *goquery.Document
 	)
-	clog.Info(strSeperater)
-	clog.Info("购买商品: %s", sku.ID)
 
 	// 准备好商品购买链接
 	if sku.Link == "" || sku.Count != 1 {
@@ -984,123 +1233,140 @@ func (jd *JingDong) buyGood(sku *SKUInfo) error {
 	}
 
 	if _, err := url.Parse(sku.Link); err != nil {
-		clog.Error(0, "商品购买链接无效: <%s>", sku.Link)
-		return fmt.Errorf("无效商品购买链接<%s>", sku.Link)
+		jd.log.Error("商品购买链接无效: <%s>", sku.Link)
+		return nil, fmt.Errorf("无效商品购买链接<%s>", sku.Link)
 	}
 
 	// 加入购物车
 	if data, err = jd.getResponse("GET", sku.Link, nil); err != nil {
-		clog.Error(0, "商品(%s)购买失败: %+v", sku.ID, err)
-		return err
+		jd.log.Error("商品(%s)购买失败: %+v", sku.ID, err)
+		return nil, err
 	}
 
 	if doc, err = goquery.NewDocumentFromReader(bytes.NewBuffer(data)); err != nil {
-		clog.Error(0, "响应解析失败: %+v", err)
-		return err
+		jd.log.Error("响应解析失败: %+v", err)
+		return nil, err
 	}
+	return doc, nil
+}
 
-	succFlag := doc.Find("h3.ftx-02").Text()
-	if succFlag == "" {
-		succFlag = doc.Find("div.p-name a").Text()
-		if succFlag == "" {
-			return errors.New("找不到加入购物车成功的标记")
-		}
-	}
+// buyGood make sure the goods is in the shopping cart with expected count
+// and selected, then wait until the price and stock meet the condition.
+// item is the entry already in the cart, nil if not exist. The progress is
+// recorded into report.
+//
+func (jd *JingDong) buyGood(ctx context.Context, sku *SKUInfo, item *CartItem, report *RushReport) error {
+	log := jd.log.With(Fields{"sku": sku.ID})
+	log.Info(strSeperater)
+	log.Info("购买商品: %s", sku.ID)
+	defer report.observe(sku)
 
-	err = jd.changeCount(sku.ID, sku.Count)
-	if err != nil {
+	if err := jd.cartGood(sku, item, false, report); err != nil {
 		return err
 	}
+	return jd.waitGood(ctx, sku, report)
+}
 
-	clog.Info("成功加入进购物车 %d 个 %s", sku.Count, sku.Name)
-
-	// 检测是否达到购买条件
-	if sku.Price > sku.ExpectPrice || sku.State != "33" {
-		if !jd.AutoRush {
-			return errors.New("不满足下单条件")
-		}
+// monitorGood is buyGood of StrategyMonitor, wait until the price and stock
+// meet the condition first, then put the goods in the shopping cart, so
+// that the cart is not changed while waiting. item is only the snapshot
+// before waiting, the cart entry is loaded again.
+//
+func (jd *JingDong) monitorGood(ctx context.Context, sku *SKUInfo, item *CartItem, report *RushReport) error {
+	log := jd.log.With(Fields{"sku": sku.ID})
+	log.Info(strSeperater)
+	log.Info("监控商品: %s", sku.ID)
+	defer report.observe(sku)
 
-		// 只要有一个条件不满足，就全部重新测试
-		for sku.Price > sku.ExpectPrice || sku.State != "33" {
-			time.Sleep(jd.Period)
+	if err := jd.waitGood(ctx, sku, report); err != nil {
+		return err
+	}
+	return jd.cartGood(sku, item, true, report)
+}
 
-			// 拿价钱
-			if sku.Price > sku.ExpectPrice {
-				clog.Info("商品%s当前价格（%.2f) 超出期望价格（%.2f)，开始监听。", sku.ID, sku.Price, sku.ExpectPrice)
+// cartGood put the goods in the shopping cart with expected count and
+// selected, item is the entry already in the cart, nil if not exist. With
+// reload, item is replaced by the entry in the cart now, since the cart may
+// have changed after item was loaded.
+//
+func (jd *JingDong) cartGood(sku *SKUInfo, item *CartItem, reload bool, report *RushReport) error {
+	var err error
+	log := jd.log.With(Fields{"sku": sku.ID})
+
+	jd.cartLock.Lock()
+	if reload {
+		var items []*CartItem
+		if items, err = jd.CartItems(); err != nil {
+			jd.cartLock.Unlock()
+			return err
+		}
+		item = nil
+		for _, it := range items {
+			if it.ID == sku.ID {
+				item = it
 			}
+		}
+	}
 
-			sku.Price, err = jd.getPrice(sku.ID)
-			if err != nil {
-				clog.Error(0, "获取(%s)价格失败: %+v", sku.ID, err)
+	if item == nil {
+		if err = jd.addToCart(sku); err != nil {
+			jd.cartLock.Unlock()
+			return err
+		}
+		log.Info("成功加入进购物车 %d 个 %s", sku.Count, sku.Name)
+		jd.publish(&CartUpdated{Time: time.Now(), SKU: sku.ID, Name: sku.Name, Action: CartAdd, Count: sku.Count})
+	} else {
+		// 购物车里已经有了，不用再走gate.action
+		if item.Count != sku.Count {
+			if err = jd.changeCount(sku.ID, sku.Count); err != nil {
+				jd.cartLock.Unlock()
 				return err
 			}
-			if sku.Price > sku.ExpectPrice {
-				continue
-			}
-
-			// 拿库存
-			if sku.State != "33" {
-				clog.Info("商品%s库存不足，正在重新查询库存。", sku.ID)
-			}
-			sku.State, sku.StateName, err = jd.stockState(sku.ID)
-			if err != nil {
-				clog.Error(0, "获取(%s)库存失败: %+v", sku.ID, err)
+			log.Info("购物车内商品 %s 数量由 %d 修改为 %d", sku.ID, item.Count, sku.Count)
+			item.Count = sku.Count
+		}
+		if !item.Selected {
+			if err = jd.selectCartItem(item, true); err != nil {
+				jd.cartLock.Unlock()
 				return err
 			}
 		}
+		log.Info("购物车内已有 %d 个 %s", sku.Count, sku.Name)
+		jd.publish(&CartUpdated{Time: time.Now(), SKU: sku.ID, Name: sku.Name, Action: CartReuse, Count: sku.Count})
 	}
-	return nil
-}
+	jd.cartLock.Unlock()
 
-type ExpectProduct struct {
-	ID    string
-	Num   int
-	Price float64
+	report.update(sku.ID, func(r *ItemReport) {
+		r.Added = true
+		r.CountSet = true
+	})
+	return nil
 }
 
-func (jd *JingDong) RushBuy(skuLst []*ExpectProduct) {
-	var wg sync.WaitGroup
-	for _, p := range skuLst {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if sku, err := jd.skuDetail(p.ID); err == nil {
-				sku.ExpectPrice = p.Price
-				sku.Count = p.Num
-				if err = jd.buyGood(sku); err != nil {
-					clog.Error(0, "加入 %d 个 %s 到购物车失败：%s", sku.Count, sku.ID, err.Error())
-				}
-			}
-		}()
-	}
-
-	wg.Wait()
-	fmt.Println()
-	jd.OrderInfo()
-
-	if jd.AutoSubmit {
-
-	SUBMITORDER:
-		res := jd.SubmitOrder()
-		if res == 0 {
-			return
+// waitGood wait until the price and stock meet the condition by Monitor,
+// the time ready is recorded into report
+//
+func (jd *JingDong) waitGood(ctx context.Context, sku *SKUInfo, report *RushReport) error {
+	// 检测是否达到购买条件
+	m := jd.NewMonitor(sku)
+	if !m.Ready() {
+		if !jd.AutoRush {
+			return errors.New("不满足下单条件")
 		}
 
-		switch res {
-		case 0:
-			return
-		case 61036: // 预约抢购，暂不支持购买的商品
-			time.Sleep(4900 * time.Millisecond)
-		case 60017: // 您多次提交过快，请稍后再试
-			time.Sleep(1 * time.Second)
-			// 这种抢购商品提前加入购物车下单的竟然没用
-		case 600126: // 抱歉，玩客云 私人云盘 迅雷 赚钱宝 3代 不止会赚钱 极速下载 隐私加密 手机扩容 多屏播放 轻NAS 曜石黑正在参与抢购活动，请重新回到商品详情页，使用“立即抢购”进行购买
-			time.Sleep(1 * time.Second)
-		default:
-			clog.Error(0, "unknown resultCode for submitorder:", res)
-			return
+		// 只要有一个条件不满足，就全部重新测试
+		err := m.Wait(ctx)
+		_, failures := m.Failures()
+		report.update(sku.ID, func(r *ItemReport) {
+			r.Failures = failures
+		})
+		if err != nil {
+			return err
 		}
-
-		goto SUBMITORDER
 	}
+
+	report.update(sku.ID, func(r *ItemReport) {
+		r.ReadyAt = time.Now()
+	})
+	return nil
 }
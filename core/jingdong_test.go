@@ -0,0 +1,43 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadQRCode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\nqrcode"))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cases := []struct {
+		name    string
+		dataDir string // set after NewJingDong, which creates it
+		want    string // empty for error
+	}{
+		{"absolute data dir", dir, filepath.Join(dir, "jd.alice.qr.png")},
+		{"missing data dir", filepath.Join(dir, "missing"), ""},
+	}
+
+	for _, c := range cases {
+		jd := NewJingDong(JDConfig{Account: "alice", DataDir: dir})
+		jd.DataDir = c.dataDir
+
+		filename, err := jd.loadQRCode(ts.URL)
+		jd.Release()
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("%s: saved to %s, want error", c.name, filename)
+			}
+			continue
+		}
+		if err != nil || filename != c.want {
+			t.Errorf("%s: got %s %v, want %s", c.name, filename, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+
+	sjson "github.com/bitly/go-simplejson"
+	"github.com/pkg/errors"
+)
+
+// ErrNotJSONP is the cause of the errors of decodeJSONP, the response is
+// an error page or the format changed
+var ErrNotJSONP = errors.New("不是JSONP格式的响应")
+
+// decodeJSONP return the JSON wrapped in the JSONP response, such as
+//
+//  jQuery123456({"code":201,"msg":"二维码未扫描 (请扫描)"});
+//
+// The callback may be a dotted name, and prefixed by a comment like /**/.
+// Plain JSON is returned as is, for the endpoints ignoring the callback.
+//
+func decodeJSONP(data []byte) ([]byte, error) {
+	s := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+
+	// the comment some servers put before the callback
+	for bytes.HasPrefix(s, []byte("/*")) {
+		end := bytes.Index(s, []byte("*/"))
+		if end < 0 {
+			return nil, notJSONP(data)
+		}
+		s = bytes.TrimSpace(s[end+2:])
+	}
+
+	if len(s) > 0 && (s[0] == '{' || s[0] == '[') {
+		if !json.Valid(s) {
+			return nil, notJSONP(data)
+		}
+		return s, nil
+	}
+
+	// callback name
+	n := 0
+	for n < len(s) && isCallbackChar(s[n]) {
+		n++
+	}
+	if n == 0 {
+		return nil, notJSONP(data)
+	}
+	s = bytes.TrimSpace(s[n:])
+
+	// (payload) with optional ; after, the payload may contain parentheses
+	s = bytes.TrimSpace(bytes.TrimRight(s, "; \t\r\n"))
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		return nil, notJSONP(data)
+	}
+	s = bytes.TrimSpace(s[1 : len(s)-1])
+
+	if !json.Valid(s) {
+		return nil, notJSONP(data)
+	}
+	return s, nil
+}
+
+// parseJSONP decode the JSONP response into JSON object
+//
+func parseJSONP(data []byte) (*sjson.Json, error) {
+	s, err := decodeJSONP(data)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.NewJson(s)
+}
+
+func isCallbackChar(c byte) bool {
+	return c == '_' || c == '$' || c == '.' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// notJSONP wrap ErrNotJSONP with the beginning of the response
+//
+func notJSONP(data []byte) error {
+	return errors.Wrapf(ErrNotJSONP, "%q", truncate(string(data)))
+}
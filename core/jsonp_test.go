@@ -0,0 +1,45 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDecodeJSONP(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want string // empty for ErrNotJSONP
+	}{
+		{"nested parentheses", `cb({"msg":"a (b) c"});`, `{"msg":"a (b) c"}`},
+		{"whitespace", " \r\n\tcb ( {\"code\":201} ) ;\n", `{"code":201}`},
+		{"bom", "\xef\xbb\xbfcb({\"code\":201})", `{"code":201}`},
+		{"comment", `/**/ cb({"code":201});`, `{"code":201}`},
+		{"dotted callback", `jQuery.fn.cb123({"code":200,"ticket":"t"})`, `{"code":200,"ticket":"t"}`},
+		{"plain json", ` {"code":200} `, `{"code":200}`},
+		{"html error page", "<html><body>系统繁忙 (500)</body></html>", ""},
+		{"empty", "", ""},
+		{"unclosed", "cb(", ""},
+		{"no open", "cb)", ""},
+		{"unclosed comment", `/* cb({"code":201})`, ""},
+		{"invalid payload", `cb({"code":)`, ""},
+	}
+
+	for _, c := range cases {
+		got, err := decodeJSONP([]byte(c.data))
+		if c.want == "" {
+			if errors.Cause(err) != ErrNotJSONP {
+				t.Errorf("%s: error %v, want ErrNotJSONP", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+import "fmt"
+
+// Level is the severity of the log entry
+//
+type Level int
+
+// Levels of Logger, from the most verbose
+//
+const (
+	LevelTrace Level = iota // the details for debugging, such as the requests traced
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"trace", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelTrace || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// Fields is the structured context of the log entry, such as sku, step,
+// result_code and latency
+//
+type Fields map[string]interface{}
+
+// Logger receive the logs of JingDong, msg is formatted already and fields
+// may be nil. It is called from multiple goroutines.
+//
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+// NopLogger discard all the logs, the default of JDConfig.Logger
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, Fields) {}
+
+// logger format the messages for Logger, with the fields attached by With
+//
+type logger struct {
+	out    Logger
+	fields Fields
+}
+
+func newLogger(out Logger) *logger {
+	if out == nil {
+		out = NopLogger
+	}
+	return &logger{out: out}
+}
+
+// With return the logger with the fields added to each entry
+//
+func (l *logger) With(fields Fields) *logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &logger{out: l.out, fields: merged}
+}
+
+func (l *logger) log(level Level, format string, args ...interface{}) {
+	if l.out == NopLogger {
+		return
+	}
+	l.out.Log(level, fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *logger) Trace(format string, args ...interface{}) { l.log(LevelTrace, format, args...) }
+func (l *logger) Info(format string, args ...interface{})  { l.log(LevelInfo, format, args...) }
+func (l *logger) Warn(format string, args ...interface{})  { l.log(LevelWarn, format, args...) }
+func (l *logger) Error(format string, args ...interface{}) { l.log(LevelError, format, args...) }
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of metric
+//
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// latencyBuckets is the upper bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric is one family of samples with the same name
+//
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	samples map[string]*sample // by the label values joined
+}
+
+// sample is the value of one set of label values
+//
+type sample struct {
+	values  []string
+	value   float64  // counter or gauge
+	buckets []uint64 // histogram, count of each latencyBuckets
+	sum     float64
+	count   uint64
+}
+
+// Metrics collect the counters and histograms of the sessions from their
+// events, served in the Prometheus text format
+//
+type Metrics struct {
+	metrics []*metric
+	byName  map[string]*metric
+	stocks  map[string]string // the last stock state by account, sku and area
+	mu      sync.Mutex
+}
+
+// NewMetrics create the metrics with nothing observed
+//
+func NewMetrics() *Metrics {
+	m := &Metrics{byName: make(map[string]*metric), stocks: make(map[string]string)}
+	m.register("jd_requests_total", metricCounter, "Requests sent by step and HTTP status, status is error if no response.", "account", "step", "status")
+	m.register("jd_request_duration_seconds", metricHistogram, "Latency of the requests until the body closed, by step.", "account", "step")
+	m.register("jd_throttled_total", metricCounter, "Times the host throttled the requests.", "account", "host")
+	m.register("jd_polls_total", metricCounter, "Rounds of polling the price and stock, by source and result.", "account", "source", "result")
+	m.register("jd_price", metricGauge, "The latest price seen.", "account", "sku")
+	m.register("jd_in_stock", metricGauge, "Whether the sku is on sale in the area by the latest stock seen.", "account", "sku", "area")
+	m.register("jd_stock_transitions_total", metricCounter, "Changes of the stock state by sku and area.", "account", "sku", "area", "from", "to")
+	m.register("jd_submit_attempts_total", metricCounter, "Orders submitted by result code, 0 for success.", "account", "result_code")
+	m.register("jd_submit_duration_seconds", metricHistogram, "Latency of submitting the order.", "account")
+	m.register("jd_orders_placed_total", metricCounter, "Orders placed successfully.", "account")
+	m.register("jd_rushes_aborted_total", metricCounter, "Rushes gave up submitting the order.", "account")
+	m.register("jd_session_relogins_total", metricCounter, "Times the cookies expired and the QR code was required.", "account")
+	return m
+}
+
+func (m *Metrics) register(name, kind, help string, labels ...string) {
+	mt := &metric{name: name, help: help, kind: kind, labels: labels, samples: make(map[string]*sample)}
+	m.metrics = append(m.metrics, mt)
+	m.byName[name] = mt
+}
+
+// sample return the sample of the label values, created if not exist, m.mu
+// should be locked
+//
+func (m *Metrics) sample(name string, values ...string) *sample {
+	mt := m.byName[name]
+	key := strings.Join(values, "\xff")
+	s, exist := mt.samples[key]
+	if !exist {
+		s = &sample{values: values}
+		if mt.kind == metricHistogram {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		mt.samples[key] = s
+	}
+	return s
+}
+
+func (m *Metrics) inc(name string, values ...string) {
+	m.sample(name, values...).value++
+}
+
+func (m *Metrics) set(name string, v float64, values ...string) {
+	m.sample(name, values...).value = v
+}
+
+func (m *Metrics) observe(name string, d time.Duration, values ...string) {
+	s := m.sample(name, values...)
+	v := d.Seconds()
+	for i, le := range latencyBuckets {
+		if v <= le {
+			s.buckets[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Watch collect the events of the session until the subscription returned
+// closed, the samples are labeled with jd.Account
+//
+func (m *Metrics) Watch(jd *JingDong) *Subscription {
+	sub := jd.Subscribe(1024, &Timing{}, &Throttled{}, &Polled{}, &Observation{},
+		&SubmitAttempt{}, &OrderPlaced{}, &RushAborted{}, &SessionExpired{})
+	go func() {
+		for e := range sub.C {
+			m.add(jd.Account, e)
+		}
+	}()
+	return sub
+}
+
+// add update the samples by the event
+//
+func (m *Metrics) add(account string, e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e := e.(type) {
+	case *Timing:
+		status := strconv.Itoa(e.Status)
+		if e.Status == 0 {
+			status = "error"
+		}
+		m.inc("jd_requests_total", account, e.Step, status)
+		m.observe("jd_request_duration_seconds", e.Total, account, e.Step)
+	case *Throttled:
+		m.inc("jd_throttled_total", account, e.Host)
+	case *Polled:
+		result := "ok"
+		if e.Failed {
+			result = "failed"
+		}
+		m.inc("jd_polls_total", account, e.Source, result)
+	case *Observation:
+		if e.State == "" {
+			m.set("jd_price", e.Price, account, e.SKU)
+			break
+		}
+		inStock := 0.0
+		if e.State == "33" {
+			inStock = 1
+		}
+		m.set("jd_in_stock", inStock, account, e.SKU, e.Area)
+
+		key := account + "/" + e.SKU + "/" + e.Area
+		if last, exist := m.stocks[key]; exist && last != e.State {
+			m.inc("jd_stock_transitions_total", account, e.SKU, e.Area, last, e.State)
+		}
+		m.stocks[key] = e.State
+	case *SubmitAttempt:
+		m.inc("jd_submit_attempts_total", account, strconv.Itoa(e.ResultCode))
+		m.observe("jd_submit_duration_seconds", e.Elapsed, account)
+	case *OrderPlaced:
+		m.inc("jd_orders_placed_total", account)
+	case *RushAborted:
+		m.inc("jd_rushes_aborted_total", account)
+	case *SessionExpired:
+		m.inc("jd_session_relogins_total", account)
+	}
+}
+
+// WriteTo write all the samples in the Prometheus text format
+//
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, mt := range m.metrics {
+		fmt.Fprintf(cw, "# HELP %s %s\n", mt.name, mt.help)
+		fmt.Fprintf(cw, "# TYPE %s %s\n", mt.name, mt.kind)
+
+		keys := make([]string, 0, len(mt.samples))
+		for key := range mt.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := mt.samples[key]
+			labels := formatLabels(mt.labels, s.values)
+			if mt.kind != metricHistogram {
+				fmt.Fprintf(cw, "%s%s %s\n", mt.name, labels, formatValue(s.value))
+				continue
+			}
+
+			for i, le := range latencyBuckets {
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", mt.name,
+					formatLabels(append(mt.labels, "le"), append(s.values, formatValue(le))), s.buckets[i])
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", mt.name,
+				formatLabels(append(mt.labels, "le"), append(s.values, "+Inf")), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", mt.name, labels, formatValue(s.sum))
+			fmt.Fprintf(cw, "%s_count%s %d\n", mt.name, labels, s.count)
+		}
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serve the samples to the Prometheus scraper
+//
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// formatLabels return {name="value",...}, empty if no labels
+//
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countWriter count the bytes written, and keep the first error
+//
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
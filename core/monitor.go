@@ -0,0 +1,118 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// consecutive failures of polling allowed by default
+	defaultBudget = 10
+
+	// the longest wait after failures, the wait is doubled each failure
+	maxFailureWait = 30 * time.Second
+)
+
+// Monitor poll the price and stock of one goods until it meets the
+// expected price and is in stock. The failures of polling, such as the
+// timeouts, the bodies not JSON, or the GBK not decoded, are retried with
+// backoff until the budget of consecutive failures used up. The throttled
+// ones are not counted, which are backed off by the RateLimiter.
+//
+type Monitor struct {
+	jd     *JingDong
+	sku    *SKUInfo
+	budget int
+	log    *logger
+
+	consecutive int // failures since the last success
+	failures    int // all the failures
+}
+
+// NewMonitor create the monitor of the goods, Retry.Budget of consecutive
+// failures allowed
+//
+func (jd *JingDong) NewMonitor(sku *SKUInfo) *Monitor {
+	return &Monitor{jd: jd, sku: sku, budget: jd.Retry.Budget, log: jd.log.With(Fields{"sku": sku.ID})}
+}
+
+// Ready check whether the price and stock meet the condition
+//
+func (m *Monitor) Ready() bool {
+	return m.sku.Price <= m.sku.ExpectPrice && m.sku.State == "33"
+}
+
+// Failures return the failures since the last success, and all the
+// failures
+//
+func (m *Monitor) Failures() (int, int) {
+	return m.consecutive, m.failures
+}
+
+// Wait poll every Period until ready, or ctx done, or the budget used up
+//
+func (m *Monitor) Wait(ctx context.Context) error {
+	for !m.Ready() {
+		if err := sleep(ctx, m.delay()); err != nil {
+			return err
+		}
+
+		err := m.poll()
+		m.jd.publish(&Polled{Time: time.Now(), Source: PollMonitor, SKU: m.sku.ID, Failed: err != nil})
+		switch {
+		case err == nil:
+			m.consecutive = 0
+		case IsThrottled(err):
+			// backed off by the limiter, not the fault of the goods
+		default:
+			m.consecutive++
+			m.failures++
+			if m.consecutive > m.budget {
+				return errors.Wrapf(err, "连续 %d 次查询失败", m.consecutive)
+			}
+			m.log.Warn("商品%s第 %d 次查询失败, %s 后重试: %+v", m.sku.ID, m.consecutive, m.delay(), err)
+		}
+	}
+	return nil
+}
+
+// delay return the wait before next poll, doubled each consecutive failure
+//
+func (m *Monitor) delay() time.Duration {
+	d := m.jd.Period
+	for i := 0; i < m.consecutive && d < maxFailureWait; i++ {
+		d *= 2
+	}
+	if d > maxFailureWait {
+		d = maxFailureWait
+	}
+	return d
+}
+
+// poll update the price, and the stock if the price is OK
+//
+func (m *Monitor) poll() error {
+	sku := m.sku
+
+	// 拿价钱
+	if sku.Price > sku.ExpectPrice {
+		m.log.Info("商品%s当前价格（%.2f) 超出期望价格（%.2f)，开始监听。", sku.ID, sku.Price, sku.ExpectPrice)
+	}
+	if err := m.jd.updatePrice(sku); err != nil {
+		return errors.Wrapf(err, "获取(%s)价格失败", sku.ID)
+	}
+	if sku.Price > sku.ExpectPrice {
+		return nil
+	}
+
+	// 拿库存
+	if sku.State != "33" {
+		m.log.Info("商品%s库存不足，正在重新查询库存。", sku.ID)
+	}
+	if err := m.jd.updateStock(sku); err != nil {
+		return errors.Wrapf(err, "获取(%s)库存失败", sku.ID)
+	}
+	return nil
+}
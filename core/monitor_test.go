@@ -0,0 +1,104 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	priceOK   = `[{"id":"J_1","p":"10.00"}]`
+	priceHigh = `[{"id":"J_1","p":"20.00"}]`
+	inStock   = `{"1":{"StockState":33,"StockStateName":"in stock"}}`
+	noStock   = `{"1":{"StockState":34,"StockStateName":"no stock"}}`
+	failed    = "<html>error</html>" // not JSON
+	throttled = "throttled"
+)
+
+// scriptedJD return the JingDong answering the requests by the responses
+// in order
+func scriptedJD(t *testing.T, responses []string) *JingDong {
+	jd := &JingDong{
+		JDConfig: JDConfig{Period: time.Millisecond, ShipArea: "1_72_2799_0", Limiter: NewRateLimiter(0, 0), Retry: RetryPolicy{Budget: 2}},
+		log:      newLogger(nil),
+	}
+	jd.client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if len(responses) == 0 {
+			t.Fatalf("unexpected request %s", req.URL)
+		}
+		body := responses[0]
+		responses = responses[1:]
+		if body == throttled {
+			return nil, &ThrottledError{URL: req.URL.String(), Reason: "429"}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})}
+	return jd
+}
+
+func TestMonitorWait(t *testing.T) {
+	cases := []struct {
+		name        string
+		responses   []string
+		fail        bool
+		consecutive int
+		failures    int
+	}{
+		{"ready at once", []string{priceOK, inStock}, false, 0, 0},
+		{"in stock later", []string{priceHigh, priceOK, noStock, priceOK, inStock}, false, 0, 0},
+		{"failures within budget", []string{failed, failed, priceOK, inStock}, false, 0, 2},
+		{"budget used up", []string{failed, failed, failed}, true, 3, 3},
+		{"reset by success", []string{failed, failed, priceHigh, failed, failed, priceOK, inStock}, false, 0, 4},
+		{"stock failures", []string{priceOK, failed, failed, failed}, true, 3, 3},
+		{"throttled not counted", []string{throttled, throttled, throttled, throttled, priceOK, inStock}, false, 0, 0},
+	}
+
+	for _, c := range cases {
+		jd := scriptedJD(t, c.responses)
+		m := jd.NewMonitor(&SKUInfo{ID: "1", ExpectPrice: 15, Price: 20, State: "34"})
+
+		err := m.Wait(context.Background())
+		if (err != nil) != c.fail {
+			t.Errorf("%s: error %v, want fail %v", c.name, err, c.fail)
+		}
+		if consecutive, failures := m.Failures(); consecutive != c.consecutive || failures != c.failures {
+			t.Errorf("%s: failures %d/%d, want %d/%d", c.name, consecutive, failures, c.consecutive, c.failures)
+		}
+	}
+}
+
+func TestMonitorDelay(t *testing.T) {
+	cases := []struct {
+		consecutive int
+		want        time.Duration
+	}{
+		{0, 500 * time.Millisecond},
+		{1, time.Second},
+		{3, 4 * time.Second},
+		{6, maxFailureWait},
+		{100, maxFailureWait},
+	}
+
+	jd := &JingDong{JDConfig: JDConfig{Period: 500 * time.Millisecond}, log: newLogger(nil)}
+	for _, c := range cases {
+		m := jd.NewMonitor(&SKUInfo{ID: "1"})
+		m.consecutive = c.consecutive
+		if d := m.delay(); d != c.want {
+			t.Errorf("%d failures: delay %s, want %s", c.consecutive, d, c.want)
+		}
+	}
+}
+
+func TestMonitorCanceled(t *testing.T) {
+	jd := scriptedJD(t, nil)
+	m := jd.NewMonitor(&SKUInfo{ID: "1", ExpectPrice: 15, Price: 20})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Wait(ctx); err != ErrCanceled {
+		t.Errorf("got %v, want ErrCanceled", err)
+	}
+}
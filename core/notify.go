@@ -0,0 +1,380 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NotifyKind is the kind of purchase event to notify
+//
+type NotifyKind string
+
+const (
+	NotifyLogin          NotifyKind = "login"           // need to scan the QR code
+	NotifyInStock        NotifyKind = "in_stock"        // stock appeared
+	NotifyPriceDrop      NotifyKind = "price_drop"      // price dropped below the expected, or by the percent
+	NotifyAddedToCart    NotifyKind = "added_to_cart"   // goods in the cart
+	NotifyOrderSubmitted NotifyKind = "order_submitted" // order submitted with ID
+	NotifyRushAborted    NotifyKind = "rush_aborted"    // gave up the rush
+)
+
+// Notification is the message sent to notifiers
+//
+type Notification struct {
+	Kind    NotifyKind `json:"kind"`
+	Time    time.Time  `json:"time"`
+	Account string     `json:"account,omitempty"`
+	SKU     string     `json:"sku,omitempty"`
+	Name    string     `json:"name,omitempty"`
+	Price   float64    `json:"price,omitempty"`
+	OrderID int64      `json:"order_id,omitempty"`
+	QRCode  string     `json:"qr_code,omitempty"` // data URL of the QR code image for NotifyLogin
+	Message string     `json:"message"`
+
+	// QRImage is the local file path of the QR code, only passed to the
+	// local command, the others get QRCode
+	QRImage string `json:"-"`
+
+	qrData []byte // content of QRImage
+}
+
+// Subject return the one line summary of the notification
+//
+func (n *Notification) Subject() string {
+	if n.Account != "" {
+		return fmt.Sprintf("[go-jd] [%s] %s", n.Account, n.Message)
+	}
+	return "[go-jd] " + n.Message
+}
+
+// Notifier send the notification to somewhere people can see
+//
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// notificationOf convert the event to notification, nil returned if the
+// event is not worth to notify
+//
+func notificationOf(e Event) *Notification {
+	n := &Notification{Time: e.When()}
+
+	switch e := e.(type) {
+	case *SessionExpired:
+		n.Kind = NotifyLogin
+		n.QRImage = e.QRImage
+		n.Message = "需要使用京东手机客户端扫码登录"
+		if data, err := ioutil.ReadFile(e.QRImage); err == nil {
+			n.qrData = data
+			n.QRCode = "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data)
+		}
+
+	case *StockChanged:
+		if !e.InStock() || e.OldState == "" {
+			return nil
+		}
+		n.Kind, n.SKU, n.Name = NotifyInStock, e.SKU, e.Name
+		n.Message = fmt.Sprintf("%s 到货了: %s", e.Name, e.StateName)
+
+	case *PriceChanged:
+		if !e.DropBelow() || e.OldPrice == 0 {
+			return nil
+		}
+		n.Kind, n.SKU, n.Name, n.Price = NotifyPriceDrop, e.SKU, e.Name, e.Price
+		n.Message = fmt.Sprintf("%s 降价到 %.2f，低于期望价格 %.2f", e.Name, e.Price, e.Expect)
+
+	case *CartUpdated:
+		if e.Action != CartAdd && e.Action != CartReuse {
+			return nil
+		}
+		n.Kind, n.SKU, n.Name = NotifyAddedToCart, e.SKU, e.Name
+		n.Message = fmt.Sprintf("%d 个 %s 已加入购物车", e.Count, e.Name)
+
+	case *OrderPlaced:
+		n.Kind, n.OrderID = NotifyOrderSubmitted, e.OrderID
+		n.SKU = strings.Join(e.SKUs, ",")
+		n.Message = fmt.Sprintf("下单成功，订单号：%d，商品：%s", e.OrderID, n.SKU)
+
+	case *RushAborted:
+		n.Kind = NotifyRushAborted
+		n.Message = e.Reason
+
+	case *WatchAlert:
+		n.Kind, n.SKU, n.Name, n.Price = NotifyPriceDrop, e.SKU, e.Name, e.Price
+		if e.Condition == WatchRestock {
+			n.Kind = NotifyInStock
+		}
+		n.Message = e.Message
+
+	default:
+		return nil
+	}
+
+	return n
+}
+
+// startNotifiers subscribe the events, and send the ones worth to notify
+// to all the notifiers in background, so that the rush is not blocked by
+// slow notifiers
+//
+func (jd *JingDong) startNotifiers() {
+	if len(jd.Notifiers) == 0 {
+		return
+	}
+
+	jd.notifySub = jd.Subscribe(256, &SessionExpired{}, &StockChanged{}, &PriceChanged{},
+		&CartUpdated{}, &OrderPlaced{}, &RushAborted{}, &WatchAlert{})
+	jd.notifyDone = make(chan struct{})
+
+	go func() {
+		defer close(jd.notifyDone)
+
+		for e := range jd.notifySub.C {
+			n := notificationOf(e)
+			if n == nil {
+				continue
+			}
+			n.Account = jd.Account
+
+			for _, notifier := range jd.Notifiers {
+				jd.notifying.Add(1)
+				go func(notifier Notifier) {
+					defer jd.notifying.Done()
+					if err := notifier.Notify(n); err != nil {
+						jd.log.Error("发送通知(%s)失败: %+v", n.Kind, err)
+					}
+				}(notifier)
+			}
+		}
+	}()
+}
+
+// stopNotifiers wait the notifications in background to finish
+//
+func (jd *JingDong) stopNotifiers() {
+	if jd.notifySub == nil {
+		return
+	}
+
+	jd.notifySub.Close()
+	<-jd.notifyDone
+	jd.notifying.Wait()
+}
+
+// WebhookNotifier POST the notification as JSON to URL
+//
+type WebhookNotifier struct {
+	URL    string
+	Header map[string]string // extra headers, e.g. Authorization
+	Client *http.Client      // default to a client with 10s timeout
+}
+
+// Notify implement Notifier
+//
+func (w *WebhookNotifier) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	applyCustomHeader(req, w.Header)
+
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// EmailNotifier send the notification by SMTP
+//
+type EmailNotifier struct {
+	Addr     string // host:port of the SMTP server
+	Username string // PLAIN auth is used if not empty
+	Password string
+	From     string // default to Username
+	To       []string
+}
+
+// Notify implement Notifier
+//
+func (e *EmailNotifier) Notify(n *Notification) error {
+	host, _, err := net.SplitHostPort(e.Addr)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+
+	from := e.From
+	if from == "" {
+		from = e.Username
+	}
+
+	body := new(bytes.Buffer)
+	fmt.Fprintf(body, "From: %s\r\n", from)
+	fmt.Fprintf(body, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(body, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", n.Subject()))
+	fmt.Fprintf(body, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(body, "MIME-Version: 1.0\r\n")
+
+	// the QR code attached, the text part first
+	var mw *multipart.Writer
+	if len(n.qrData) > 0 {
+		mw = multipart.NewWriter(body)
+		fmt.Fprintf(body, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+		if _, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}}); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(body, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	}
+
+	fmt.Fprintf(body, "%s\r\n\r\n", n.Message)
+	fmt.Fprintf(body, "时间: %s\r\n", n.Time.Format("2006-01-02 15:04:05"))
+	if n.SKU != "" {
+		fmt.Fprintf(body, "商品: %s %s\r\n", n.SKU, n.Name)
+		fmt.Fprintf(body, "链接: %s\r\n", fmt.Sprintf(URLGoodsDets, n.SKU))
+	}
+	if n.Price > 0 {
+		fmt.Fprintf(body, "价格: %.2f\r\n", n.Price)
+	}
+	if n.OrderID != 0 {
+		fmt.Fprintf(body, "订单号: %d\r\n", n.OrderID)
+	}
+
+	if mw != nil {
+		fmt.Fprintf(body, "二维码见附件\r\n")
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {http.DetectContentType(n.qrData)},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {`attachment; filename="qrcode.png"`},
+		})
+		if err != nil {
+			return err
+		}
+		enc := base64.StdEncoding.EncodeToString(n.qrData)
+		for len(enc) > 76 {
+			fmt.Fprintf(w, "%s\r\n", enc[:76])
+			enc = enc[76:]
+		}
+		fmt.Fprintf(w, "%s\r\n", enc)
+		if err = mw.Close(); err != nil {
+			return err
+		}
+	}
+
+	return smtp.SendMail(e.Addr, auth, from, e.To, body.Bytes())
+}
+
+// CommandNotifier run a local command for each notification. The
+// notification is written to stdin as JSON, and also passed by the
+// environment variables JD_EVENT_KIND, JD_EVENT_ACCOUNT, JD_EVENT_SKU,
+// JD_EVENT_PRICE, JD_EVENT_ORDER_ID, JD_EVENT_QR_IMAGE, the local file path
+// of the QR code, and JD_EVENT_MESSAGE.
+//
+type CommandNotifier struct {
+	Command string
+	Args    []string
+	Timeout time.Duration // default to 30s
+
+	// HideEnv are the prefixes of the environment variables not passed to
+	// the command, such as the settings with the secrets
+	HideEnv []string
+}
+
+// eventEnvPrefix is the prefix of the environment variables of the event
+const eventEnvPrefix = "JD_EVENT_"
+
+// environ return the environment of the command, the hidden ones removed
+// and the event added
+//
+func (c *CommandNotifier) environ(n *Notification) []string {
+	env := make([]string, 0)
+NEXT:
+	for _, kv := range os.Environ() {
+		for _, prefix := range c.HideEnv {
+			if strings.HasPrefix(kv, prefix) {
+				continue NEXT
+			}
+		}
+		env = append(env, kv)
+	}
+
+	return append(env,
+		eventEnvPrefix+"KIND="+string(n.Kind),
+		eventEnvPrefix+"ACCOUNT="+n.Account,
+		eventEnvPrefix+"SKU="+n.SKU,
+		eventEnvPrefix+"PRICE="+strconv.FormatFloat(n.Price, 'f', 2, 64),
+		eventEnvPrefix+"ORDER_ID="+strconv.FormatInt(n.OrderID, 10),
+		eventEnvPrefix+"QR_IMAGE="+n.QRImage,
+		eventEnvPrefix+"MESSAGE="+n.Message,
+	)
+}
+
+// Notify implement Notifier
+//
+func (c *CommandNotifier) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(c.Command, c.Args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = c.environ(n)
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("command %s timeout after %s", c.Command, timeout)
+	}
+}
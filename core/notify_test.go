@@ -0,0 +1,61 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyLoginQRCode(t *testing.T) {
+	qr := filepath.Join(t.TempDir(), "jd.qr.png")
+	png := []byte("\x89PNG\r\n\x1a\nqrcode")
+	if err := ioutil.WriteFile(qr, png, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n := notificationOf(&SessionExpired{Time: time.Now(), QRImage: qr})
+	data, err := json.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), qr) {
+		t.Errorf("local path in the payload: %s", data)
+	}
+	if want := "data:image/png;base64,iVBORw0KGgpxcmNvZGU="; n.QRCode != want {
+		t.Errorf("qr_code %s, want %s", n.QRCode, want)
+	}
+}
+
+func TestCommandNotifierEnv(t *testing.T) {
+	os.Setenv("JD_SMTP_PASS", "secret")
+	defer os.Unsetenv("JD_SMTP_PASS")
+
+	c := &CommandNotifier{Command: "true", HideEnv: []string{"JD_"}}
+	env := c.environ(&Notification{Kind: NotifyInStock, SKU: "2567304", Message: "到货了"})
+
+	want := map[string]string{
+		"JD_EVENT_KIND":    "in_stock",
+		"JD_EVENT_SKU":     "2567304",
+		"JD_EVENT_MESSAGE": "到货了",
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "JD_SMTP_PASS=") {
+			t.Errorf("secret passed: %s", kv)
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if v, ok := want[pair[0]]; ok {
+			if pair[1] != v {
+				t.Errorf("%s: got %q, want %q", pair[0], pair[1], v)
+			}
+			delete(want, pair[0])
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("missing %v", want)
+	}
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/axgle/mahonia"
+)
+
+// Pages scraped, see checkSelectors
+//
+const (
+	PageSKU       = "sku"         // the goods page, item.jd.com
+	PageCart      = "cart"        // the shopping cart page
+	PageOrder     = "order"       // the order page, getOrderInfo.action
+	PageAddToCart = "add_to_cart" // the result page of gate.action
+)
+
+// pageSelector is one selector the parsers rely on
+//
+type pageSelector struct {
+	selector string
+	optional bool // one of the alternatives, or not always present
+}
+
+// pageSelectors are the selectors of the parsers by page, keep them in
+// sync with the parse functions below
+var pageSelectors = map[string][]pageSelector{
+	PageSKU: {
+		{selector: "a#InitCartUrl"},
+		{selector: "div.sku-name"},
+	},
+	PageCart: {
+		{selector: "div[class*='item-item']"},
+		{selector: "input[p-type]"},
+		{selector: "div.p-price strong"},
+		{selector: "div.p-sum strong"},
+		{selector: "div.p-name a"},
+		{selector: "div.amount-sum em"},
+		{selector: "span.sumPrice em"},
+	},
+	PageOrder: {
+		{selector: "div.order-summary"},
+		{selector: "#warePriceId"},
+		{selector: "#cachBackId", optional: true},
+		{selector: "#freightPriceId"},
+		{selector: "#serviceFeeId", optional: true},
+		{selector: "#couponPriceId", optional: true},
+		{selector: "#freeFreightPriceId", optional: true},
+		{selector: "div.trade-foot"},
+		{selector: "#sumPayPriceId"},
+		{selector: "#sendMobile"},
+		{selector: "#sendAddr"},
+	},
+	PageAddToCart: {
+		{selector: "h3.ftx-02", optional: true},
+		{selector: "div.p-name a", optional: true},
+	},
+}
+
+// SelectorCheck is the count of elements matched by one selector, the
+// page layout is changed if a required one matches nothing
+//
+type SelectorCheck struct {
+	Page     string `json:"page"`
+	Selector string `json:"selector"`
+	Matches  int    `json:"matches"`
+	Optional bool   `json:"optional"`
+}
+
+// OK check whether the selector is matched, or not required
+//
+func (c *SelectorCheck) OK() bool {
+	return c.Matches > 0 || c.Optional
+}
+
+// checkSelectors count the elements matched by each selector of the page
+//
+func checkSelectors(page string, doc *goquery.Document) []*SelectorCheck {
+	lst := make([]*SelectorCheck, 0, len(pageSelectors[page]))
+	for _, s := range pageSelectors[page] {
+		lst = append(lst, &SelectorCheck{
+			Page:     page,
+			Selector: s.selector,
+			Matches:  doc.Find(s.selector).Length(),
+			Optional: s.optional,
+		})
+	}
+	return lst
+}
+
+// parseSKUPage return the name and the link to add to cart of the goods
+// page, the page is encoded by GBK
+//
+func parseSKUPage(doc *goquery.Document) (name, link string) {
+	if href, exist := doc.Find("a#InitCartUrl").Attr("href"); exist {
+		link = href
+		if !strings.HasPrefix(link, "https:") { // 恩，加入购物车的链接，必须走https
+			link = "https:" + link
+		}
+	}
+
+	dec := mahonia.NewDecoder("gbk")
+	name = strings.Trim(dec.ConvertString(doc.Find("div.sku-name").Text()), " \t\n")
+	return truncate(name), link
+}
+
+// parseCartItems collect all the goods from the cart page, no matter
+// selected or not. Suits (item-suit) are not supported yet.
+//
+func parseCartItems(doc *goquery.Document) []*CartItem {
+	items := make([]*CartItem, 0)
+
+	// 查找所有class属性包含item-item的div, 选中的商品会带上item-selected
+	doc.Find("div[class*='item-item']").Each(func(i int, p *goquery.Selection) {
+		item := &CartItem{
+			Selected: p.HasClass("item-selected"),
+			PType:    "1",
+			PromoID:  "0",
+		}
+
+		if idStr, exist := p.Attr("id"); exist {
+			item.ID = strings.TrimPrefix(idStr, "product_")
+		}
+		if item.ID == "" {
+			return
+		}
+
+		if val, exist := p.Attr("num"); exist {
+			item.Count, _ = strconv.Atoi(val)
+		}
+
+		item.Price = strings.Trim(p.Find("div.p-price strong").Eq(0).Text(), " ")
+		item.Total = strings.Trim(p.Find("div.p-sum strong").Eq(0).Text(), " ")
+		item.Name = truncate(strings.Trim(p.Find("div.p-name a").Eq(0).Text(), " \n\t"))
+
+		// value of the checkbox: pid_ptype_promoID
+		if val, exist := doc.Find(fmt.Sprintf("input[p-type*='%s_']", item.ID)).Attr("value"); exist {
+			ss := strings.Split(val, "_")
+			if len(ss) > 1 {
+				item.PType = ss[1]
+			}
+			if len(ss) > 2 {
+				item.PromoID = ss[2]
+			}
+		}
+
+		items = append(items, item)
+	})
+
+	return items
+}
+
+// parseCartTotal return the count and the amount of the goods selected in
+// the cart page
+//
+func parseCartTotal(doc *goquery.Document) (count, amount string) {
+	count = strings.Trim(doc.Find("div.amount-sum em").Eq(0).Text(), " ")
+	amount = strings.Trim(doc.Find("span.sumPrice em").Eq(0).Text(), " ")
+	return count, amount
+}
+
+// parseOrderPreview return the prices and the receiver of the order page
+//
+func parseOrderPreview(doc *goquery.Document) *OrderPreview {
+	o := &OrderPreview{}
+	if order := doc.Find("div.order-summary").Eq(0); order != nil {
+		o.WarePrice = strings.Trim(order.Find("#warePriceId").Text(), " \t\n")
+		o.CashBack = strings.Trim(order.Find("#cachBackId").Text(), " \t\n")
+		o.ShipPrice = strings.Trim(order.Find("#freightPriceId").Text(), " \t\n")
+		o.ServicePrice = strings.Trim(order.Find("#serviceFeeId").Text(), " \t\n")
+		o.CouponPrice = strings.Trim(order.Find("#couponPriceId").Text(), " \t\n")
+		o.FreightPrice = strings.Trim(order.Find("#freeFreightPriceId").Text(), " \t\n")
+	}
+
+	if sum := doc.Find("div.trade-foot").Eq(0); sum != nil {
+		o.Payment = strings.Trim(sum.Find("#sumPayPriceId").Text(), " \t\n")
+		o.Phone = strings.Trim(sum.Find("#sendMobile").Text(), " \t\n")
+		o.Addr = strings.Trim(sum.Find("#sendAddr").Text(), " \t\n")
+	}
+	return o
+}
+
+// parseAddToCart check whether the result page of gate.action shows the
+// goods added
+//
+func parseAddToCart(doc *goquery.Document) bool {
+	return doc.Find("h3.ftx-02").Text() != "" || doc.Find("div.p-name a").Text() != ""
+}
+
+// parseScanResult return the result of checking the QR code scanned, the
+// ticket is set when code is 200
+//
+func parseScanResult(data []byte) (code int, msg, ticket string, err error) {
+	js, err := parseJSONP(data)
+	if err != nil {
+		return 0, "", "", err
+	}
+	code = js.Get("code").MustInt()
+	return code, js.Get("msg").MustString(), js.Get("ticket").MustString(), nil
+}
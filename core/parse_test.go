@@ -0,0 +1,129 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// go test ./core -run Parse -update rewrite the golden files after the
+// pages in testdata are saved again
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func loadPage(t *testing.T, name string) *goquery.Document {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return doc
+}
+
+// checkGolden compare v encoded as JSON with testdata/<name>.golden
+//
+func checkGolden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err = ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v, run with -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\ngot:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
+
+func TestParseSKUPage(t *testing.T) {
+	name, link := parseSKUPage(loadPage(t, "sku.html"))
+	checkGolden(t, "sku", map[string]string{"name": name, "link": link})
+}
+
+func TestParseCart(t *testing.T) {
+	doc := loadPage(t, "cart.html")
+	count, amount := parseCartTotal(doc)
+	checkGolden(t, "cart", map[string]interface{}{
+		"items":  parseCartItems(doc),
+		"count":  count,
+		"amount": amount,
+	})
+}
+
+func TestParseOrderPreview(t *testing.T) {
+	checkGolden(t, "order", parseOrderPreview(loadPage(t, "order.html")))
+}
+
+func TestParseAddToCart(t *testing.T) {
+	if !parseAddToCart(loadPage(t, "gate.html")) {
+		t.Error("gate.html: goods not added")
+	}
+	if parseAddToCart(loadPage(t, "order.html")) {
+		t.Error("order.html: goods added")
+	}
+}
+
+func TestParseScanResult(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "scan.jsonp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, msg, ticket, err := parseScanResult(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "scan", map[string]interface{}{"code": code, "msg": msg, "ticket": ticket})
+
+	if _, _, _, err = parseScanResult([]byte("<html>系统繁忙</html>")); err == nil {
+		t.Error("error page: no error")
+	}
+}
+
+func TestCheckSelectors(t *testing.T) {
+	pages := []struct {
+		page string
+		file string
+	}{
+		{PageSKU, "sku.html"},
+		{PageCart, "cart.html"},
+		{PageOrder, "order.html"},
+		{PageAddToCart, "gate.html"},
+	}
+	for _, p := range pages {
+		for _, c := range checkSelectors(p.page, loadPage(t, p.file)) {
+			if !c.OK() {
+				t.Errorf("%s: %s matches nothing", p.file, c.Selector)
+			}
+		}
+	}
+
+	var failed []string
+	for _, c := range checkSelectors(PageOrder, loadPage(t, "order_changed.html")) {
+		if !c.OK() {
+			failed = append(failed, c.Selector)
+		}
+	}
+	if len(failed) != 1 || failed[0] != "#sumPayPriceId" {
+		t.Errorf("order_changed.html: failed %v, want [#sumPayPriceId]", failed)
+	}
+}
@@ -0,0 +1,428 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExpectProduct is one target of the plan
+//
+type ExpectProduct struct {
+	ID       string    // SKU ID
+	Num      int       // buying count
+	Price    float64   // max unit price
+	MaxTotal float64   // max total price of Num goods, 0 means no limit
+	Areas    []string  // areas to check stock, default to JDConfig.ShipArea
+	Priority int       // bigger one is started first, not the order of submitting
+	StartAt  time.Time // do not rush before it, zero means start immediately
+	Account  string    // account used to buy, empty for the default account
+	Optional bool      // the order can go without it
+	Line     int       // line number in the plan file, 0 if not from file
+}
+
+// UnitLimit return the max acceptable unit price, both Price and MaxTotal
+// are considered
+//
+func (p *ExpectProduct) UnitLimit() float64 {
+	limit := p.Price
+	if p.MaxTotal > 0 && p.Num > 0 {
+		limit = math.Min(limit, p.MaxTotal/float64(p.Num))
+	}
+	return limit
+}
+
+// Plan describe the goods to buy, in JSON, YAML or TOML, see ParsePlanAs
+//
+//  {
+//    "policy": "all",
+//    "strategy": "monitor",
+//    "targets": [
+//      {"sku": "2567304", "num": 2, "max_price": 300, "areas": ["1_72_2799_0"]},
+//      {"sku": "3133851", "max_total": 500, "priority": 1, "start": "2017-06-18 00:00:00",
+//       "account": "work", "optional": true}
+//    ]
+//  }
+//
+type Plan struct {
+	Policy   string // PolicyAll, PolicyAny or PolicySplit, default to PolicyAll
+	Strategy string // StrategyCart or StrategyMonitor, default to StrategyCart
+	Targets  []*ExpectProduct
+}
+
+// planTarget is the JSON form of ExpectProduct
+type planTarget struct {
+	SKU      string   `json:"sku"`
+	Num      int      `json:"num"`
+	MaxPrice float64  `json:"max_price"`
+	MaxTotal float64  `json:"max_total"`
+	Areas    []string `json:"areas"`
+	Priority int      `json:"priority"`
+	Start    string   `json:"start"`
+	Account  string   `json:"account"`
+	Optional bool     `json:"optional"`
+}
+
+// PlanError is the error with line number of the plan file
+//
+type PlanError struct {
+	Line int
+	Msg  string
+}
+
+func (e *PlanError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// PlanErrors collect all the errors found in plan file
+//
+type PlanErrors []*PlanError
+
+func (es PlanErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var (
+	reSKU  = regexp.MustCompile(`^\d+$`)
+	reArea = regexp.MustCompile(`^\d+([_-]\d+){1,3}$`)
+
+	startLayouts = []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02T15:04:05",
+		time.RFC3339,
+	}
+)
+
+// lineOf return the line number of the first token at or after offset
+//
+func lineOf(data []byte, offset int64) int {
+	n := int(offset)
+	if n > len(data) {
+		n = len(data)
+	}
+	for n < len(data) && strings.IndexByte(" \t\r\n,:", data[n]) >= 0 {
+		n++
+	}
+	return bytes.Count(data[:n], []byte("\n")) + 1
+}
+
+// jsonError convert the json error to PlanError with line number. The offset
+// of errors from Decode is relative to base, the start of the value.
+//
+func jsonError(data []byte, dec *json.Decoder, base int64, err error) *PlanError {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return &PlanError{Line: lineOf(data, base+e.Offset-1), Msg: e.Error()}
+	case *json.UnmarshalTypeError:
+		return &PlanError{Line: lineOf(data, base+e.Offset-1), Msg: e.Error()}
+	default:
+		return &PlanError{Line: lineOf(data, dec.InputOffset()), Msg: err.Error()}
+	}
+}
+
+// expectDelim read the next token, which must be delim
+//
+func expectDelim(data []byte, dec *json.Decoder, delim json.Delim) error {
+	off := dec.InputOffset()
+	tok, err := dec.Token()
+	if err != nil {
+		return jsonError(data, dec, 0, err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return &PlanError{Line: lineOf(data, off), Msg: fmt.Sprintf("expect '%s', got %v", delim, tok)}
+	}
+	return nil
+}
+
+// ParsePlan parse and validate the plan in JSON, YAML or TOML, which is
+// guessed by the first line. Errors with line number returned if invalid.
+//
+func ParsePlan(data []byte) (*Plan, error) {
+	return ParsePlanAs(data, planFormat(data))
+}
+
+// ParsePlanAs parse and validate the plan in the format, PlanJSON, PlanYAML
+// or PlanTOML. See parseYAMLPlan and parseTOMLPlan for the subsets of YAML
+// and TOML supported.
+//
+func ParsePlanAs(data []byte, format string) (*Plan, error) {
+	var (
+		doc *planDoc
+		err error
+	)
+	switch format {
+	case PlanJSON:
+		return parseJSONPlan(data)
+	case PlanYAML:
+		doc, err = parseYAMLPlan(data)
+	case PlanTOML:
+		doc, err = parseTOMLPlan(data)
+	default:
+		return nil, fmt.Errorf("unknown plan format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.plan()
+}
+
+// parseJSONPlan parse the JSON plan
+//
+func parseJSONPlan(data []byte) (*Plan, error) {
+	plan := &Plan{Targets: make([]*ExpectProduct, 0)}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := expectDelim(data, dec, '{'); err != nil {
+		return nil, err
+	}
+
+	var errs PlanErrors
+	for dec.More() {
+		off := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, jsonError(data, dec, 0, err)
+		}
+
+		switch key := tok.(string); key {
+		case "policy":
+			base := dec.InputOffset()
+			if err := dec.Decode(&plan.Policy); err != nil {
+				return nil, jsonError(data, dec, base, err)
+			}
+			if line := lineOf(data, base); !ValidPolicy(plan.Policy) {
+				errs = append(errs, &PlanError{Line: line, Msg: fmt.Sprintf("invalid policy %q, expect all, any or split", plan.Policy)})
+			}
+
+		case "strategy":
+			base := dec.InputOffset()
+			if err := dec.Decode(&plan.Strategy); err != nil {
+				return nil, jsonError(data, dec, base, err)
+			}
+			if line := lineOf(data, base); !ValidStrategy(plan.Strategy) {
+				errs = append(errs, &PlanError{Line: line, Msg: fmt.Sprintf("invalid strategy %q, expect cart or monitor", plan.Strategy)})
+			}
+
+		case "targets":
+			if err := expectDelim(data, dec, '['); err != nil {
+				return nil, err
+			}
+			for dec.More() {
+				base := dec.InputOffset()
+				line := lineOf(data, base)
+				var t planTarget
+				if err := dec.Decode(&t); err != nil {
+					return nil, jsonError(data, dec, base, err)
+				}
+				p, es := t.product(line)
+				plan.Targets = append(plan.Targets, p)
+				errs = append(errs, es...)
+			}
+			if err := expectDelim(data, dec, ']'); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, &PlanError{Line: lineOf(data, off), Msg: fmt.Sprintf("unknown field %q", key)}
+		}
+	}
+
+	if err := expectDelim(data, dec, '}'); err != nil {
+		return nil, err
+	}
+
+	errs = append(errs, plan.validate()...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return plan, nil
+}
+
+// LoadPlan load the plan from the file, the format is decided by the
+// extension, .json, .yaml, .yml or .toml, guessed by the content if other
+//
+func LoadPlan(filename string) (*Plan, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	format := planFormat(data)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		format = PlanJSON
+	case ".yaml", ".yml":
+		format = PlanYAML
+	case ".toml":
+		format = PlanTOML
+	}
+
+	plan, err := ParsePlanAs(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, strings.Replace(err.Error(), "\n", "\n"+filename+": ", -1))
+	}
+	return plan, nil
+}
+
+// product validate the target and convert it to ExpectProduct
+//
+func (t *planTarget) product(line int) (*ExpectProduct, PlanErrors) {
+	var errs PlanErrors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, &PlanError{Line: line, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	p := &ExpectProduct{
+		ID:       strings.TrimSpace(t.SKU),
+		Num:      t.Num,
+		Price:    t.MaxPrice,
+		MaxTotal: t.MaxTotal,
+		Areas:    t.Areas,
+		Priority: t.Priority,
+		Account:  t.Account,
+		Optional: t.Optional,
+		Line:     line,
+	}
+
+	if !reSKU.MatchString(p.ID) {
+		fail("invalid sku %q", t.SKU)
+	}
+
+	// part of the cookie file name
+	if !ValidAccount(p.Account) {
+		fail("invalid account %q", t.Account)
+	}
+
+	if p.Num == 0 {
+		p.Num = 1
+	} else if p.Num < 0 {
+		fail("invalid num %d", t.Num)
+	}
+
+	if p.Price == 0 {
+		p.Price = math.MaxFloat64
+	} else if p.Price < 0 {
+		fail("invalid max_price %.2f", t.MaxPrice)
+	}
+
+	if p.MaxTotal < 0 {
+		fail("invalid max_total %.2f", t.MaxTotal)
+	}
+
+	for _, area := range p.Areas {
+		if !reArea.MatchString(area) {
+			fail("invalid area %q", area)
+		}
+	}
+
+	if t.Start != "" {
+		for _, layout := range startLayouts {
+			if at, err := time.ParseInLocation(layout, t.Start, chinaZone); err == nil {
+				p.StartAt = at
+				break
+			}
+		}
+		if p.StartAt.IsZero() {
+			fail("invalid start %q, expect format like 2006-01-02 15:04:05", t.Start)
+		}
+	}
+
+	return p, errs
+}
+
+// ValidStrategy check whether the strategy is supported
+//
+func ValidStrategy(strategy string) bool {
+	switch strategy {
+	case "", StrategyCart, StrategyMonitor:
+		return true
+	}
+	return false
+}
+
+// ValidPolicy check whether the policy is supported
+//
+func ValidPolicy(policy string) bool {
+	switch policy {
+	case "", PolicyAll, PolicyAny, PolicySplit:
+		return true
+	}
+	return false
+}
+
+// validate check the plan level constraints
+//
+func (plan *Plan) validate() PlanErrors {
+	var errs PlanErrors
+
+	if len(plan.Targets) == 0 {
+		errs = append(errs, &PlanError{Line: 1, Msg: "no targets in plan"})
+	}
+
+	seen := make(map[string]*ExpectProduct)
+	for _, p := range plan.Targets {
+		key := p.Account + "/" + p.ID
+		if prev, exist := seen[key]; exist {
+			errs = append(errs, &PlanError{
+				Line: p.Line,
+				Msg:  fmt.Sprintf("duplicate sku %s, see line %d", p.ID, prev.Line),
+			})
+			continue
+		}
+		seen[key] = p
+	}
+
+	return errs
+}
+
+// Accounts return all the accounts used by the plan
+//
+func (plan *Plan) Accounts() []string {
+	accounts := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, p := range plan.Targets {
+		if !seen[p.Account] {
+			seen[p.Account] = true
+			accounts = append(accounts, p.Account)
+		}
+	}
+	return accounts
+}
+
+// ForAccount return the sub plan for the account
+//
+func (plan *Plan) ForAccount(account string) *Plan {
+	sub := &Plan{Policy: plan.Policy, Strategy: plan.Strategy, Targets: make([]*ExpectProduct, 0)}
+	for _, p := range plan.Targets {
+		if p.Account == account {
+			sub.Targets = append(sub.Targets, p)
+		}
+	}
+	return sub
+}
+
+// sorted return the targets sorted by priority, bigger one first
+//
+func (plan *Plan) sorted() []*ExpectProduct {
+	lst := make([]*ExpectProduct, len(plan.Targets))
+	copy(lst, plan.Targets)
+	sort.SliceStable(lst, func(i, j int) bool {
+		return lst[i].Priority > lst[j].Priority
+	})
+	return lst
+}
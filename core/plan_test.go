@@ -0,0 +1,105 @@
+package core
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const jsonPlan = `{
+  "policy": "any",
+  "strategy": "monitor",
+  "targets": [
+    {"sku": "2567304", "num": 2, "max_price": 300, "areas": ["1_72_2799_0", "18_1511_1513_40429"]},
+    {"sku": "3133851", "max_total": 500, "priority": 1, "start": "2017-06-18 00:00:00",
+     "account": "work", "optional": true}
+  ]
+}`
+
+const yamlPlan = `# the same as jsonPlan
+policy: any
+strategy: 'monitor'
+targets:
+  - sku: "2567304"
+    num: 2
+    max_price: 300   # unit price
+    areas:
+      - 1_72_2799_0
+      - "18_1511_1513_40429"
+  -
+    sku: 3133851
+    max_total: 500
+    priority: 1
+    start: 2017-06-18 00:00:00
+    account: work
+    optional: true
+`
+
+const tomlPlan = `# the same as jsonPlan
+policy = "any"
+strategy = "monitor"
+
+[[targets]]
+sku = "2567304"
+num = 2
+max_price = 300.0
+areas = ["1_72_2799_0", "18_1511_1513_40429"]
+
+[[targets]]
+sku = "3133851"
+max_total = 500
+priority = 1
+start = 2017-06-18T00:00:00
+account = "work"
+optional = true
+`
+
+func TestParsePlanFormats(t *testing.T) {
+	want, err := ParsePlanAs([]byte(jsonPlan), PlanJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, data := range map[string]string{PlanYAML: yamlPlan, PlanTOML: tomlPlan} {
+		if guess := planFormat([]byte(data)); guess != format {
+			t.Errorf("%s: guessed as %s", format, guess)
+		}
+		got, err := ParsePlan([]byte(data))
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+
+		// line numbers differ between the formats
+		for _, p := range append(got.Targets, want.Targets...) {
+			p.Line = 0
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", format, got, want)
+		}
+	}
+}
+
+func TestParsePlanErrors(t *testing.T) {
+	cases := []struct {
+		format string
+		data   string
+		want   string
+	}{
+		{PlanJSON, `{"targets": [{"sku": "1", "account": "../x"}]}`, `line 1: invalid account "../x"`},
+		{PlanYAML, "targets:\n  - sku: 1\n    num: two\n", `line 3: invalid num "two"`},
+		{PlanYAML, "targets:\n  - sku: 1\n      num: 2\n", "line 3: unexpected indentation"},
+		{PlanYAML, "policy: every\ntargets:\n  - sku: 1\n", `line 1: invalid policy "every", expect all, any or split`},
+		{PlanYAML, "targets:\n  - sku: 1\n    account: a/b\n", `line 2: invalid account "a/b"`},
+		{PlanTOML, "[[targets]]\nsku = \"1\"\ncolor = \"red\"\n", `line 3: unknown field "color"`},
+		{PlanTOML, "[targets]\nsku = \"1\"\n", "line 1: unsupported table [targets], expect [[targets]]"},
+		{PlanTOML, "[[targets]]\nareas = [\"1_2\",\n", "line 2: list of areas must end in the same line"},
+	}
+
+	for _, c := range cases {
+		_, err := ParsePlanAs([]byte(c.data), c.format)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s %q: error %v, want %s", c.format, c.data, err, c.want)
+		}
+	}
+}
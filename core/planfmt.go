@@ -0,0 +1,458 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Formats of the plan file
+//
+const (
+	PlanJSON = "json"
+	PlanYAML = "yaml"
+	PlanTOML = "toml"
+)
+
+// planField is one key and value of the YAML or TOML plan, the value is a
+// scalar or a list of scalars
+//
+type planField struct {
+	Key    string
+	Value  string
+	List   []string
+	IsList bool
+	Line   int
+}
+
+// planTable is the fields of one target, Line is where it starts
+//
+type planTable struct {
+	Line   int
+	Fields []*planField
+}
+
+// planDoc is the YAML or TOML plan before validation
+//
+type planDoc struct {
+	Fields  []*planField
+	Targets []*planTable
+}
+
+// planFormat guess the format of the plan by the first line with content
+//
+func planFormat(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		text := strings.TrimSpace(stripComment(line))
+		if text == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "{") {
+			return PlanJSON
+		}
+		if strings.HasPrefix(text, "[") {
+			return PlanTOML
+		}
+		eq, colon := strings.IndexByte(text, '='), strings.IndexByte(text, ':')
+		if eq >= 0 && (colon < 0 || eq < colon) {
+			return PlanTOML
+		}
+		return PlanYAML
+	}
+	return PlanJSON
+}
+
+// stripComment remove the comment started by # outside the quotes
+//
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseScalar unquote the scalar, "..." with escapes or '...' literal, the
+// others kept as is
+//
+func parseScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case s == "~" || s == "null":
+		return "", nil
+	}
+	return s, nil
+}
+
+// parseValue parse the scalar or the list in one line like [a, "b"] into f
+//
+func (f *planField) parseValue(s string) error {
+	if !strings.HasPrefix(s, "[") {
+		v, err := parseScalar(s)
+		f.Value = v
+		return err
+	}
+
+	if !strings.HasSuffix(s, "]") {
+		return fmt.Errorf("list of %s must end in the same line", f.Key)
+	}
+	f.IsList = true
+	f.List = make([]string, 0)
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return nil
+	}
+	for _, item := range splitList(inner) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue // trailing comma
+		}
+		v, err := parseScalar(item)
+		if err != nil {
+			return err
+		}
+		f.List = append(f.List, v)
+	}
+	return nil
+}
+
+// splitList split the items of the list by the commas outside the quotes
+//
+func splitList(s string) []string {
+	var (
+		items []string
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// parseYAMLPlan parse the subset of YAML used by the plan:
+//
+//  policy: all
+//  strategy: monitor
+//  targets:
+//    - sku: "2567304"
+//      num: 2
+//      max_price: 300
+//      areas: [1_72_2799_0]
+//    - sku: "3133851"
+//      areas:
+//        - 1_72_2799_0
+//
+// Block mappings, the sequence of targets, flow or block lists of scalars
+// and comments are supported, the anchors, multi-line strings and nested
+// mappings are not.
+//
+func parseYAMLPlan(data []byte) (*planDoc, error) {
+	doc := &planDoc{}
+	var (
+		inTargets   bool
+		cur         *planTable
+		itemIndent  = -1
+		fieldIndent = -1
+		list        *planField // the field waiting for the block list
+	)
+
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNo := i + 1
+		fail := func(format string, args ...interface{}) error {
+			return &PlanError{Line: lineNo, Msg: fmt.Sprintf(format, args...)}
+		}
+
+		text := strings.TrimRight(stripComment(strings.TrimRight(line, "\r")), " \t")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || (text == "---" && lineNo == 1) {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fail("tabs are not allowed for indentation")
+		}
+		indent := len(text) - len(content)
+
+		// the items of targets may be not indented
+		if indent == 0 && !(inTargets && strings.HasPrefix(content, "-")) {
+			inTargets, cur, list = false, nil, nil
+			f, err := yamlField(content, lineNo)
+			if err != nil {
+				return nil, err
+			}
+			if f.Key == "targets" {
+				if f.IsList && len(f.List) == 0 {
+					continue
+				}
+				if f.Value != "" || f.IsList {
+					return nil, fail("targets must be a list of mappings")
+				}
+				inTargets = true
+				continue
+			}
+			doc.Fields = append(doc.Fields, f)
+			continue
+		}
+
+		if !inTargets {
+			return nil, fail("unexpected indentation")
+		}
+
+		switch {
+		case strings.HasPrefix(content, "-") && (itemIndent < 0 || indent == itemIndent):
+			// - sku: "2567304"
+			rest := content[1:]
+			if rest != "" && rest[0] != ' ' {
+				return nil, fail("expect '- ' for the target")
+			}
+			itemIndent = indent
+			cur = &planTable{Line: lineNo}
+			doc.Targets = append(doc.Targets, cur)
+			list = nil
+
+			trimmed := strings.TrimLeft(rest, " ")
+			if trimmed == "" {
+				fieldIndent = -1 // set by the next line
+				continue
+			}
+			fieldIndent = indent + 1 + len(rest) - len(trimmed)
+			f, err := yamlField(trimmed, lineNo)
+			if err != nil {
+				return nil, err
+			}
+			cur.Fields = append(cur.Fields, f)
+			list = f.blockList()
+
+		case cur != nil && list != nil && strings.HasPrefix(content, "-") && indent >= fieldIndent:
+			//   areas:
+			//     - 1_72_2799_0
+			v, err := parseScalar(strings.TrimSpace(content[1:]))
+			if err != nil {
+				return nil, fail("%s", err)
+			}
+			list.List = append(list.List, v)
+
+		case cur != nil && indent > itemIndent && (fieldIndent < 0 || indent == fieldIndent):
+			fieldIndent = indent
+			f, err := yamlField(content, lineNo)
+			if err != nil {
+				return nil, err
+			}
+			cur.Fields = append(cur.Fields, f)
+			list = f.blockList()
+
+		default:
+			return nil, fail("unexpected indentation")
+		}
+	}
+
+	return doc, nil
+}
+
+// yamlField parse the line of key: value
+//
+func yamlField(content string, line int) (*planField, error) {
+	i := strings.Index(content, ":")
+	for i >= 0 && i+1 < len(content) && content[i+1] != ' ' {
+		j := strings.Index(content[i+1:], ":")
+		if j < 0 {
+			i = -1
+			break
+		}
+		i += 1 + j
+	}
+	if i <= 0 {
+		return nil, &PlanError{Line: line, Msg: fmt.Sprintf("expect key: value, got %q", content)}
+	}
+
+	f := &planField{Key: strings.TrimSpace(content[:i]), Line: line}
+	if err := f.parseValue(strings.TrimSpace(content[i+1:])); err != nil {
+		return nil, &PlanError{Line: line, Msg: err.Error()}
+	}
+	return f, nil
+}
+
+// blockList return f if its value may be the block list in the lines after
+//
+func (f *planField) blockList() *planField {
+	if f.IsList || f.Value != "" {
+		return nil
+	}
+	f.IsList = true
+	f.List = make([]string, 0)
+	return f
+}
+
+// parseTOMLPlan parse the subset of TOML used by the plan:
+//
+//  policy = "all"
+//  strategy = "monitor"
+//
+//  [[targets]]
+//  sku = "2567304"
+//  num = 2
+//  max_price = 300
+//  areas = ["1_72_2799_0"]
+//
+// Only the key/value pairs and the array of tables [[targets]] are
+// supported, the arrays must be in one line.
+//
+func parseTOMLPlan(data []byte) (*planDoc, error) {
+	doc := &planDoc{}
+	var cur *planTable
+
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNo := i + 1
+		text := strings.TrimSpace(stripComment(line))
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if text != "[[targets]]" {
+				return nil, &PlanError{Line: lineNo, Msg: fmt.Sprintf("unsupported table %s, expect [[targets]]", text)}
+			}
+			cur = &planTable{Line: lineNo}
+			doc.Targets = append(doc.Targets, cur)
+			continue
+		}
+
+		eq := strings.IndexByte(text, '=')
+		if eq <= 0 {
+			return nil, &PlanError{Line: lineNo, Msg: fmt.Sprintf("expect key = value, got %q", text)}
+		}
+		key, err := parseScalar(strings.TrimSpace(text[:eq]))
+		if err != nil {
+			return nil, &PlanError{Line: lineNo, Msg: err.Error()}
+		}
+		f := &planField{Key: key, Line: lineNo}
+		if err = f.parseValue(strings.TrimSpace(text[eq+1:])); err != nil {
+			return nil, &PlanError{Line: lineNo, Msg: err.Error()}
+		}
+
+		if cur == nil {
+			doc.Fields = append(doc.Fields, f)
+		} else {
+			cur.Fields = append(cur.Fields, f)
+		}
+	}
+
+	return doc, nil
+}
+
+// plan validate the fields and convert them to Plan, same as ParsePlan for
+// JSON
+//
+func (doc *planDoc) plan() (*Plan, error) {
+	plan := &Plan{Targets: make([]*ExpectProduct, 0)}
+	var errs PlanErrors
+	fail := func(f *planField, format string, args ...interface{}) {
+		errs = append(errs, &PlanError{Line: f.Line, Msg: fmt.Sprintf(format, args...)})
+	}
+	scalar := func(f *planField) string {
+		if f.IsList {
+			if len(f.List) > 0 {
+				fail(f, "%s must not be a list", f.Key)
+			}
+			return ""
+		}
+		return f.Value
+	}
+
+	for _, f := range doc.Fields {
+		switch f.Key {
+		case "policy":
+			if plan.Policy = scalar(f); !ValidPolicy(plan.Policy) {
+				fail(f, "invalid policy %q, expect all, any or split", plan.Policy)
+			}
+		case "strategy":
+			if plan.Strategy = scalar(f); !ValidStrategy(plan.Strategy) {
+				fail(f, "invalid strategy %q, expect cart or monitor", plan.Strategy)
+			}
+		case "targets":
+			fail(f, "targets must be a list of mappings")
+		default:
+			fail(f, "unknown field %q", f.Key)
+		}
+	}
+
+	for _, table := range doc.Targets {
+		var t planTarget
+		for _, f := range table.Fields {
+			var err error
+			switch f.Key {
+			case "sku":
+				t.SKU = scalar(f)
+			case "num":
+				t.Num, err = strconv.Atoi(scalar(f))
+			case "max_price":
+				t.MaxPrice, err = strconv.ParseFloat(scalar(f), 64)
+			case "max_total":
+				t.MaxTotal, err = strconv.ParseFloat(scalar(f), 64)
+			case "areas":
+				if !f.IsList {
+					fail(f, "areas must be a list")
+				}
+				t.Areas = f.List
+			case "priority":
+				t.Priority, err = strconv.Atoi(scalar(f))
+			case "start":
+				t.Start = scalar(f)
+			case "account":
+				t.Account = scalar(f)
+			case "optional":
+				t.Optional, err = strconv.ParseBool(scalar(f))
+			default:
+				fail(f, "unknown field %q", f.Key)
+			}
+			if err != nil {
+				fail(f, "invalid %s %q", f.Key, f.Value)
+			}
+		}
+
+		p, es := t.product(table.Line)
+		plan.Targets = append(plan.Targets, p)
+		errs = append(errs, es...)
+	}
+
+	errs = append(errs, plan.validate()...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return plan, nil
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStripComment(t *testing.T) {
+	cases := []struct {
+		line string
+		want string
+	}{
+		{`sku: 1 # comment`, `sku: 1 `},
+		{`# only comment`, ``},
+		{`name: a#b`, `name: a#b`},
+		{`name: "a # b" # c`, `name: "a # b" `},
+		{`name: 'a # b'`, `name: 'a # b'`},
+		{`name: "a \" # b"`, `name: "a \" # b"`},
+		{`name: 'it''s' # c`, `name: 'it''s' `},
+	}
+
+	for _, c := range cases {
+		if got := stripComment(c.line); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.line, got, c.want)
+		}
+	}
+}
+
+func TestParseScalar(t *testing.T) {
+	cases := []struct {
+		s    string
+		want string
+		fail bool
+	}{
+		{`plain`, `plain`, false},
+		{`"a\tb"`, "a\tb", false},
+		{`"中文"`, `中文`, false},
+		{`'it''s'`, `it's`, false},
+		{`'a\tb'`, `a\tb`, false},
+		{`~`, ``, false},
+		{`null`, ``, false},
+		{`"open`, ``, true},
+		{`'open`, ``, true},
+		{`'`, ``, true},
+	}
+
+	for _, c := range cases {
+		got, err := parseScalar(c.s)
+		if (err != nil) != c.fail || got != c.want {
+			t.Errorf("%s: got %q %v, want %q fail %v", c.s, got, err, c.want, c.fail)
+		}
+	}
+}
+
+func TestParsePlanSubset(t *testing.T) {
+	cases := []struct {
+		name   string
+		format string
+		data   string
+		want   string // the targets as "sku num account areas", or the error
+	}{
+		// YAML
+		{"yaml flow list with quoted comma", PlanYAML,
+			"targets:\n  - sku: 1\n    areas: ['1_2', \"3,4\", ]\n", `line 2: invalid area "3,4"`},
+		{"yaml block list", PlanYAML,
+			"targets:\n- sku: 1\n  areas:\n  - 1_2\n  - '3_4' # c\n", "1 1  [1_2 3_4]"},
+		{"yaml dash alone", PlanYAML,
+			"targets:\n  -\n    sku: '1'\n    num: 2\n  - sku: \"2\"\n", "1 2  []; 2 1  []"},
+		{"yaml document start and comments", PlanYAML,
+			"---\n# plan\npolicy: any # c\n\ntargets:\n  - sku: 1 # c\n", "1 1  []"},
+		{"yaml empty targets", PlanYAML, "targets: []\n", "no targets"},
+		{"yaml quoted key value", PlanYAML,
+			"targets:\n  - sku: 1\n    account: \"a.b@c\"\n", "1 1 a.b@c []"},
+		{"yaml nested mapping", PlanYAML,
+			"targets:\n  - sku: 1\n    areas:\n      beijing: 1_2\n", "line 4: unexpected indentation"},
+		{"yaml nested top level", PlanYAML, "policy:\n  all: true\n", "line 2: unexpected indentation"},
+		{"yaml bad field indentation", PlanYAML,
+			"targets:\n  - sku: 1\n   num: 2\n", "line 3: unexpected indentation"},
+		{"yaml tab indentation", PlanYAML, "targets:\n\t- sku: 1\n", "line 2: tabs are not allowed"},
+		{"yaml targets scalar", PlanYAML, "targets: 1\n", "line 1: targets must be a list of mappings"},
+		{"yaml missing colon", PlanYAML, "targets:\n  - sku 1\n", `line 2: expect key: value`},
+		{"yaml multi-line flow list", PlanYAML,
+			"targets:\n  - sku: 1\n    areas: [1_2,\n      3_4]\n", "line 3: list of areas must end in the same line"},
+		{"yaml bad quote", PlanYAML, "targets:\n  - sku: \"1\n", "line 2: invalid string"},
+		{"yaml list as scalar", PlanYAML, "targets:\n  - sku: [1]\n", "line 2: sku must not be a list"},
+
+		// TOML
+		{"toml arrays of tables", PlanTOML,
+			"[[targets]]\nsku = \"1\"\n\n[[targets]] # second\nsku = \"2\"\nnum = 3\n", "1 1  []; 2 3  []"},
+		{"toml quoted key and comment", PlanTOML,
+			"[[targets]]\n\"sku\" = \"1\" # c\nareas = [ \"1_2\", '3#4' ]\n", `line 1: invalid area "3#4"`},
+		{"toml trailing comma", PlanTOML,
+			"[[targets]]\nsku = \"1\"\nareas = [\"1_2\",]\n", "1 1  [1_2]"},
+		{"toml nested table", PlanTOML,
+			"[[targets]]\nsku = \"1\"\n[targets.extra]\nnum = 2\n", "line 3: unsupported table [targets.extra]"},
+		{"toml other array of tables", PlanTOML, "[[goods]]\nsku = \"1\"\n", "line 1: unsupported table [[goods]]"},
+		{"toml inline table", PlanTOML, "[[targets]]\nsku = { id = 1 }\n", `line 1: invalid sku "{ id = 1 }"`},
+		{"toml missing equal", PlanTOML, "[[targets]]\nsku \"1\"\n", "line 2: expect key = value"},
+		{"toml areas not list", PlanTOML, "[[targets]]\nsku = \"1\"\nareas = \"1_2\"\n", "line 3: areas must be a list"},
+		{"toml field before targets", PlanTOML, "sku = \"1\"\n", `line 1: unknown field "sku"`},
+	}
+
+	for _, c := range cases {
+		plan, err := ParsePlanAs([]byte(c.data), c.format)
+		var got string
+		if err != nil {
+			got = err.Error()
+			if c.want == "" || !strings.Contains(got, c.want) {
+				t.Errorf("%s: error %s, want %q", c.name, got, c.want)
+			}
+			continue
+		}
+
+		lst := make([]string, len(plan.Targets))
+		for i, p := range plan.Targets {
+			lst[i] = fmt.Sprintf("%s %d %s %v", p.ID, p.Num, p.Account, p.Areas)
+		}
+		if got = strings.Join(lst, "; "); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package core
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RushStatus is the overall result of RushBuy
+//
+type RushStatus int
+
+const (
+	RushSuccess RushStatus = iota // all the goods bought
+	RushPartial                   // some of the goods bought
+	RushFailure                   // nothing bought
+)
+
+func (s RushStatus) String() string {
+	switch s {
+	case RushSuccess:
+		return "success"
+	case RushPartial:
+		return "partial"
+	default:
+		return "failure"
+	}
+}
+
+// ItemReport is the outcome of one goods
+//
+type ItemReport struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Optional  bool    `json:"optional"`
+	Seckill   bool    `json:"seckill"`   // bought through the seckill flow
+	Added     bool    `json:"added"`     // in the shopping cart
+	CountSet  bool    `json:"count_set"` // count in the cart set as expected
+	Count     int     `json:"count"`     // expected count
+	Price     float64 `json:"price"`     // the last price seen
+	State     string  `json:"state"`     // the last stock state seen
+	StateName string  `json:"state_name"`
+	Failures  int     `json:"failures"`        // polling failures retried, see Monitor
+	Ready     bool    `json:"ready"`           // price and stock meet the condition
+	Ordered   bool    `json:"ordered"`         // included in a submitted order
+	Error     string  `json:"error,omitempty"` // the reason if failed
+
+	// from the price and stock met the condition to the order submitted,
+	// to compare the strategies
+	ReadyAt  time.Time     `json:"ready_at"`
+	ToSubmit time.Duration `json:"to_submit,omitempty"`
+}
+
+// SubmitAttempt is one try of submitting the order
+//
+type SubmitAttempt struct {
+	SKUs       []string      `json:"skus"`
+	Time       time.Time     `json:"time"`
+	Elapsed    time.Duration `json:"elapsed"`
+	ResultCode int           `json:"result_code"` // 0 for success, -1 for request or response error, or failure without code
+	Message    string        `json:"message"`
+	OrderID    int64         `json:"order_id,omitempty"`
+}
+
+// RushReport is the result of RushBuy
+//
+type RushReport struct {
+	Start    time.Time        `json:"start"`
+	End      time.Time        `json:"end"`    // zero while rushing
+	Submit   bool             `json:"submit"` // whether submit the order, see JDConfig.AutoSubmit
+	Canceled bool             `json:"canceled"`
+	Items    []*ItemReport    `json:"items"`
+	Submits  []*SubmitAttempt `json:"submits"`
+	OrderIDs []int64          `json:"order_ids"`
+
+	// latency of the requests by step, see Timing
+	Steps map[string]*StepStats `json:"steps"`
+
+	mu sync.Mutex
+}
+
+// NewRushReport create the report for the plan
+//
+func NewRushReport(plan *Plan, submit bool) *RushReport {
+	return newRushReport(plan.sorted(), submit)
+}
+
+// newRushReport create the report for the goods list
+//
+func newRushReport(lst []*ExpectProduct, submit bool) *RushReport {
+	r := &RushReport{
+		Start:    time.Now(),
+		Submit:   submit,
+		Items:    make([]*ItemReport, 0, len(lst)),
+		Submits:  make([]*SubmitAttempt, 0),
+		OrderIDs: make([]int64, 0),
+		Steps:    make(map[string]*StepStats),
+	}
+	for _, p := range lst {
+		r.Items = append(r.Items, &ItemReport{
+			ID:       p.ID,
+			Count:    p.Num,
+			Optional: p.Optional,
+		})
+	}
+	return r
+}
+
+// Item return the report of goods, nil if not found
+//
+func (r *RushReport) Item(ID string) *ItemReport {
+	for _, item := range r.Items {
+		if item.ID == ID {
+			return item
+		}
+	}
+	return nil
+}
+
+// update change the item report with lock held
+//
+func (r *RushReport) update(ID string, fn func(item *ItemReport)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if item := r.Item(ID); item != nil {
+		fn(item)
+	}
+}
+
+// fail record the error of the goods
+//
+func (r *RushReport) fail(ID string, err error) {
+	r.update(ID, func(item *ItemReport) {
+		item.Error = err.Error()
+	})
+}
+
+// observe record the price and stock of the sku
+//
+func (r *RushReport) observe(sku *SKUInfo) {
+	r.update(sku.ID, func(item *ItemReport) {
+		item.Name = sku.Name
+		item.Price = sku.Price
+		item.State = sku.State
+		item.StateName = sku.StateName
+	})
+}
+
+// addTiming aggregate the latency of the request
+//
+func (r *RushReport) addTiming(t *Timing) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, exist := r.Steps[t.Step]
+	if !exist {
+		stats = &StepStats{}
+		r.Steps[t.Step] = stats
+	}
+	stats.add(t)
+}
+
+// addSubmit record the submit attempt for the goods
+//
+func (r *RushReport) addSubmit(a *SubmitAttempt) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Submits = append(r.Submits, a)
+	if a.ResultCode != 0 {
+		return
+	}
+
+	r.OrderIDs = append(r.OrderIDs, a.OrderID)
+	for _, ID := range a.SKUs {
+		if item := r.Item(ID); item != nil {
+			item.Ordered = true
+			item.Error = ""
+			if !item.ReadyAt.IsZero() {
+				item.ToSubmit = a.Time.Add(a.Elapsed).Sub(item.ReadyAt)
+			}
+		}
+	}
+}
+
+// finish mark the end of rush, and whether it was canceled
+//
+func (r *RushReport) finish(ctx context.Context) {
+	r.mu.Lock()
+	r.End = time.Now()
+	r.Canceled = ctx.Err() != nil
+	r.mu.Unlock()
+}
+
+// Snapshot return a copy of the report, safe to read while rushing
+//
+func (r *RushReport) Snapshot() *RushReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := &RushReport{
+		Start:    r.Start,
+		End:      r.End,
+		Submit:   r.Submit,
+		Canceled: r.Canceled,
+		Items:    make([]*ItemReport, len(r.Items)),
+		Submits:  make([]*SubmitAttempt, len(r.Submits)),
+		OrderIDs: append(make([]int64, 0, len(r.OrderIDs)), r.OrderIDs...),
+		Steps:    make(map[string]*StepStats, len(r.Steps)),
+	}
+	for step, stats := range r.Steps {
+		copied := *stats
+		c.Steps[step] = &copied
+	}
+	for i, item := range r.Items {
+		copied := *item
+		c.Items[i] = &copied
+	}
+	for i, a := range r.Submits {
+		copied := *a
+		c.Submits[i] = &copied
+	}
+	return c
+}
+
+// done check whether the goods finished as expected: ordered, or ready
+// when the order is not going to submit
+//
+func (r *RushReport) done(item *ItemReport) bool {
+	if r.Submit {
+		return item.Ordered
+	}
+	return item.Ready
+}
+
+// Status return the overall result of the rush
+//
+func (r *RushReport) Status() RushStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var done, required, requiredDone int
+	for _, item := range r.Items {
+		ok := r.done(item)
+		if ok {
+			done++
+		}
+		if !item.Optional {
+			required++
+			if ok {
+				requiredDone++
+			}
+		}
+	}
+
+	switch {
+	case done == 0:
+		return RushFailure
+	case requiredDone == required && (required > 0 || done == len(r.Items)):
+		return RushSuccess
+	default:
+		return RushPartial
+	}
+}
+
+// Log print the report to out
+//
+func (r *RushReport) Log(out Logger) {
+	log := newLogger(out)
+	status := r.Status()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log.Info(strSeperater)
+	log.Info("抢购结果> %s, 耗时 %s", status, r.End.Sub(r.Start))
+	if r.Canceled {
+		log.Info("抢购已取消")
+	}
+	for _, item := range r.Items {
+		result := "失败"
+		if item.Ordered {
+			result = "已下单"
+		} else if item.Ready {
+			result = "已就绪"
+		}
+		log.Info("%-8s%-12s%-4d¥%-10.2f%-6s%s %s",
+			result, item.ID, item.Count, item.Price, item.StateName, item.Name, item.Error)
+		if item.ToSubmit > 0 {
+			log.Info("        就绪到下单耗时 %s", item.ToSubmit)
+		}
+	}
+	for _, a := range r.Submits {
+		log.Info("提交订单[%s] %s 耗时 %s, 结果 %d %s",
+			strings.Join(a.SKUs, ","), a.Time.Format("15:04:05.000"), a.Elapsed, a.ResultCode, a.Message)
+	}
+	for _, orderID := range r.OrderIDs {
+		log.Info("订单号: %d", orderID)
+	}
+	logSteps(log, r.Steps)
+}
+
+// logSteps print the latency of each step
+//
+func logSteps(log *logger, steps map[string]*StepStats) {
+	if len(steps) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(steps))
+	for step := range steps {
+		names = append(names, step)
+	}
+	sort.Strings(names)
+
+	log.Info("请求耗时> 步骤          次数  失败  平均        最大        首字节      新连接")
+	for _, step := range names {
+		s := steps[step]
+		ttfb := time.Duration(0)
+		if s.Count > 0 {
+			ttfb = s.TTFB / time.Duration(s.Count)
+		}
+		log.Info("          %-14s%-6d%-6d%-12s%-12s%-12s%d",
+			step, s.Count, s.Errors, s.Mean().Round(time.Millisecond), s.Max.Round(time.Millisecond),
+			ttfb.Round(time.Millisecond), s.Conns)
+	}
+}
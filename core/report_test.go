@@ -0,0 +1,84 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRushReportStatus(t *testing.T) {
+	type item struct {
+		optional bool
+		ordered  bool // included in a successful submit
+		ready    bool
+	}
+	cases := []struct {
+		name   string
+		submit bool
+		items  []item
+		failed bool // a failed submit of all the goods attempted too
+		want   RushStatus
+	}{
+		{"all ordered", true, []item{{ordered: true}, {ordered: true}}, false, RushSuccess},
+		{"some ordered", true, []item{{ordered: true}, {}}, false, RushPartial},
+		{"nothing ordered", true, []item{{}, {}}, false, RushFailure},
+		{"failed submit", true, []item{{ready: true}, {ready: true}}, true, RushFailure},
+		{"ready but not submitted", true, []item{{ready: true}}, false, RushFailure},
+		{"optional missing", true, []item{{ordered: true}, {optional: true}}, false, RushSuccess},
+		{"only optional ordered", true, []item{{}, {optional: true, ordered: true}}, false, RushPartial},
+		{"all optional ordered", true, []item{{optional: true, ordered: true}, {optional: true, ordered: true}}, false, RushSuccess},
+		{"some optional ordered", true, []item{{optional: true, ordered: true}, {optional: true}}, false, RushPartial},
+		{"dry run ready", false, []item{{ready: true}, {optional: true}}, false, RushSuccess},
+		{"dry run some ready", false, []item{{ready: true}, {}}, false, RushPartial},
+		{"dry run none ready", false, []item{{}, {optional: true}}, false, RushFailure},
+		{"empty", true, nil, false, RushFailure},
+	}
+
+	for _, c := range cases {
+		lst := make([]*ExpectProduct, len(c.items))
+		for i, it := range c.items {
+			lst[i] = &ExpectProduct{ID: string(rune('1' + i)), Num: 1, Optional: it.optional}
+		}
+		r := newRushReport(lst, c.submit)
+
+		var ordered, all []string
+		for i, it := range c.items {
+			ID := lst[i].ID
+			all = append(all, ID)
+			if it.ready || it.ordered {
+				r.update(ID, func(item *ItemReport) { item.Ready = true })
+			}
+			if it.ordered {
+				ordered = append(ordered, ID)
+			}
+		}
+		if c.failed {
+			r.addSubmit(&SubmitAttempt{SKUs: all, ResultCode: -1, Message: "下单失败"})
+		}
+		if len(ordered) > 0 {
+			r.addSubmit(&SubmitAttempt{SKUs: ordered, OrderID: 1})
+		}
+
+		if got := r.Status(); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRushReportSubmit(t *testing.T) {
+	r := newRushReport([]*ExpectProduct{{ID: "1", Num: 1}, {ID: "2", Num: 1}}, true)
+	r.fail("1", errors.New("失败"))
+	r.fail("2", errors.New("失败"))
+
+	r.addSubmit(&SubmitAttempt{SKUs: []string{"1", "2"}, ResultCode: 60017})
+	r.addSubmit(&SubmitAttempt{SKUs: []string{"1"}, OrderID: 123})
+
+	if len(r.Submits) != 2 || len(r.OrderIDs) != 1 || r.OrderIDs[0] != 123 {
+		t.Errorf("submits %d, order IDs %v", len(r.Submits), r.OrderIDs)
+	}
+	if item := r.Item("1"); !item.Ordered || item.Error != "" {
+		t.Errorf("item 1 ordered %v, error %q", item.Ordered, item.Error)
+	}
+	if item := r.Item("2"); item.Ordered || item.Error == "" {
+		t.Errorf("item 2 ordered %v, error %q", item.Ordered, item.Error)
+	}
+}
@@ -0,0 +1,360 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Policy decide how to submit the order when the plan has multiple goods
+//
+const (
+	PolicyAll   = "all"   // submit only when all the required goods are ready
+	PolicyAny   = "any"   // submit the goods ready, one refresh period after the first one is ready
+	PolicySplit = "split" // submit one order for each goods as soon as it is ready
+)
+
+// Strategy decide when to put the goods into the cart
+//
+const (
+	StrategyCart    = "cart"    // add to cart first, then wait the price and stock
+	StrategyMonitor = "monitor" // wait the price and stock, then add to cart and submit at once
+)
+
+// ErrCanceled is the error of goods not finished when the rush canceled
+var ErrCanceled = errors.New("抢购已取消")
+
+// errStopWaiting is the error of goods not ready when the others submitted
+// by PolicyAny
+var errStopWaiting = errors.New("其他商品已满足条件下单，停止等待")
+
+// RushBuy buy the goods of the plan. Goods already in the shopping cart are
+// reused, and only the goods in the plan keep selected in the cart. When
+// to submit the order is decided by the plan policy. The outcome of each
+// goods and the submit attempts are returned.
+//
+func (jd *JingDong) RushBuy(plan *Plan) *RushReport {
+	report := NewRushReport(plan, jd.AutoSubmit)
+	jd.Rush(context.Background(), plan, report)
+	return report
+}
+
+// Rush is RushBuy with the report created by NewRushReport, so that the
+// progress can be watched by report.Snapshot while rushing. Waiting for
+// the stock, price or start time stops when ctx canceled, and the order
+// is not submitted anymore.
+//
+func (jd *JingDong) Rush(ctx context.Context, plan *Plan, report *RushReport) {
+	skuLst := plan.sorted()
+	policy := plan.Policy
+	if policy == "" {
+		policy = PolicyAll
+	}
+	buy := jd.buyGood
+	if plan.Strategy == StrategyMonitor {
+		buy = jd.monitorGood
+	}
+
+	defer report.finish(ctx)
+
+	// the latency of the requests while rushing
+	timings := jd.Subscribe(1024, &Timing{})
+	timingDone := make(chan struct{})
+	go func() {
+		defer close(timingDone)
+		for e := range timings.C {
+			report.addTiming(e.(*Timing))
+		}
+	}()
+	defer func() {
+		timings.Close()
+		<-timingDone
+	}()
+
+	items, err := jd.CartItems()
+	if err != nil {
+		jd.log.Error("获取购物车商品失败: %+v", err)
+	}
+
+	cart := make(map[string]*CartItem)
+	for _, item := range items {
+		cart[item.ID] = item
+	}
+
+	// 预约抢购的商品走秒杀流程，不进购物车
+	var (
+		seckill, normal []*ExpectProduct
+		reserves        = make(map[string]*ReserveInfo)
+	)
+	for _, p := range skuLst {
+		if info := jd.seckillInfo(p.ID); info != nil {
+			reserves[p.ID] = info
+			seckill = append(seckill, p)
+		} else {
+			normal = append(normal, p)
+		}
+	}
+	skuLst = normal
+
+	// 抢购商品只能单独下单，无法和其他商品一起满足 all
+	if policy == PolicyAll && len(seckill) > 0 && len(seckill)+len(normal) > 1 {
+		ids := make([]string, len(seckill))
+		for i, p := range seckill {
+			ids[i] = p.ID
+		}
+		err := fmt.Errorf("计划包含预约抢购商品 %s，只能单独下单，all 策略无法保证全部商品一起下单，请使用 any 或 split", strings.Join(ids, ","))
+		jd.log.Error("%s", err)
+		jd.publish(&RushAborted{Time: time.Now(), Reason: err.Error()})
+		for _, p := range append(seckill, normal...) {
+			report.fail(p.ID, err)
+		}
+		return
+	}
+
+	// 取消掉所有不相关商品的选中勾选状态
+	jd.reconcileCart(items, wantedSet(skuLst))
+
+	var (
+		wg, seckillWG sync.WaitGroup
+		mu            sync.Mutex
+		ready         = make(map[string]bool)
+		readyCh       = make(chan struct{}, len(skuLst))
+	)
+
+	// the seckill goods are ordered alone, not waited by the others
+	defer seckillWG.Wait()
+	for _, p := range seckill {
+		seckillWG.Add(1)
+		go func(p *ExpectProduct) {
+			defer seckillWG.Done()
+			// 立即预约，开始时间之后才获取抢购链接
+			if err := jd.seckillBuy(ctx, p, reserves[p.ID], report); err != nil {
+				jd.log.Error("抢购 %d 个 %s 失败：%s", p.Num, p.ID, err.Error())
+				report.fail(p.ID, err)
+			}
+		}(p)
+	}
+
+	// any 策略下，其余商品在下单时停止等待
+	waitCtx, stopWait := context.WithCancel(ctx)
+	defer stopWait()
+	fail := func(ID string, err error) {
+		if waitCtx.Err() != nil && ctx.Err() == nil {
+			err = errStopWaiting
+		}
+		report.fail(ID, err)
+	}
+
+	for _, p := range skuLst {
+		wg.Add(1)
+		go func(p *ExpectProduct) {
+			defer wg.Done()
+			if err := jd.waitStart(waitCtx, p); err != nil {
+				fail(p.ID, err)
+				return
+			}
+
+			sku, err := jd.SKUDetail(p.ID, p.Areas)
+			if err != nil {
+				fail(p.ID, err)
+				return
+			}
+			sku.ExpectPrice = p.UnitLimit()
+			sku.Count = p.Num
+			if err = buy(waitCtx, sku, cart[p.ID], report); err != nil {
+				jd.log.Error("加入 %d 个 %s 到购物车失败：%s", sku.Count, sku.ID, err.Error())
+				fail(p.ID, err)
+				return
+			}
+
+			mu.Lock()
+			ready[p.ID] = true
+			mu.Unlock()
+			report.update(p.ID, func(item *ItemReport) {
+				item.Ready = true
+			})
+			readyCh <- struct{}{}
+
+			if policy == PolicySplit {
+				jd.checkout(ctx, []*ExpectProduct{p}, policy, report)
+			}
+		}(p)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// any 策略不等待所有商品，第一个商品满足条件后再等一个刷新周期，
+	// 让同时满足条件的商品一起下单
+	if policy == PolicyAny {
+		select {
+		case <-done:
+		case <-readyCh:
+			grace := time.NewTimer(jd.Period)
+			select {
+			case <-done:
+			case <-grace.C:
+				jd.log.Info("已有商品满足下单条件，停止等待其余商品")
+			}
+			grace.Stop()
+		}
+		stopWait()
+	}
+	<-done
+
+	if ctx.Err() != nil {
+		jd.log.Info("抢购已取消")
+		jd.publish(&RushAborted{Time: time.Now(), Reason: "抢购已取消"})
+		return
+	}
+	if policy == PolicySplit || len(skuLst) == 0 {
+		return
+	}
+
+	lst := make([]*ExpectProduct, 0, len(skuLst))
+	for _, p := range skuLst {
+		if ready[p.ID] {
+			lst = append(lst, p)
+			continue
+		}
+		if policy == PolicyAll && !p.Optional {
+			jd.log.Error("必选商品 %s 未满足下单条件，放弃下单", p.ID)
+			jd.publish(&RushAborted{Time: time.Now(), Reason: fmt.Sprintf("必选商品 %s 未满足下单条件，放弃下单", p.ID)})
+			return
+		}
+		jd.log.Info("商品 %s 未满足下单条件，不包含在订单内", p.ID)
+	}
+
+	if len(lst) == 0 {
+		jd.log.Error("没有满足下单条件的商品")
+		jd.publish(&RushAborted{Time: time.Now(), Reason: "没有满足下单条件的商品，放弃下单"})
+		return
+	}
+
+	jd.checkout(ctx, lst, policy, report)
+}
+
+// checkout submit the order with only the goods of lst selected in cart
+//
+func (jd *JingDong) checkout(ctx context.Context, lst []*ExpectProduct, policy string, report *RushReport) {
+	jd.cartLock.Lock()
+	defer jd.cartLock.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	items, err := jd.CartItems()
+	if err != nil {
+		jd.log.Error("获取购物车商品失败: %+v", err)
+		return
+	}
+	jd.reconcileCart(items, wantedSet(lst))
+
+	jd.OrderInfo()
+
+	if !jd.AutoSubmit {
+		return
+	}
+
+	skus := make([]string, len(lst))
+	for i, p := range lst {
+		skus[i] = p.ID
+	}
+
+SUBMITORDER:
+	attempt := jd.SubmitOrder()
+	attempt.SKUs = skus
+	report.addSubmit(attempt)
+	jd.publish(attempt)
+
+	switch res := attempt.ResultCode; res {
+	case 0:
+		jd.publish(&OrderPlaced{Time: time.Now(), OrderID: attempt.OrderID, SKUs: skus})
+		return
+	case ResultReserveOnly, ResultRushOnly:
+		// 这种抢购商品提前加入购物车下单是没用的，改走秒杀流程
+		if policy == PolicyAll && len(lst) > 1 {
+			err := fmt.Errorf("购物车内有抢购商品，只能单独下单，all 策略无法保证全部商品一起下单")
+			jd.log.Error("%s", err)
+			jd.publish(&RushAborted{Time: time.Now(), Reason: err.Error()})
+			for _, p := range lst {
+				report.fail(p.ID, err)
+			}
+			return
+		}
+		jd.log.Info("购物车内有抢购商品，改走抢购流程")
+		for _, p := range lst {
+			info, ok := jd.seckillGoods(p.ID)
+			if !ok {
+				// 普通商品永远等不到抢购链接
+				err := fmt.Errorf("商品 %s 不是抢购商品，无法改走抢购流程", p.ID)
+				jd.log.Error("%s", err)
+				report.fail(p.ID, err)
+				continue
+			}
+			if err := jd.seckillBuy(ctx, p, info, report); err != nil {
+				jd.log.Error("抢购 %d 个 %s 失败：%s", p.Num, p.ID, err.Error())
+				report.fail(p.ID, err)
+			}
+		}
+		return
+	case 60017: // 您多次提交过快，请稍后再试
+		if err := sleep(ctx, 1*time.Second); err != nil {
+			for _, p := range lst {
+				report.fail(p.ID, err)
+			}
+			return
+		}
+	default:
+		jd.log.Error("unknown resultCode for submitorder: %d", res)
+		jd.publish(&RushAborted{Time: time.Now(), Reason: fmt.Sprintf("下单失败, %d : %s", res, attempt.Message)})
+		for _, p := range lst {
+			report.fail(p.ID, fmt.Errorf("下单失败, %d : %s", res, attempt.Message))
+		}
+		return
+	}
+
+	goto SUBMITORDER
+}
+
+// wantedSet return the set of goods ID
+//
+func wantedSet(lst []*ExpectProduct) map[string]bool {
+	wanted := make(map[string]bool)
+	for _, p := range lst {
+		wanted[p.ID] = true
+	}
+	return wanted
+}
+
+// waitStart wait until the start time of the target
+//
+func (jd *JingDong) waitStart(ctx context.Context, p *ExpectProduct) error {
+	if d := time.Until(p.StartAt); d > 0 {
+		jd.log.Info("商品 %s 将于 %s 开始抢购, 等待 %s", p.ID, p.StartAt.Format("2006-01-02 15:04:05"), d)
+		return jd.waitUntil(ctx, p.StartAt)
+	}
+	return nil
+}
+
+// sleep wait for the duration, ErrCanceled returned if ctx canceled before
+//
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ErrCanceled
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,464 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	sjson "github.com/bitly/go-simplejson"
+	"github.com/pkg/errors"
+)
+
+// 预约抢购 / 立即抢购 的商品不能走购物车下单, 需要走marathon的秒杀流程:
+//
+//  1. yushou 查询预约信息, 并提前预约
+//  2. 开抢后 itemko 返回抢购链接 divide.jd.com/user_routing
+//  3. 访问 marathon.jd.com/captcha.html, 会跳转到秒杀结算页
+//  4. init.action 拿到收货地址, 发票和token
+//  5. submitOrder.action 提交订单
+//
+const (
+	URLReserveInfo  = "https://yushou.jd.com/youshouinfo.action"
+	URLSeckillBtn   = "https://itemko.jd.com/itemShowBtn"
+	URLSeckillPage  = "https://marathon.jd.com/seckill/seckill.action"
+	URLSeckillInit  = "https://marathon.jd.com/seckillnew/orderService/pc/init.action"
+	URLSeckillOrder = "https://marathon.jd.com/seckillnew/orderService/pc/submitOrder.action"
+)
+
+const (
+	// resultCode of SubmitOrder for goods which need the seckill flow
+	ResultReserveOnly = 61036  // 预约抢购，暂不支持购买的商品
+	ResultRushOnly    = 600126 // 正在参与抢购活动，请重新回到商品详情页，使用“立即抢购”进行购买
+
+	// how many times to retry when the rush url not ready after buy time
+	seckillRetry = 60
+)
+
+// ReserveInfo is the reservation (预约) information of goods
+//
+//  fetchJSON({"type":"1","state":2,"url":"//yushou.jd.com/toYuyue.action?sku=100012043978&key=...",
+//    "info":"预约进行中","qiangStime":"2020-01-01 10:00:00","qiangEtime":"",...})
+//
+type ReserveInfo struct {
+	ID      string
+	URL     string    // 预约链接
+	State   int       // 预约状态
+	Info    string    // 预约状态描述
+	BuyTime time.Time // 开抢时间, 零值表示未知
+}
+
+// seckillOrder is the data returned by init.action, used to submit order
+//
+type seckillOrder struct {
+	token   string
+	address *sjson.Json
+	invoice *sjson.Json
+}
+
+// chinaZone is the timezone of all time string returned by JD
+var chinaZone = time.FixedZone("CST", 8*3600)
+
+// postForm post the form data to URL, the response data returned
+//
+func (jd *JingDong) postForm(URL string, form url.Values) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	applyCustomHeader(req, DefaultHeaders)
+
+	resp, err := jd.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status : %s", resp.Status)
+	}
+
+	return jd.responseData(resp), nil
+}
+
+// ReserveInfo query the reservation information of goods, nil returned if
+// the goods does not need reservation.
+//
+func (jd *JingDong) ReserveInfo(ID string) (*ReserveInfo, error) {
+	data, err := jd.getResponse("GET", URLReserveInfo, func(URL string) string {
+		u, _ := url.Parse(URL)
+		q := u.Query()
+		q.Set("callback", "fetchJSON")
+		q.Set("sku", ID)
+		q.Set("_", strconv.FormatInt(time.Now().Unix()*1000, 10))
+		u.RawQuery = q.Encode()
+		return u.String()
+	})
+
+	if err != nil {
+		jd.log.Error("获取商品（%s）预约信息失败: %+v", ID, err)
+		return nil, err
+	}
+
+	js, err := parseJSONP(data)
+	if err != nil {
+		jd.log.Trace("Response Data: %s", data)
+		return nil, errors.Wrap(err, "解析预约信息失败")
+	}
+
+	link := js.Get("url").MustString()
+	if link == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(link, "//") {
+		link = "https:" + link
+	}
+
+	info := &ReserveInfo{
+		ID:    ID,
+		URL:   link,
+		State: js.Get("state").MustInt(),
+		Info:  js.Get("info").MustString(),
+	}
+
+	if s := js.Get("qiangStime").MustString(); s != "" {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", s, chinaZone); err == nil {
+			info.BuyTime = t
+		}
+	}
+
+	return info, nil
+}
+
+// Reserve make reservation (预约) for the goods
+//
+func (jd *JingDong) Reserve(info *ReserveInfo) error {
+	if _, err := jd.getResponse("GET", info.URL, nil); err != nil {
+		jd.log.Error("预约商品（%s）失败: %+v", info.ID, err)
+		return err
+	}
+
+	jd.log.Info("预约商品 %s 成功, 开抢时间: %s", info.ID, info.BuyTime.Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+// seckillURL return the rush url from the item page, empty if not start yet
+//
+//  jQuery123456({"type":"3","url":"//divide.jd.com/user_routing?skuId=8654289&sn=...&from=pc"})
+//
+func (jd *JingDong) seckillURL(ID string) (string, error) {
+	data, err := jd.getResponse("GET", URLSeckillBtn, func(URL string) string {
+		u, _ := url.Parse(URL)
+		q := u.Query()
+		q.Set("callback", "jQuery123456")
+		q.Set("skuId", ID)
+		q.Set("from", "pc")
+		q.Set("_", strconv.FormatInt(time.Now().Unix()*1000, 10))
+		u.RawQuery = q.Encode()
+		return u.String()
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	js, err := parseJSONP(data)
+	if err != nil {
+		jd.log.Trace("Response Data: %s", data)
+		return "", errors.Wrap(err, "解析抢购链接失败")
+	}
+
+	link := js.Get("url").MustString()
+	if link == "" {
+		return "", nil
+	}
+
+	// divide.jd.com/user_routing => marathon.jd.com/captcha.html
+	link = strings.Replace(link, "divide", "marathon", 1)
+	link = strings.Replace(link, "user_routing", "captcha.html", 1)
+	if strings.HasPrefix(link, "//") {
+		link = "https:" + link
+	}
+
+	return link, nil
+}
+
+// waitSeckillURL wait until the buy time, then poll the rush url
+//
+func (jd *JingDong) waitSeckillURL(ctx context.Context, ID string, buyTime time.Time) (string, error) {
+	if d := time.Until(buyTime); d > 0 {
+		jd.log.Info("商品 %s 将于 %s 开抢, 等待 %s", ID, buyTime.Format("15:04:05"), d)
+		if err := jd.waitUntil(ctx, buyTime); err != nil {
+			return "", err
+		}
+	}
+
+	for retry := jd.Retry.Seckill; jd.AutoRush || retry != 0; retry-- {
+		link, err := jd.seckillURL(ID)
+		if err != nil {
+			jd.log.Error("获取商品（%s）抢购链接失败: %+v", ID, err)
+		} else if link != "" {
+			jd.log.Info("抢购链接: %s", link)
+			return link, nil
+		}
+		if err = sleep(ctx, jd.Period); err != nil {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("商品（%s）未获取到抢购链接", ID)
+}
+
+// seckillInit go through the marathon checkout pages, and get the data
+// needed to submit order
+//
+func (jd *JingDong) seckillInit(ID string, num int, link string) (*seckillOrder, error) {
+	// captcha.html 会跳转到 seckill.action
+	if _, err := jd.getResponse("GET", link, nil); err != nil {
+		return nil, errors.Wrap(err, "访问抢购链接失败")
+	}
+
+	_, err := jd.getResponse("GET", URLSeckillPage, func(URL string) string {
+		u, _ := url.Parse(URL)
+		q := u.Query()
+		q.Set("skuId", ID)
+		q.Set("num", strconv.Itoa(num))
+		q.Set("rid", strconv.FormatInt(time.Now().Unix(), 10))
+		u.RawQuery = q.Encode()
+		return u.String()
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "访问秒杀结算页失败")
+	}
+
+	data, err := jd.postForm(URLSeckillInit, url.Values{
+		"sku":             {ID},
+		"num":             {strconv.Itoa(num)},
+		"isModifyAddress": {"false"},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "获取秒杀结算信息失败")
+	}
+
+	js, err := sjson.NewJson(data)
+	if err != nil {
+		jd.log.Trace("Response Data: %s", data)
+		return nil, errors.Wrap(err, "解析秒杀结算信息失败")
+	}
+
+	order := &seckillOrder{
+		token:   js.Get("token").MustString(),
+		address: js.Get("addressList").GetIndex(0),
+		invoice: js.Get("invoiceInfo"),
+	}
+	if order.address.Interface() == nil {
+		return nil, errors.New("秒杀结算信息里没有收货地址")
+	}
+
+	return order, nil
+}
+
+// submitSeckillOrder submit the order from the marathon checkout page
+//
+func (jd *JingDong) submitSeckillOrder(ID string, num int, order *seckillOrder) *SubmitAttempt {
+	attempt := &SubmitAttempt{SKUs: []string{ID}, Time: time.Now(), ResultCode: -1}
+	defer func() {
+		attempt.Elapsed = time.Since(attempt.Time)
+	}()
+
+	addr, inv := order.address, order.invoice
+	str := func(js *sjson.Json, key string) string {
+		v := js.Get(key).Interface()
+		if v == nil {
+			return ""
+		}
+		return fmt.Sprint(v)
+	}
+
+	form := url.Values{
+		"skuId":              {ID},
+		"num":                {strconv.Itoa(num)},
+		"addressId":          {str(addr, "id")},
+		"yuShou":             {"true"},
+		"isModifyAddress":    {"false"},
+		"name":               {str(addr, "name")},
+		"provinceId":         {str(addr, "provinceId")},
+		"cityId":             {str(addr, "cityId")},
+		"countyId":           {str(addr, "countyId")},
+		"townId":             {str(addr, "townId")},
+		"addressDetail":      {str(addr, "addressDetail")},
+		"mobile":             {str(addr, "mobile")},
+		"mobileKey":          {str(addr, "mobileKey")},
+		"email":              {str(addr, "email")},
+		"postCode":           {""},
+		"invoiceTitle":       {str(inv, "invoiceTitle")},
+		"invoiceCompanyName": {""},
+		"invoiceContent":     {str(inv, "invoiceContentType")},
+		"invoiceTaxpayerNO":  {""},
+		"invoiceEmail":       {""},
+		"invoicePhone":       {str(inv, "invoicePhone")},
+		"invoicePhoneKey":    {str(inv, "invoicePhoneKey")},
+		"invoice":            {strconv.FormatBool(inv.Interface() != nil)},
+		"password":           {""},
+		"codTimeType":        {"3"},
+		"paymentType":        {"4"},
+		"areaCode":           {""},
+		"overseas":           {"0"},
+		"phone":              {""},
+		"eid":                {""},
+		"fp":                 {""},
+		"token":              {order.token},
+		"pru":                {""},
+	}
+
+	data, err := jd.postForm(URLSeckillOrder+"?skuId="+ID, form)
+	if err != nil {
+		attempt.Message = err.Error()
+		return attempt
+	}
+
+	js, err := sjson.NewJson(data)
+	if err != nil {
+		jd.log.Info("Reponse Data: %s", data)
+		attempt.Message = "无法解析秒杀订单响应数据: " + err.Error()
+		return attempt
+	}
+
+	jd.log.Trace("秒杀订单: %s", data)
+
+	if succ, _ := js.Get("success").Bool(); succ {
+		attempt.OrderID, _ = js.Get("orderId").Int64()
+		attempt.ResultCode = 0
+		return attempt
+	}
+
+	attempt.ResultCode = failureCode(js)
+	if attempt.Message, _ = js.Get("errorMessage").String(); attempt.Message == "" {
+		attempt.Message = "秒杀订单提交失败: " + truncate(string(data))
+	}
+	return attempt
+}
+
+// SeckillBuy buy the goods through the reservation / seckill flow: reserve
+// at once, wait for the start time of p and the rush url at sale time, then
+// go through the marathon checkout pages and submit there. The order is not submitted if
+// the price exceeds the limit of p. The submit attempts are recorded into
+// report. Waiting is stopped when ctx canceled.
+//
+func (jd *JingDong) SeckillBuy(ctx context.Context, p *ExpectProduct, report *RushReport) error {
+	info, err := jd.ReserveInfo(p.ID)
+	if err != nil {
+		return err
+	}
+	return jd.seckillBuy(ctx, p, info, report)
+}
+
+// seckillBuy is SeckillBuy with the reservation information known, nil if
+// the goods needs no reservation
+//
+func (jd *JingDong) seckillBuy(ctx context.Context, p *ExpectProduct, info *ReserveInfo, report *RushReport) error {
+	log := jd.log.With(Fields{"sku": p.ID})
+	log.Info(strSeperater)
+	log.Info("抢购商品: %s", p.ID)
+
+	var (
+		err     error
+		buyTime time.Time
+	)
+	if info != nil {
+		log.Info("预约状态: %d %s", info.State, info.Info)
+		if err = jd.Reserve(info); err != nil {
+			return err
+		}
+		buyTime = info.BuyTime
+	}
+
+	// 预约在前，开始时间只限制获取抢购链接
+	if err = jd.waitStart(ctx, p); err != nil {
+		return err
+	}
+
+	link, err := jd.waitSeckillURL(ctx, p.ID, buyTime)
+	if err != nil {
+		return err
+	}
+
+	order, err := jd.seckillInit(p.ID, p.Num, link)
+	if err != nil {
+		return err
+	}
+
+	// 秒杀价只在开抢后才有，进入结算页后再检查
+	if limit := p.UnitLimit(); limit != math.MaxFloat64 {
+		sku := &SKUInfo{ID: p.ID, ExpectPrice: limit}
+		if err = jd.updatePrice(sku); err != nil {
+			return err
+		}
+		report.update(p.ID, func(item *ItemReport) {
+			item.Price = sku.Price
+		})
+		if sku.Price <= 0 || sku.Price > limit {
+			reason := fmt.Sprintf("商品 %s 抢购价格（%.2f）超出期望价格（%.2f），放弃下单", p.ID, sku.Price, limit)
+			jd.publish(&RushAborted{Time: time.Now(), Reason: reason})
+			return errors.New(reason)
+		}
+	}
+
+	report.update(p.ID, func(item *ItemReport) {
+		item.Seckill = true
+		item.Ready = true
+	})
+
+	if !jd.AutoSubmit {
+		log.Info("商品 %s 已进入秒杀结算页, 未开启自动下单", p.ID)
+		return nil
+	}
+
+	for retry := jd.Retry.Seckill; retry != 0; retry-- {
+		attempt := jd.submitSeckillOrder(p.ID, p.Num, order)
+		report.addSubmit(attempt)
+		jd.publish(attempt)
+		if attempt.ResultCode == 0 {
+			log.With(Fields{"result_code": 0, "latency": attempt.Elapsed}).Info("抢购成功，订单号：%d", attempt.OrderID)
+			jd.publish(&OrderPlaced{Time: time.Now(), OrderID: attempt.OrderID, SKUs: attempt.SKUs})
+			return nil
+		}
+
+		log.With(Fields{"result_code": attempt.ResultCode, "latency": attempt.Elapsed}).Error("抢购下单失败, %d : %s", attempt.ResultCode, attempt.Message)
+		if attempt.ResultCode == -1 {
+			return errors.New(attempt.Message)
+		}
+		if err = sleep(ctx, jd.Period); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("商品（%s）抢购失败", p.ID)
+}
+
+// seckillInfo return the reservation information if the goods has to go
+// through the seckill flow, nil otherwise
+//
+func (jd *JingDong) seckillInfo(ID string) *ReserveInfo {
+	info, err := jd.ReserveInfo(ID)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// seckillGoods check whether the goods can go through the seckill flow, by
+// the reservation or the rush url of itemShowBtn, the reservation returned
+// if any
+//
+func (jd *JingDong) seckillGoods(ID string) (*ReserveInfo, bool) {
+	if info := jd.seckillInfo(ID); info != nil {
+		return info, true
+	}
+	link, err := jd.seckillURL(ID)
+	return nil, err == nil && link != ""
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"github.com/PuerkitoBio/goquery"
+)
+
+// PageCheck is the result of checking one page by SelfCheck
+//
+type PageCheck struct {
+	Page   string           `json:"page"`
+	Checks []*SelectorCheck `json:"checks"`
+	Parsed interface{}      `json:"parsed,omitempty"` // what the parser got from the page
+	Error  string           `json:"error,omitempty"`  // the page not loaded
+}
+
+// OK check whether the page loaded and all the required selectors matched
+//
+func (c *PageCheck) OK() bool {
+	if c.Error != "" {
+		return false
+	}
+	for _, s := range c.Checks {
+		if !s.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// SelfCheck load the pages scraped and check whether the selectors of the
+// parsers still match, so that the layout changes of JingDong are found
+// before rushing. The goods page of ID needs no login, the cart and the
+// order page do. With add, the goods is put into the cart by gate.action to
+// check the result page, and removed afterwards if not in the cart before.
+// Without the cart loaded, it is unknown whether the goods was there, so
+// nothing is added.
+//
+func (jd *JingDong) SelfCheck(ID string, add bool) []*PageCheck {
+	lst := make([]*PageCheck, 0, 4)
+	check := func(page string, load func() (*goquery.Document, error), parse func(doc *goquery.Document) interface{}) *PageCheck {
+		c := &PageCheck{Page: page, Checks: make([]*SelectorCheck, 0)}
+		lst = append(lst, c)
+
+		doc, err := load()
+		if err != nil {
+			c.Error = err.Error()
+			return c
+		}
+		c.Checks = checkSelectors(page, doc)
+		c.Parsed = parse(doc)
+		return c
+	}
+
+	sku := &SKUInfo{ID: ID, Count: 1}
+	check(PageSKU, func() (*goquery.Document, error) {
+		return jd.loadSKUPage(ID)
+	}, func(doc *goquery.Document) interface{} {
+		sku.Name, sku.Link = parseSKUPage(doc)
+		return map[string]string{"name": sku.Name, "link": sku.Link}
+	})
+
+	jd.cartLock.Lock()
+	defer jd.cartLock.Unlock()
+
+	var existed bool
+	cart := check(PageCart, jd.loadCart, func(doc *goquery.Document) interface{} {
+		items := parseCartItems(doc)
+		for _, item := range items {
+			if item.ID == ID {
+				existed = true
+			}
+		}
+		count, amount := parseCartTotal(doc)
+		return map[string]interface{}{"items": items, "count": count, "amount": amount}
+	})
+
+	if add && cart.Error == "" {
+		check(PageAddToCart, func() (*goquery.Document, error) {
+			return jd.gate(sku)
+		}, func(doc *goquery.Document) interface{} {
+			return map[string]bool{"added": parseAddToCart(doc)}
+		})
+	}
+
+	check(PageOrder, jd.loadOrder, func(doc *goquery.Document) interface{} {
+		return parseOrderPreview(doc)
+	})
+
+	if add && cart.Error == "" && !existed {
+		items, err := jd.CartItems()
+		if err == nil {
+			for _, item := range items {
+				if item.ID == ID {
+					err = jd.cartAction(URLRemoveItem, item)
+				}
+			}
+		}
+		if err != nil {
+			jd.log.Error("删除购物车内商品(%s)失败: %+v", ID, err)
+		}
+	}
+	return lst
+}
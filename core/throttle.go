@@ -0,0 +1,262 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the first backoff when throttled, doubled each time throttled again
+	// within the quiet period
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+
+	// the backoff is reset if not throttled for the times of it
+	quietBackoffs = 4
+)
+
+var (
+	// throttleURLs are the risk control pages redirected to, not the
+	// captcha.html of marathon.jd.com which the seckill has to go through
+	throttleURLs = []string{"safe.jd.com", "risk_handler"}
+
+	// throttleMarks are the content of the captcha pages returned instead
+	// of the JSON expected, or the title of the risk control page
+	throttleMarks = []string{"验证码", "安全验证", "captcha"}
+
+	// titlePattern find the title of the HTML page
+	titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// ThrottledError is returned when JingDong limits the requests, the host is
+// backed off by the RateLimiter, retry later instead of giving up
+//
+type ThrottledError struct {
+	URL    string
+	Reason string
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("请求被限制（%s）: %s", e.Reason, e.URL)
+}
+
+// IsThrottled check whether the error is caused by throttling
+//
+func IsThrottled(err error) bool {
+	var e *ThrottledError
+	return errors.As(err, &e)
+}
+
+// Throttled is fired when the requests throttled by JingDong, the requests
+// of the host are paused for Backoff
+//
+type Throttled struct {
+	Time    time.Time
+	Host    string
+	URL     string
+	Reason  string
+	Backoff time.Duration
+}
+
+// When implement Event
+func (e *Throttled) When() time.Time { return e.Time }
+
+// RateLimiter limit the requests of each host by token bucket, and pause the
+// host when throttled. Share one between the JingDong of accounts to limit
+// them all.
+//
+type RateLimiter struct {
+	rate  float64 // tokens per second, no limit if 0
+	burst float64
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+// hostLimit is the token bucket and the backoff of one host
+//
+type hostLimit struct {
+	tokens    float64
+	last      time.Time // last time the tokens updated
+	backoff   time.Duration
+	throttled time.Time // last time throttled
+	pause     time.Time // requests paused until
+}
+
+// NewRateLimiter create the limiter allowing rate requests per second for
+// each host, with burst ones at most at once. No limit if rate is 0, but
+// the throttled hosts are still backed off.
+//
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:  rate,
+		burst: float64(burst),
+		hosts: make(map[string]*hostLimit),
+	}
+}
+
+// host return the limit of the host, must be called with mu locked
+//
+func (l *RateLimiter) host(name string) *hostLimit {
+	h, exist := l.hosts[name]
+	if !exist {
+		h = &hostLimit{tokens: l.burst, last: time.Now()}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+// Wait block until the request to the host is allowed, or ctx done
+//
+func (l *RateLimiter) Wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	h := l.host(host)
+	now := time.Now()
+	wait := h.pause.Sub(now)
+
+	if l.rate > 0 {
+		h.tokens += now.Sub(h.last).Seconds() * l.rate
+		if h.tokens > l.burst {
+			h.tokens = l.burst
+		}
+		h.last = now
+
+		// take the token now, and wait until it is filled
+		h.tokens--
+		if h.tokens < 0 {
+			if d := time.Duration(-h.tokens / l.rate * float64(time.Second)); d > wait {
+				wait = d
+			}
+		}
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Throttle pause the host, the backoff is doubled if throttled again soon
+//
+func (l *RateLimiter) Throttle(host string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(host)
+	now := time.Now()
+	switch {
+	case h.backoff == 0 || now.Sub(h.throttled) > h.backoff*quietBackoffs:
+		h.backoff = minBackoff
+	case now.Before(h.pause):
+		// the requests sent before the pause, already backed off
+		return h.pause.Sub(now)
+	default:
+		h.backoff *= 2
+		if h.backoff > maxBackoff {
+			h.backoff = maxBackoff
+		}
+	}
+	h.throttled = now
+	h.pause = now.Add(h.backoff)
+	return h.backoff
+}
+
+// throttle back off the host of the URL, and fire Throttled
+//
+func (jd *JingDong) throttle(u *url.URL, reason string) error {
+	backoff := jd.Limiter.Throttle(u.Host)
+	jd.log.With(Fields{"host": u.Host, "backoff": backoff}).Warn("请求被限制（%s）: %s, 暂停 %s", reason, u.Host, backoff)
+
+	URL := u.Scheme + "://" + u.Host + u.Path
+	jd.publish(&Throttled{Time: time.Now(), Host: u.Host, URL: URL, Reason: reason, Backoff: backoff})
+	return &ThrottledError{URL: URL, Reason: reason}
+}
+
+// throttledBody check whether the response is a captcha page. A page in
+// place of the JSON or JSONP announced is checked by its content, while the
+// HTML pages expected, such as the product and cart pages, mentioning the
+// captcha of the login box, are checked by the title only
+//
+func throttledBody(contentType string, data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '<' {
+		return false
+	}
+
+	str := string(data)
+	if mt, _, err := mime.ParseMediaType(contentType); err != nil || !isScriptType(mt) {
+		m := titlePattern.FindStringSubmatch(str)
+		if m == nil {
+			return false
+		}
+		str = m[1]
+	}
+
+	for _, mark := range throttleMarks {
+		if strings.Contains(str, mark) {
+			return true
+		}
+	}
+	return false
+}
+
+// isScriptType check whether the media type is JSON or JSONP
+//
+func isScriptType(mt string) bool {
+	return strings.HasSuffix(mt, "/json") || strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "javascript")
+}
+
+// limitTransport wait the RateLimiter before each request, and detect the
+// throttling by the status code or the risk control page redirected to
+//
+type limitTransport struct {
+	next http.RoundTripper
+	jd   *JingDong
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := req.URL.Host + req.URL.Path
+	for _, mark := range throttleURLs {
+		if strings.Contains(target, mark) {
+			return nil, t.jd.throttle(req.URL, "风控页面")
+		}
+	}
+
+	if err := t.jd.Limiter.Wait(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusForbidden:
+		resp.Body.Close()
+		return nil, t.jd.throttle(req.URL, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestThrottledBody(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		data        string
+		want        bool
+	}{
+		{"json", "application/json", `{"msg":"请输入验证码"}`, false},
+		{"jsonp", "application/javascript", `cb({"code":201})`, false},
+		{"captcha for json", "application/json;charset=utf-8", "<html><body>请完成安全验证</body></html>", true},
+		{"captcha for jsonp", "text/javascript", "<html><body>captcha</body></html>", true},
+		{"risk control page", "text/html", "<html><head><title>京东-安全验证</title></head></html>", true},
+		{"product page", "text/html; charset=gbk", "<html><head><title>商品</title></head><body>手机验证码登录</body></html>", false},
+		{"cart page", "", "<html><head><title>我的购物车</title></head><body>验证码</body></html>", false},
+	}
+
+	for _, c := range cases {
+		if got := throttledBody(c.contentType, []byte(c.data)); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// roundTripFunc is the http.RoundTripper by function
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestLimitTransport(t *testing.T) {
+	cases := []struct {
+		name      string
+		url       string
+		status    int
+		sent      bool
+		throttled bool
+	}{
+		{"seckill captcha", "https://marathon.jd.com/captcha.html?skuId=1", http.StatusOK, true, false},
+		{"safe page", "https://safe.jd.com/dangerousVerify/index.action", http.StatusOK, false, true},
+		{"risk handler", "https://cfe.m.jd.com/privatedomain/risk_handler/03101900/", http.StatusOK, false, true},
+		{"too many requests", "https://c0.3.cn/stock", http.StatusTooManyRequests, true, true},
+		{"forbidden", "https://c0.3.cn/stock", http.StatusForbidden, true, true},
+		{"ok", "https://cart.jd.com/cart.action", http.StatusOK, true, false},
+	}
+
+	for _, c := range cases {
+		sent := false
+		jd := &JingDong{JDConfig: JDConfig{Limiter: NewRateLimiter(0, 0)}, log: newLogger(nil)}
+		tr := &limitTransport{jd: jd, next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent = true
+			return &http.Response{StatusCode: c.status, Status: http.StatusText(c.status), Body: http.NoBody, Request: req}, nil
+		})}
+
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		resp, err := tr.RoundTrip(req)
+		if sent != c.sent {
+			t.Errorf("%s: sent %v, want %v", c.name, sent, c.sent)
+		}
+		if IsThrottled(err) != c.throttled {
+			t.Errorf("%s: error %v, want throttled %v", c.name, err, c.throttled)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	cases := []struct {
+		name  string
+		rate  float64
+		burst int
+		n     int           // requests sent at once
+		min   time.Duration // the time of the last request at least
+		max   time.Duration
+	}{
+		{"no limit", 0, 1, 20, 0, 50 * time.Millisecond},
+		{"within burst", 10, 5, 5, 0, 50 * time.Millisecond},
+		{"beyond burst", 20, 2, 4, 90 * time.Millisecond, 300 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		l := NewRateLimiter(c.rate, c.burst)
+		start := time.Now()
+		for i := 0; i < c.n; i++ {
+			if err := l.Wait(context.Background(), "c0.3.cn"); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		if d := time.Since(start); d < c.min || d > c.max {
+			t.Errorf("%s: took %s, want %s ~ %s", c.name, d, c.min, c.max)
+		}
+	}
+
+	// the hosts are limited separately
+	l := NewRateLimiter(1, 1)
+	l.Wait(context.Background(), "a")
+	start := time.Now()
+	l.Wait(context.Background(), "b")
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("host b waited %s for host a", d)
+	}
+}
+
+func TestRateLimiterThrottle(t *testing.T) {
+	l := NewRateLimiter(0, 0)
+	ago := func(d time.Duration) time.Time { return time.Now().Add(-d) }
+
+	cases := []struct {
+		name      string
+		backoff   time.Duration // the state before, zero for the first time
+		throttled time.Time
+		pause     time.Time
+		min, max  time.Duration // the backoff returned
+	}{
+		{"first", 0, time.Time{}, time.Time{}, minBackoff, minBackoff},
+		{"again soon", 2 * time.Second, ago(3 * time.Second), ago(time.Second), 4 * time.Second, 4 * time.Second},
+		{"while paused", 4 * time.Second, ago(time.Second), time.Now().Add(3 * time.Second), 2 * time.Second, 3 * time.Second},
+		{"at most", maxBackoff, ago(2 * maxBackoff), ago(maxBackoff), maxBackoff, maxBackoff},
+		{"quiet long enough", 2 * time.Second, ago(9 * time.Second), ago(7 * time.Second), minBackoff, minBackoff},
+	}
+
+	for _, c := range cases {
+		l.hosts["c0.3.cn"] = &hostLimit{backoff: c.backoff, throttled: c.throttled, pause: c.pause, last: time.Now()}
+		if d := l.Throttle("c0.3.cn"); d < c.min || d > c.max {
+			t.Errorf("%s: backoff %s, want %s ~ %s", c.name, d, c.min, c.max)
+		}
+	}
+
+	// the requests wait for the pause
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, "c0.3.cn"); err != context.DeadlineExceeded {
+		t.Errorf("wait while paused: %v, want deadline exceeded", err)
+	}
+	if err := l.Wait(ctx, "p.3.cn"); err != nil {
+		t.Errorf("other host paused: %v", err)
+	}
+}
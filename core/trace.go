@@ -0,0 +1,259 @@
+package core
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Steps of the purchase pipeline, the requests are grouped by them
+//
+const (
+	StepDetail      = "detail"       // the goods page
+	StepPrice       = "price"        // prices/mgets
+	StepStock       = "stock"        // stocks of the area
+	StepGate        = "gate"         // gate.action, add to cart
+	StepChangeCount = "change_count" // changeNum.action
+	StepCart        = "cart"         // the cart page
+	StepCartAction  = "cart_action"  // select, unselect or remove in the cart
+	StepOrderInfo   = "order_info"   // getOrderInfo.action
+	StepCoupon      = "coupon"       // best coupons of the order
+	StepSubmit      = "submit"       // submitOrder.action
+	StepSeckill     = "seckill"      // the seckill flow
+	StepLogin       = "login"        // login and the session check
+)
+
+// stepURLs map the URL prefixes to the steps, the longest matched wins
+var stepURLs = map[string]string{
+	URLGoodsDets:       StepDetail,
+	URLGoodsPrice:      StepPrice,
+	URLSKUState:        StepStock,
+	URLAdd2Cart:        StepGate,
+	URLChangeCount:     StepChangeCount,
+	URLCartInfo:        StepCart,
+	"cart.jd.com/":     StepCartAction,
+	URLOrderInfo:       StepOrderInfo,
+	URLBestCoupons:     StepCoupon,
+	URLSubmitOrder:     StepSubmit,
+	URLReserveInfo:     StepSeckill,
+	URLSeckillBtn:      StepSeckill,
+	"marathon.jd.com/": StepSeckill,
+	URLForQR[0]:        StepLogin,
+	"qr.m.jd.com/":     StepLogin,
+	"passport.jd.com/": StepLogin,
+	URLForQR[4]:        StepLogin,
+}
+
+// stepOf return the step of the request, the host if not known
+//
+func stepOf(req *http.Request) string {
+	step, n := req.URL.Host, 0
+	target := req.URL.Host + req.URL.Path
+	for prefix, s := range stepURLs {
+		prefix = strings.TrimPrefix(strings.TrimPrefix(prefix, "https://"), "http://")
+		if i := strings.Index(prefix, "%s"); i >= 0 {
+			prefix = prefix[:i]
+		}
+		if len(prefix) > n && strings.HasPrefix(target, prefix) {
+			step, n = s, len(prefix)
+		}
+	}
+	return step
+}
+
+// Timing is fired for each request with the latency traced, the durations
+// are from the request started, zero if not happened, such as DNS and
+// Connect for the connection reused
+//
+type Timing struct {
+	Time    time.Time     `json:"time"`
+	Step    string        `json:"step"`
+	Method  string        `json:"method"`
+	URL     string        `json:"url"` // without the query
+	Status  int           `json:"status"`
+	Error   string        `json:"error,omitempty"`
+	Reused  bool          `json:"reused"`  // the connection reused
+	DNS     time.Duration `json:"dns"`     // DNS done
+	Connect time.Duration `json:"connect"` // TCP connected
+	TLS     time.Duration `json:"tls"`     // TLS handshake done
+	TTFB    time.Duration `json:"ttfb"`    // the first byte of response
+	Total   time.Duration `json:"total"`   // the body closed
+}
+
+// When implement Event
+func (e *Timing) When() time.Time { return e.Time }
+
+// StepStats is the timings of one step aggregated
+//
+type StepStats struct {
+	Count  int           `json:"count"`
+	Errors int           `json:"errors"`
+	Total  time.Duration `json:"total"` // the sum of Timing.Total
+	Max    time.Duration `json:"max"`
+	TTFB   time.Duration `json:"ttfb"`  // the sum of Timing.TTFB
+	Conns  int           `json:"conns"` // new connections
+	Dial   time.Duration `json:"dial"`  // the sum of DNS, connect and TLS of the new connections
+}
+
+// Mean return the average latency
+//
+func (s *StepStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// add aggregate the timing
+//
+func (s *StepStats) add(t *Timing) {
+	s.Count++
+	if t.Error != "" {
+		s.Errors++
+	}
+	s.Total += t.Total
+	if t.Total > s.Max {
+		s.Max = t.Total
+	}
+	s.TTFB += t.TTFB
+	if !t.Reused {
+		s.Conns++
+		s.Dial += t.TLS
+		if t.TLS == 0 {
+			s.Dial += t.Connect
+		}
+	}
+}
+
+// traceTransport trace the requests by httptrace, and fire Timing
+//
+type traceTransport struct {
+	next http.RoundTripper
+	jd   *JingDong
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	timing := &Timing{
+		Time:   start,
+		Step:   stepOf(req),
+		Method: req.Method,
+		URL:    req.URL.Scheme + "://" + req.URL.Host + req.URL.Path,
+	}
+
+	var mu sync.Mutex
+	since := func(d *time.Duration) {
+		mu.Lock()
+		*d = time.Since(start)
+		mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			timing.Reused = info.Reused
+			mu.Unlock()
+		},
+		DNSDone:              func(httptrace.DNSDoneInfo) { since(&timing.DNS) },
+		ConnectDone:          func(string, string, error) { since(&timing.Connect) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { since(&timing.TLS) },
+		GotFirstResponseByte: func() { since(&timing.TTFB) },
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		mu.Lock()
+		timing.Total = time.Since(start)
+		timing.Error = err.Error()
+		mu.Unlock()
+		t.jd.publish(timing)
+		t.log(req, timing)
+		return nil, err
+	}
+
+	timing.Status = resp.StatusCode
+	resp.Body = &timedBody{ReadCloser: resp.Body, done: func() {
+		mu.Lock()
+		timing.Total = time.Since(start)
+		mu.Unlock()
+		t.jd.publish(timing)
+		t.log(req, timing)
+	}}
+	return resp, nil
+}
+
+// log the request finished if JDConfig.TraceRequests
+//
+func (t *traceTransport) log(req *http.Request, timing *Timing) {
+	if !t.jd.TraceRequests {
+		return
+	}
+
+	log := t.jd.log.With(Fields{
+		"step":    timing.Step,
+		"method":  timing.Method,
+		"status":  timing.Status,
+		"latency": timing.Total,
+	})
+	if timing.Error != "" {
+		log.Trace("请求> %s %s 失败 %s: %s", req.Method, redactURL(req.URL), timing.Total, timing.Error)
+		return
+	}
+	log.Trace("请求> %s %s %d %s", req.Method, redactURL(req.URL), timing.Status, timing.Total)
+}
+
+// sensitiveParams are the query parameters hidden in the requests traced,
+// in lower case
+var sensitiveParams = []string{"token", "ticket", "trackid", "wlfstk_smdl", "pin", "eid", "fp", "sid", "skey", "password", "pwd"}
+
+// redactURL return the URL with the password, tokens and tickets hidden
+//
+func redactURL(u *url.URL) string {
+	c := *u
+	if c.User != nil {
+		c.User = url.User(c.User.Username())
+	}
+
+	q := c.Query()
+	for k := range q {
+		if sensitiveParam(k) {
+			q.Set(k, "xxx")
+		}
+	}
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// sensitiveParam check whether the query parameter should be hidden, such
+// as submitOrderParam.trackID
+//
+func sensitiveParam(name string) bool {
+	name = strings.ToLower(name)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, p := range sensitiveParams {
+		if name == p || (len(p) > 3 && strings.Contains(name, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// timedBody call done once the body is closed
+//
+type timedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
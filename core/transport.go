@@ -0,0 +1,244 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportOption tune the connections of the HTTP client, for the flash
+// sale the connections can be warmed before the start time
+//
+type TransportOption struct {
+	RoundTripper        http.RoundTripper        // custom transport, Proxy and the connection options ignored if set
+	Timeouts            map[string]time.Duration // timeout by endpoint, the host or URL prefix as key, override JDConfig.Timeout
+	KeepAlive           time.Duration            // TCP keep-alive period, 30s if 0
+	MaxIdleConnsPerHost int                      // idle connections kept for each host, 16 if 0
+	IdleConnTimeout     time.Duration            // how long the idle connections kept, 90s if 0
+	DisableHTTP2        bool                     // HTTP/2 is tried for https by default
+	WarmUp              time.Duration            // connect to the hosts this long before the start time, 0 to disable
+	Record              string                   // directory to record the requests and responses, see Recorder
+	Replay              string                   // directory of the records served instead of JingDong, see Replayer
+}
+
+const (
+	defaultKeepAlive           = 30 * time.Second
+	defaultMaxIdleConnsPerHost = 16
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// warmHosts are the hosts of the purchase pipeline, connected by WarmUp
+var warmHosts = []string{
+	"https://item.jd.com/",
+	"https://p.3.cn/",
+	"https://c0.3.cn/",
+	"https://cart.jd.com/",
+	"https://trade.jd.com/",
+	"https://marathon.jd.com/",
+}
+
+// ValidateProxy check the proxy URL, http, https and socks5 supported
+//
+func ValidateProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("no proxy host in %q", proxy)
+	}
+	return nil
+}
+
+// newTransport create the transport of the client from the options
+//
+func (jd *JingDong) newTransport() http.RoundTripper {
+	next := jd.Transport.RoundTripper
+	if next == nil {
+		opt := jd.Transport
+		if opt.KeepAlive == 0 {
+			opt.KeepAlive = defaultKeepAlive
+		}
+		if opt.MaxIdleConnsPerHost == 0 {
+			opt.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+		}
+		if opt.IdleConnTimeout == 0 {
+			opt.IdleConnTimeout = defaultIdleConnTimeout
+		}
+
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: opt.KeepAlive,
+		}).DialContext
+		t.MaxIdleConnsPerHost = opt.MaxIdleConnsPerHost
+		t.IdleConnTimeout = opt.IdleConnTimeout
+		if opt.DisableHTTP2 {
+			t.ForceAttemptHTTP2 = false
+			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+
+		next = t
+		if jd.Proxy != "" {
+			// no fallback to the environment proxy or direct connection
+			if err := ValidateProxy(jd.Proxy); err != nil {
+				jd.log.Error("代理设置无效: %s", err)
+				next = errTransport{err}
+			} else {
+				u, _ := url.Parse(jd.Proxy)
+				t.Proxy = http.ProxyURL(u)
+			}
+		}
+	}
+
+	switch opt := jd.Transport; {
+	case opt.Replay != "":
+		r, err := NewReplayer(opt.Replay)
+		if err != nil {
+			jd.log.Error("加载请求记录失败: %s", err)
+			next = errTransport{err}
+		} else {
+			jd.log.Info("回放请求记录: %s", opt.Replay)
+			next = r
+		}
+	case opt.Record != "":
+		r, err := NewRecorder(opt.Record, next)
+		if err != nil {
+			jd.log.Error("创建请求记录目录失败: %s", err)
+		} else {
+			jd.log.Info("记录请求到: %s", opt.Record)
+			next = r
+		}
+	}
+
+	// the wait of the limiter is not counted in the timeout or the timing
+	next = &timeoutTransport{next: next, timeout: jd.Timeout, timeouts: jd.Transport.Timeouts}
+	next = &traceTransport{next: next, jd: jd}
+	return &limitTransport{next: next, jd: jd}
+}
+
+// errTransport fail all the requests, nothing should be sent to JingDong
+// when the records to replay are broken
+//
+type errTransport struct {
+	err error
+}
+
+func (t errTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// timeoutTransport apply the timeout of the endpoint to each request,
+// instead of one timeout of http.Client for all
+//
+type timeoutTransport struct {
+	next     http.RoundTripper
+	timeout  time.Duration
+	timeouts map[string]time.Duration
+}
+
+// timeoutOf return the timeout of the longest key matched
+//
+func (t *timeoutTransport) timeoutOf(u *url.URL) time.Duration {
+	d, n := t.timeout, 0
+	target := u.Host + u.Path
+	for key, v := range t.timeouts {
+		key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		if len(key) > n && strings.HasPrefix(target, key) {
+			d, n = v, len(key)
+		}
+	}
+	return d
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d := t.timeoutOf(req.URL)
+	if d <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), d)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody release the timeout once the body is closed
+//
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// WarmUp connect to the hosts of the purchase pipeline, so that the DNS,
+// TCP and TLS handshakes are done before the flash sale
+//
+func (jd *JingDong) WarmUp() {
+	start := time.Now()
+
+	// the responses do not matter, redirects not followed
+	client := *jd.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	var wg sync.WaitGroup
+	for _, URL := range warmHosts {
+		wg.Add(1)
+		go func(URL string) {
+			defer wg.Done()
+			req, err := http.NewRequest("HEAD", URL, nil)
+			if err != nil {
+				return
+			}
+			applyCustomHeader(req, DefaultHeaders)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				jd.log.Warn("预热连接 %s 失败: %s", URL, err)
+				return
+			}
+			resp.Body.Close()
+		}(URL)
+	}
+	wg.Wait()
+
+	jd.log.Trace("预热连接完成, 耗时 %s", time.Since(start))
+}
+
+// waitUntil sleep until the time, the connections warmed before it if
+// WarmUp set
+//
+func (jd *JingDong) waitUntil(ctx context.Context, t time.Time) error {
+	if jd.Transport.WarmUp > 0 {
+		if d := time.Until(t.Add(-jd.Transport.WarmUp)); d > 0 {
+			if err := sleep(ctx, d); err != nil {
+				return err
+			}
+			jd.WarmUp()
+		}
+	}
+	return sleep(ctx, time.Until(t))
+}
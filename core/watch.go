@@ -0,0 +1,282 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Conditions of WatchAlert
+//
+const (
+	WatchBelow   = "below"   // price at or below WatchRule.Below
+	WatchDrop    = "drop"    // price dropped by WatchRule.DropPercent
+	WatchRestock = "restock" // turns to be in stock
+)
+
+// watchBatch is the max count of sku in one price or stock request
+const watchBatch = 20
+
+// WatchRule is the conditions to alert for one sku
+//
+type WatchRule struct {
+	ID          string  `json:"id"`
+	Area        string  `json:"area"`         // area to check stock, default to JDConfig.ShipArea
+	Below       float64 `json:"below"`        // alert when the price at or below it, 0 to disable
+	DropPercent float64 `json:"drop_percent"` // alert when the price dropped by the percent since first seen, 0 to disable
+	Restock     bool    `json:"restock"`      // alert when the sku turns to be in stock
+}
+
+// WatchState is the latest observation of one rule
+//
+type WatchState struct {
+	WatchRule
+	Name       string    `json:"name"`
+	Price      float64   `json:"price"`
+	FirstPrice float64   `json:"first_price"` // the base of DropPercent
+	LowPrice   float64   `json:"low_price"`   // the lowest price seen
+	State      string    `json:"state"`       // 33 : on sale, 34 : out of stock
+	StateName  string    `json:"state_name"`
+	Checked    time.Time `json:"checked"` // last time polled
+	Changes    int       `json:"changes"` // times of price or stock changed
+
+	// alerted conditions, cleared when the condition not met anymore, so
+	// that one condition alerts only once each time it turns to be true
+	alerted map[string]bool
+}
+
+// WatchAlert is fired when the condition of WatchRule met
+//
+type WatchAlert struct {
+	Time      time.Time
+	SKU       string
+	Name      string
+	Area      string
+	Condition string // WatchBelow, WatchDrop or WatchRestock
+	Price     float64
+	StateName string
+	Message   string
+}
+
+// When implement Event
+func (e *WatchAlert) When() time.Time { return e.Time }
+
+// Watcher poll the price and stock of sku list without buying anything,
+// WatchAlert fired when the conditions met. No login required.
+//
+type Watcher struct {
+	jd     *JingDong
+	states []*WatchState
+	mu     sync.Mutex
+}
+
+// NewWatcher create the watcher for the rules, polled by jd.Period
+//
+func NewWatcher(jd *JingDong, rules []*WatchRule) *Watcher {
+	w := &Watcher{jd: jd, states: make([]*WatchState, 0, len(rules))}
+	for _, r := range rules {
+		s := &WatchState{WatchRule: *r, Name: r.ID, alerted: make(map[string]bool)}
+		if s.Area == "" {
+			s.Area = jd.ShipArea
+		}
+		w.states = append(w.states, s)
+	}
+	return w
+}
+
+// States return a copy of the latest observations
+//
+func (w *Watcher) States() []WatchState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lst := make([]WatchState, len(w.states))
+	for i, s := range w.states {
+		lst[i] = *s
+		lst[i].alerted = nil
+	}
+	return lst
+}
+
+// Run poll until stop closed
+//
+func (w *Watcher) Run(stop <-chan struct{}) {
+	// names are only for display, ID is used if failed
+	names := make(map[string]string)
+	for _, s := range w.states {
+		if _, exist := names[s.ID]; exist {
+			continue
+		}
+		g := &SKUInfo{ID: s.ID}
+		if err := w.jd.skuPage(g); err == nil && g.Name != "" {
+			names[s.ID] = g.Name
+		}
+	}
+
+	w.mu.Lock()
+	for _, s := range w.states {
+		if name, exist := names[s.ID]; exist {
+			s.Name = name
+		}
+	}
+	w.mu.Unlock()
+
+	w.jd.log.Info("开始监控 %d 个商品，刷新间隔 %s", len(w.states), w.jd.Period)
+	for {
+		w.poll()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(w.jd.Period):
+		}
+	}
+}
+
+// chunks split the IDs into batches of watchBatch
+//
+func chunks(IDs []string) [][]string {
+	lst := make([][]string, 0, len(IDs)/watchBatch+1)
+	for len(IDs) > watchBatch {
+		lst = append(lst, IDs[:watchBatch])
+		IDs = IDs[watchBatch:]
+	}
+	if len(IDs) > 0 {
+		lst = append(lst, IDs)
+	}
+	return lst
+}
+
+// poll query the price and stock of all the sku in batch, and check the
+// conditions. Failed batches are skipped until next time.
+//
+func (w *Watcher) poll() {
+	IDs := make([]string, 0)
+	areas := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, s := range w.states {
+		if !seen[s.ID] {
+			seen[s.ID] = true
+			IDs = append(IDs, s.ID)
+		}
+		if key := s.Area + "/" + s.ID; !seen[key] {
+			seen[key] = true
+			areas[s.Area] = append(areas[s.Area], s.ID)
+		}
+	}
+
+	failed := false
+	defer func() {
+		w.jd.publish(&Polled{Time: time.Now(), Source: PollWatch, Failed: failed})
+	}()
+
+	prices := make(map[string]float64)
+	for _, batch := range chunks(IDs) {
+		ps, err := w.jd.Prices(batch)
+		if err != nil {
+			failed = true
+			continue
+		}
+		for ID, price := range ps {
+			prices[ID] = price
+		}
+	}
+
+	states := make(map[string]*StockState)
+	for area, lst := range areas {
+		for _, batch := range chunks(lst) {
+			ss, err := w.jd.StockStates(batch, area)
+			if err != nil {
+				failed = true
+				continue
+			}
+			for ID, state := range ss {
+				states[area+"/"+ID] = state
+			}
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range w.states {
+		price, hasPrice := prices[s.ID]
+		state, hasState := states[s.Area+"/"+s.ID]
+		if !hasPrice && !hasState {
+			continue
+		}
+		s.Checked = now
+
+		// JD return -1 for the goods not on sale anymore
+		if hasPrice && price > 0 && price != s.Price {
+			if s.Price > 0 {
+				s.Changes++
+				w.jd.log.With(Fields{"sku": s.ID, "price": price}).Info("监控> %s %s 价格: %.2f -> %.2f", s.ID, s.Name, s.Price, price)
+			}
+			s.Price = price
+			if s.FirstPrice == 0 {
+				s.FirstPrice = price
+			}
+			if s.LowPrice == 0 || price < s.LowPrice {
+				s.LowPrice = price
+			}
+		}
+
+		if hasState && state.State != s.State {
+			if s.State == "" {
+				// in stock already, not a restock
+				s.alerted[WatchRestock] = state.State == "33"
+			} else {
+				s.Changes++
+				w.jd.log.With(Fields{"sku": s.ID, "area": s.Area, "state": state.State}).Info("监控> %s %s 库存: %s -> %s", s.ID, s.Name, s.StateName, state.StateName)
+			}
+			s.State, s.StateName = state.State, state.StateName
+		}
+
+		w.check(s, now)
+	}
+}
+
+// check fire WatchAlert for the conditions turn to be true
+//
+func (w *Watcher) check(s *WatchState, now time.Time) {
+	trigger := func(cond string, met bool, format string, args ...interface{}) {
+		if !met {
+			s.alerted[cond] = false
+			return
+		}
+		if s.alerted[cond] {
+			return
+		}
+		s.alerted[cond] = true
+
+		e := &WatchAlert{
+			Time:      now,
+			SKU:       s.ID,
+			Name:      s.Name,
+			Area:      s.Area,
+			Condition: cond,
+			Price:     s.Price,
+			StateName: s.StateName,
+			Message:   fmt.Sprintf(format, args...),
+		}
+		w.jd.log.With(Fields{"sku": s.ID, "area": s.Area, "condition": cond}).Info("监控提醒> %s", e.Message)
+		w.jd.publish(e)
+	}
+
+	if s.Below > 0 {
+		trigger(WatchBelow, s.Price > 0 && s.Price <= s.Below,
+			"%s 价格 %.2f，不高于 %.2f", s.Name, s.Price, s.Below)
+	}
+
+	if s.DropPercent > 0 && s.FirstPrice > 0 {
+		drop := (s.FirstPrice - s.Price) / s.FirstPrice * 100
+		trigger(WatchDrop, drop >= s.DropPercent,
+			"%s 价格 %.2f，比开始监控时的 %.2f 下降了 %.1f%%", s.Name, s.Price, s.FirstPrice, drop)
+	}
+
+	if s.Restock {
+		trigger(WatchRestock, s.State == "33", "%s 到货了: %s", s.Name, s.StateName)
+	}
+}
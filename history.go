@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/monotone/go-jd/core"
+)
+
+// cmdHistory show the price and stock history of the goods in -history,
+// all the goods recorded if no sku given
+//
+func cmdHistory(args []string) int {
+	if *history == "" {
+		return fail("未指定价格库存记录文件")
+	}
+
+	// read only, a watch or rush may be recording at the same time
+	store, err := core.OpenHistoryReadOnly(*history)
+	if err != nil {
+		return fail("打开价格库存记录失败: %s", err)
+	}
+	defer store.Close()
+
+	var since time.Time
+	if *days > 0 {
+		since = time.Now().AddDate(0, 0, -*days)
+	}
+
+	skus := args
+	if len(skus) == 0 {
+		skus = store.SKUs()
+	}
+
+	// the default area is for rush, only filter when given explicitly
+	onlyArea := ""
+	if isSet("area") {
+		onlyArea = *area
+	}
+
+	results := make([]*core.SKUHistory, 0, len(skus))
+	for _, sku := range skus {
+		lst, err := store.Query(sku, since)
+		if err != nil {
+			return fail("读取价格库存记录失败: %s", err)
+		}
+
+		h := core.Summarize(sku, lst)
+		if onlyArea != "" {
+			areas := h.Areas[:0]
+			for _, a := range h.Areas {
+				if a.Area == onlyArea {
+					areas = append(areas, a)
+				}
+			}
+			h.Areas = areas
+		}
+		results = append(results, h)
+	}
+
+	const layout = "2006-01-02 15:04:05"
+	if printResult(results, func(t *table) {
+		t.row("商品", "开始", "结束", "最低", "最低时间", "最高", "最近", "地区", "有货", "到货")
+		for _, h := range results {
+			if h.From.IsZero() {
+				continue
+			}
+			for _, a := range h.Areas {
+				t.row(h.SKU, h.From.Format(layout), h.To.Format(layout), h.LowPrice, h.LowAt.Format(layout),
+					h.HighPrice, h.LastPrice, a.Area, fmt.Sprintf("%d/%d", a.InStock, a.Samples), len(a.Restocks))
+			}
+			if len(h.Areas) == 0 {
+				t.row(h.SKU, h.From.Format(layout), h.To.Format(layout), h.LowPrice, h.LowAt.Format(layout),
+					h.HighPrice, h.LastPrice, "-", "-", "-")
+			}
+		}
+	}) {
+		return exitSuccess
+	}
+
+	for _, h := range results {
+		fmt.Println(strings.Repeat("+", 60))
+		if h.From.IsZero() {
+			fmt.Printf("商品: %s  无记录\n", h.SKU)
+			continue
+		}
+		fmt.Printf("商品: %s  记录: %s ~ %s\n", h.SKU, h.From.Format(layout), h.To.Format(layout))
+
+		if h.LowPrice > 0 {
+			fmt.Printf("价格: 最低 ¥%.2f (%s)  最高 ¥%.2f  最近 ¥%.2f\n",
+				h.LowPrice, h.LowAt.Format(layout), h.HighPrice, h.LastPrice)
+			for _, p := range h.Prices {
+				fmt.Printf("  %s  ¥%.2f\n", p.Time.Format(layout), p.Price)
+			}
+		}
+
+		for _, a := range h.Areas {
+			fmt.Printf("地区: %s  有货 %.1f%% (%d/%d)  到货 %d 次\n",
+				a.Area, float64(a.InStock)*100/float64(a.Samples), a.InStock, a.Samples, len(a.Restocks))
+			for _, t := range a.Restocks {
+				fmt.Printf("  到货: %s\n", t.Format(layout))
+			}
+
+			hours := make([]string, 0)
+			for hour, n := range a.RestockHours {
+				if n > 0 {
+					hours = append(hours, fmt.Sprintf("%d时 %d次", hour, n))
+				}
+			}
+			if len(hours) > 0 {
+				fmt.Printf("  到货时段: %s\n", strings.Join(hours, ", "))
+			}
+		}
+	}
+
+	return exitSuccess
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monotone/go-jd/core"
+	clog "gopkg.in/clog.v1"
+)
+
+// output formats of the command results, see -output
+const (
+	outputText  = "text"  // the logs as is, for human
+	outputJSON  = "json"  // one JSON document on stdout, logs to stderr
+	outputTable = "table" // tab aligned columns on stdout, logs to stderr
+)
+
+// outputMode return the output format, -json is short for -output json
+//
+func outputMode() string {
+	if *jsonOut {
+		return outputJSON
+	}
+	return *output
+}
+
+// log formats, see -log-format
+const (
+	logText = "text" // by clog to the console or -log-file, or to stderr for the results on stdout
+	logJSON = "json" // one JSON object each line, with the fields of core
+)
+
+// logLevels are the values of -log-level
+var logLevels = map[string]core.Level{
+	"trace": core.LevelTrace,
+	"info":  core.LevelInfo,
+	"warn":  core.LevelWarn,
+	"error": core.LevelError,
+}
+
+// clogLevels map the levels of core to clog
+var clogLevels = map[core.Level]clog.LEVEL{
+	core.LevelTrace: clog.TRACE,
+	core.LevelInfo:  clog.INFO,
+	core.LevelWarn:  clog.WARN,
+	core.LevelError: clog.ERROR,
+}
+
+// logger is where the logs of the commands and core go, set by initLog
+var logger core.Logger = core.NopLogger
+
+// initLog init the logger of -log-format. The text logs go to the console,
+// or to -log-file, or to stderr when stdout is for the results.
+//
+func initLog() error {
+	level := logLevels[*logLevel]
+	if *logFormat == logJSON {
+		w := os.Stderr
+		if *logFile != "" {
+			f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			w = f
+		}
+		logger = &jsonLogger{w: w, level: level}
+		return nil
+	}
+
+	if *logFile == "" && outputMode() != outputText {
+		// stderr may be a pipe or closed, not a file clog can reopen
+		logger = &textLogger{w: os.Stderr, level: level}
+		return nil
+	}
+
+	logger = clogLogger{}
+	if *logFile == "" {
+		return clog.New(clog.CONSOLE, clog.ConsoleConfig{
+			Level:      clogLevels[level],
+			BufferSize: 100,
+		})
+	}
+	return clog.New(clog.FILE, clog.FileConfig{
+		Level:      clogLevels[level],
+		BufferSize: 100,
+		Filename:   *logFile,
+	})
+}
+
+// logf log the message without fields
+//
+func logf(level core.Level, format string, args ...interface{}) {
+	logger.Log(level, fmt.Sprintf(format, args...), nil)
+}
+
+// clogLogger write the logs by clog, the fields appended to the message
+//
+type clogLogger struct{}
+
+func (clogLogger) Log(level core.Level, msg string, fields core.Fields) {
+	msg = withFields(msg, fields)
+	switch level {
+	case core.LevelTrace:
+		clog.Trace("%s", msg)
+	case core.LevelInfo:
+		clog.Info("%s", msg)
+	case core.LevelWarn:
+		clog.Warn("%s", msg)
+	default:
+		clog.Error(0, "%s", msg)
+	}
+}
+
+// withFields append the fields sorted by key to the message
+//
+func withFields(msg string, fields core.Fields) string {
+	if len(fields) == 0 {
+		return msg
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", k, fields[k])
+	}
+	return msg + " [" + strings.Join(pairs, " ") + "]"
+}
+
+// textLogger write the text logs to w in the format of clog, for stderr
+// when stdout is for the results
+//
+type textLogger struct {
+	w     io.Writer
+	level core.Level
+	mu    sync.Mutex
+}
+
+func (l *textLogger) Log(level core.Level, msg string, fields core.Fields) {
+	if level < l.level {
+		return
+	}
+
+	line := fmt.Sprintf("%s [%5s] %s\n", time.Now().Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), withFields(msg, fields))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line)
+}
+
+// jsonLogger write one JSON object each line, with time, level, msg and
+// the fields
+//
+type jsonLogger struct {
+	w     io.Writer
+	level core.Level
+	mu    sync.Mutex
+}
+
+func (l *jsonLogger) Log(level core.Level, msg string, fields core.Fields) {
+	if level < l.level {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		if d, ok := v.(time.Duration); ok {
+			// milliseconds are easier to query than the nanoseconds
+			v = float64(d) / float64(time.Millisecond)
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{"level": level.String(), "msg": msg, "error": err.Error()})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(data, '\n'))
+}
+
+// printResult print v as JSON, or as table by fn, false for text format
+// which is left to the command
+//
+func printResult(v interface{}, fn func(t *table)) bool {
+	switch outputMode() {
+	case outputJSON:
+		printJSON(v)
+		return true
+	case outputTable:
+		printTable(fn)
+		return true
+	}
+	return false
+}
+
+// printTable print the rows added by fn as table
+//
+func printTable(fn func(t *table)) {
+	t := &table{w: tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)}
+	fn(t)
+	t.w.Flush()
+}
+
+// printJSON print v as JSON to stdout
+//
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logf(core.LevelError, "输出JSON失败: %s", err)
+	}
+}
+
+// table is the tab aligned output, one row each line
+//
+type table struct {
+	w *tabwriter.Writer
+}
+
+// row print the columns, formatted by fmt.Sprint
+//
+func (t *table) row(cols ...interface{}) {
+	strs := make([]string, len(cols))
+	for i, col := range cols {
+		switch v := col.(type) {
+		case float64:
+			strs[i] = fmt.Sprintf("%.2f", v)
+		case string:
+			// tabs and newlines from the page break the columns
+			strs[i] = strings.Join(strings.Fields(v), " ")
+		default:
+			strs[i] = fmt.Sprint(v)
+		}
+	}
+	fmt.Fprintln(t.w, strings.Join(strs, "\t"))
+}
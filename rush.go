@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/monotone/go-jd/core"
+	clog "gopkg.in/clog.v1"
+)
+
+// loadPlan load the goods from -plan, -goods or the arguments in the
+// format of -goods, with -policy applied, the targets without account go
+// to -account
+//
+func loadPlan(args []string) (*core.Plan, error) {
+	var (
+		err error
+		gs  *core.Plan
+	)
+	if *goods == "" && len(args) > 0 {
+		*goods = strings.Join(args, ",")
+	}
+
+	if *plan != "" {
+		gs, err = core.LoadPlan(*plan)
+	} else {
+		gs, err = parseGoods(*goods)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range gs.Targets {
+		if p.Account == "" {
+			p.Account = *account
+		}
+	}
+
+	if *policy != "" {
+		if !core.ValidPolicy(*policy) {
+			return nil, fmt.Errorf("无效的下单策略: %s", *policy)
+		}
+		gs.Policy = *policy
+	}
+	if *strategy != "" {
+		if !core.ValidStrategy(*strategy) {
+			return nil, fmt.Errorf("无效的加购策略: %s", *strategy)
+		}
+		gs.Strategy = *strategy
+	}
+	return gs, nil
+}
+
+// cmdRush buy the goods of -goods or -plan, one session for each account
+// in the plan
+//
+func cmdRush(args []string) int {
+	gs, err := loadPlan(args)
+	if err != nil {
+		return fail("无效的商品计划: %s", err)
+	}
+
+	logf(core.LevelTrace, "[Area: %+v, Goods: %+v, Period: %+v, Rush: %+v, Order: %+v, Strategy: %+v]",
+		*area, gs.Targets, *period, *rush, *order, gs.Strategy)
+
+	store := openHistory()
+
+	accounts := gs.Accounts()
+	jds := make([]*core.JingDong, len(accounts))
+	for i, account := range accounts {
+		jds[i] = core.NewJingDong(config(account, store))
+	}
+
+	onSignal(func() {
+		for _, jd := range jds {
+			jd.Release()
+		}
+		if store != nil {
+			store.Close()
+		}
+
+		clog.Shutdown()
+		os.Exit(exitFailure)
+	})
+
+	// login one by one, since each one need scan the QR code
+	var wg sync.WaitGroup
+	reports := make([]*core.RushReport, len(jds))
+	for i, jd := range jds {
+		if accounts[i] != "" {
+			logf(core.LevelInfo, "账号: %s", accounts[i])
+		}
+		if err := jd.Login(); err != nil {
+			continue
+		}
+		jd.CartDetails()
+
+		wg.Add(1)
+		go func(i int, jd *core.JingDong) {
+			defer wg.Done()
+			reports[i] = jd.RushBuy(gs.ForAccount(accounts[i]))
+		}(i, jd)
+	}
+
+	wg.Wait()
+	for _, jd := range jds {
+		jd.Release()
+	}
+	if store != nil {
+		store.Close()
+	}
+
+	results := make([]map[string]interface{}, len(reports))
+	for i, report := range reports {
+		results[i] = map[string]interface{}{"account": accounts[i], "report": report}
+		if report == nil {
+			results[i]["status"] = "login_failed"
+		} else {
+			results[i]["status"] = report.Status().String()
+		}
+	}
+	if !printResult(results, func(t *table) {
+		t.row("账号", "结果", "编号", "数量", "价格", "库存", "下单", "商品", "错误")
+		for i, report := range reports {
+			if report == nil {
+				t.row(accounts[i], results[i]["status"], "-", "-", "-", "-", "-", "-", "-")
+				continue
+			}
+			for _, item := range report.Items {
+				t.row(accounts[i], results[i]["status"], item.ID, item.Count, item.Price,
+					item.StateName, item.Ordered, item.Name, item.Error)
+			}
+		}
+	}) {
+		for _, report := range reports {
+			if report != nil {
+				report.Log(logger)
+			}
+		}
+	}
+
+	return exitCode(reports)
+}
+
+// exitCode merge the result of all accounts, nil report means the account
+// failed to login.
+//
+func exitCode(reports []*core.RushReport) int {
+	var success, failure int
+	for _, report := range reports {
+		if report == nil {
+			failure++
+			continue
+		}
+
+		switch report.Status() {
+		case core.RushSuccess:
+			success++
+		case core.RushFailure:
+			failure++
+		}
+	}
+
+	switch {
+	case success == len(reports):
+		return exitSuccess
+	case failure == len(reports):
+		return exitFailure
+	default:
+		return exitPartial
+	}
+}
+
+// parseGoods parse the input goods list. Support to input multiple goods sperated
+// by comma(,). With an (:count) after goods ID to specify the count of each goods.
+//
+// Example as following:
+//
+//   2567304				single goods with default count 1, and any price
+//   2567304:3				single goods with count 3, and any price
+//   2567304,3133851:4		multiple goods with defferent count 1, 4, and any price
+//   2567304:2:300,3133851:5:200	...
+//
+// For more options, use a plan file with -plan instead.
+//
+func parseGoods(goods string) (*core.Plan, error) {
+	lst := make([]*core.ExpectProduct, 0)
+	if goods == "" {
+		return nil, fmt.Errorf("no goods specified, use -goods or -plan")
+	}
+
+	var err error
+	for _, good := range strings.Split(goods, ",") {
+		pair := strings.Split(good, ":")
+		id := strings.Trim(pair[0], " ")
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			return nil, fmt.Errorf("goods %q: invalid product ID", good)
+		}
+		num := 1
+		if len(pair) > 1 {
+			v, err := strconv.ParseInt(pair[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("goods %s: %s", good, err)
+			}
+			num = int(v)
+		}
+		if num < 1 {
+			return nil, fmt.Errorf("goods %s: not a valid product count value", good)
+		}
+
+		price := math.MaxFloat64
+		if len(pair) > 2 {
+			price, err = strconv.ParseFloat(pair[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("goods %s: %s", good, err)
+			}
+		}
+		if price < 0 {
+			return nil, fmt.Errorf("goods %s: not a valid price value", good)
+		}
+
+		lst = append(lst, &core.ExpectProduct{
+			ID:    id,
+			Num:   num,
+			Price: price,
+		})
+	}
+
+	return &core.Plan{Targets: lst}, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseGoods(t *testing.T) {
+	cases := []struct {
+		goods string
+		want  int // targets, -1 for error
+	}{
+		{"2567304", 1},
+		{"2567304:2:300, 3133851", 2},
+		{"1,,2", -1},
+		{",1", -1},
+		{"1,", -1},
+		{":2", -1},
+		{"abc", -1},
+		{"1:0", -1},
+		{"1:1:-1", -1},
+		{"", -1},
+	}
+
+	for _, c := range cases {
+		plan, err := parseGoods(c.goods)
+		if c.want < 0 {
+			if err == nil {
+				t.Errorf("%q: got %d targets, want error", c.goods, len(plan.Targets))
+			}
+			continue
+		}
+		if err != nil || len(plan.Targets) != c.want {
+			t.Errorf("%q: got %v, want %d targets", c.goods, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/monotone/go-jd/core"
+)
+
+// cmdSelfCheck check whether the selectors of the parsers still match the
+// pages of JingDong, or the pages recorded with -replay
+//
+func cmdSelfCheck(args []string) int {
+	if len(args) < 1 || (len(args) > 1 && args[1] != "add") {
+		return fail("用法: selfcheck sku [add]")
+	}
+
+	jd, err := session(true)
+	if err != nil {
+		return fail("登录失败: %s", err)
+	}
+	defer jd.Release()
+
+	pages := jd.SelfCheck(args[0], len(args) > 1)
+	if !printResult(pages, func(t *table) {
+		t.row("页面", "选择器", "匹配", "结果")
+		for _, p := range pages {
+			if p.Error != "" {
+				t.row(p.Page, "-", "-", p.Error)
+				continue
+			}
+			for _, c := range p.Checks {
+				t.row(p.Page, c.Selector, c.Matches, checkResult(c))
+			}
+		}
+	}) {
+		for _, p := range pages {
+			if p.Error != "" {
+				logf(core.LevelError, "%-12s加载失败: %s", p.Page, p.Error)
+				continue
+			}
+			for _, c := range p.Checks {
+				level := core.LevelInfo
+				if !c.OK() {
+					level = core.LevelError
+				}
+				logf(level, "%-12s%-28s%-6d%s", p.Page, c.Selector, c.Matches, checkResult(c))
+			}
+		}
+	}
+
+	for _, p := range pages {
+		if !p.OK() {
+			return exitFailure
+		}
+	}
+	return exitSuccess
+}
+
+// checkResult describe the selector check
+//
+func checkResult(c *core.SelectorCheck) string {
+	switch {
+	case c.Matches > 0:
+		return "OK"
+	case c.Optional:
+		return "未匹配(可选)"
+	default:
+		return "未匹配"
+	}
+}
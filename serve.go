@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/monotone/go-jd/core"
+	"github.com/monotone/go-jd/server"
+)
+
+// cmdServe run as daemon, the sessions and rushes are driven by the HTTP API
+//
+func cmdServe(args []string) int {
+	store := openHistory()
+	srv := server.New(config("", store))
+	srv.Token = *token
+	srv.ConfigOf = func(account string) core.JDConfig {
+		return config(account, store)
+	}
+
+	closed := make(chan struct{})
+	onSignal(func() {
+		srv.Close()
+		close(closed)
+	})
+
+	// check the default account, the QR code is ready by the API if needed
+	srv.Login("", false)
+
+	code := exitSuccess
+	if err := srv.ListenAndServe(*listen); err != nil {
+		logf(core.LevelError, "控制接口启动失败: %s", err)
+		srv.Close()
+		code = exitFailure
+	} else {
+		<-closed
+	}
+	if store != nil {
+		store.Close()
+	}
+	return code
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// assets of the dashboard, compiled in so that it works offline
+//
+//go:embed dashboard
+var assets embed.FS
+
+// dashboard return the handler of the dashboard pages
+//
+func dashboard() http.Handler {
+	sub, err := fs.Sub(assets, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
@@ -0,0 +1,362 @@
+// go-jd dashboard, talks to the HTTP/JSON API of `autobuy serve`
+(function () {
+  'use strict';
+
+  var $ = function (sel) { return document.querySelector(sel); };
+
+  function esc(v) {
+    return String(v === undefined || v === null ? '' : v).replace(/[&<>"']/g, function (c) {
+      return { '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c];
+    });
+  }
+
+  function price(v) {
+    return v > 0 ? '¥' + v.toFixed(2) : '-';
+  }
+
+  function time(v) {
+    if (!v || v.indexOf('0001-') === 0) {
+      return '-';
+    }
+    return new Date(v).toLocaleString();
+  }
+
+  function account() {
+    return encodeURIComponent($('#account').value.trim());
+  }
+
+  // token of -token, from ?token= of the dashboard URL, kept in the tab
+  (function () {
+    var params = new URLSearchParams(location.search);
+    if (params.has('token')) {
+      sessionStorage.setItem('token', params.get('token'));
+      history.replaceState(null, '', location.pathname + location.hash);
+    }
+  })();
+
+  function headers(method) {
+    var h = {};
+    var token = sessionStorage.getItem('token');
+    if (token) {
+      h['Authorization'] = 'Bearer ' + token;
+    }
+    if (method === 'POST') {
+      h['Content-Type'] = 'application/json';
+    }
+    return h;
+  }
+
+  // api call the API, the error message of {"error": ...} is thrown
+  function api(method, url, body) {
+    var opts = { method: method, headers: headers(method) };
+    if (body !== undefined) {
+      opts.body = body;
+    }
+    return fetch(url, opts).then(function (resp) {
+      return resp.json().then(function (data) {
+        if (!resp.ok) {
+          throw new Error(data.error || resp.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  // tabs
+
+  var current = 'login';
+  var loaders = {};
+
+  function show(name) {
+    if (!document.getElementById(name)) {
+      name = 'login';
+    }
+    current = name;
+    document.querySelectorAll('main > section').forEach(function (s) {
+      s.hidden = s.id !== name;
+    });
+    document.querySelectorAll('nav a').forEach(function (a) {
+      a.classList.toggle('active', a.getAttribute('href') === '#' + name);
+    });
+    if (loaders[name]) {
+      loaders[name]();
+    }
+  }
+
+  window.addEventListener('hashchange', function () { show(location.hash.slice(1)); });
+
+  // login
+
+  function renderLogin(st) {
+    $('#login-state').textContent = st.state + (st.error ? ': ' + st.error : '');
+    $('#qr').hidden = !st.qr_image;
+    if (st.qr_image && $('#qr-img').dataset.src !== st.qr_image + st.checked) {
+      $('#qr-img').dataset.src = st.qr_image + st.checked;
+      // fetched with the token, which an img can not send
+      fetch(st.qr_image + '&t=' + Date.now(), { headers: headers('GET') }).then(function (resp) {
+        return resp.ok ? resp.blob() : Promise.reject(new Error(resp.statusText));
+      }).then(function (blob) {
+        var img = $('#qr-img');
+        if (img.src.indexOf('blob:') === 0) {
+          URL.revokeObjectURL(img.src);
+        }
+        img.src = URL.createObjectURL(blob);
+      }).catch(function (e) { $('#login-state').textContent = e.message; });
+    }
+  }
+
+  function login(force) {
+    api('POST', '/api/login?account=' + account() + (force ? '&force=1' : ''))
+      .then(renderLogin)
+      .catch(function (e) { $('#login-state').textContent = e.message; });
+  }
+
+  loaders.login = function () {
+    api('GET', '/api/login?account=' + account()).then(renderLogin).catch(function (e) {
+      $('#login-state').textContent = e.message;
+      $('#qr').hidden = true;
+    });
+    api('GET', '/api/sessions').then(function (lst) {
+      $('#sessions tbody').innerHTML = lst.map(function (s) {
+        return '<tr><td>' + esc(s.account || '默认') + '</td><td>' + esc(s.state) + '</td><td>' +
+          time(s.checked) + '</td><td class="error">' + esc(s.error) + '</td></tr>';
+      }).join('');
+    }).catch(function () {});
+  };
+
+  $('#login-btn').onclick = function () { login(false); };
+  $('#relogin-btn').onclick = function () { login(true); };
+
+  // rushes
+
+  function itemState(item) {
+    if (item.ordered) {
+      return '<span class="ok">已下单</span>';
+    }
+    if (item.ready) {
+      return '<span class="ok">已就绪</span>';
+    }
+    if (item.error) {
+      return '<span class="error">' + esc(item.error) + '</span>';
+    }
+    return item.added ? '已加入购物车' : '等待中';
+  }
+
+  function renderRush(r) {
+    var html = '<div class="card"><h3>#' + esc(r.id) + ' ' + esc(r.state) + ' <span class="muted">' +
+      esc(r.policy) + ' ' + time(r.created) + '</span>';
+    if (r.state === 'running') {
+      html += ' <button data-cancel="' + esc(r.id) + '">取消</button>';
+    }
+    html += '</h3>';
+
+    r.accounts.forEach(function (a) {
+      html += '<p>账号: ' + esc(a.account || '默认') + (a.status ? ' 结果: ' + esc(a.status) : '') +
+        (a.report.order_ids.length ? ' 订单号: ' + a.report.order_ids.map(esc).join(', ') : '') + '</p>';
+      html += '<table><thead><tr><th>编号</th><th>数量</th><th>价格</th><th>库存</th><th>状态</th><th>商品</th></tr></thead><tbody>';
+      a.report.items.forEach(function (item) {
+        html += '<tr><td>' + esc(item.id) + '</td><td>' + item.count + '</td><td>' + price(item.price) +
+          '</td><td>' + esc(item.state_name) + '</td><td>' + itemState(item) + '</td><td class="name">' +
+          esc(item.name) + '</td></tr>';
+      });
+      html += '</tbody></table>';
+    });
+    return html + '</div>';
+  }
+
+  loaders.rushes = function () {
+    api('GET', '/api/rushes').then(function (lst) {
+      $('#rush-list').innerHTML = lst.reverse().map(renderRush).join('') || '<p class="muted">没有抢购</p>';
+    }).catch(function (e) { $('#rush-msg').textContent = e.message; });
+  };
+
+  $('#rush-form').onsubmit = function (e) {
+    e.preventDefault();
+    $('#rush-msg').textContent = '';
+    api('POST', '/api/rushes', $('#plan').value)
+      .then(loaders.rushes)
+      .catch(function (e) { $('#rush-msg').textContent = e.message; });
+  };
+
+  $('#rush-list').onclick = function (e) {
+    var id = e.target.dataset.cancel;
+    if (id && confirm('取消抢购 #' + id + '?')) {
+      api('DELETE', '/api/rushes/' + id).then(loaders.rushes).catch(function (e) { alert(e.message); });
+    }
+  };
+
+  // watches
+
+  function renderWatch(w) {
+    var html = '<div class="card"><h3>#' + esc(w.id) + ' ' + esc(w.state) + ' <span class="muted">' + time(w.created) + '</span>';
+    if (w.state === 'running') {
+      html += ' <button data-stop="' + esc(w.id) + '">停止</button>';
+    }
+    html += '</h3><table><thead><tr><th>编号</th><th>地区</th><th>价格</th><th>最低</th><th>库存</th><th>变化</th><th>检查时间</th><th>商品</th></tr></thead><tbody>';
+    w.states.forEach(function (s) {
+      html += '<tr><td>' + esc(s.id) + '</td><td>' + esc(s.area) + '</td><td>' + price(s.price) + '</td><td>' +
+        price(s.low_price) + '</td><td>' + esc(s.state_name) + '</td><td>' + s.changes + '</td><td>' +
+        time(s.checked) + '</td><td class="name">' + esc(s.name) + '</td></tr>';
+    });
+    return html + '</tbody></table></div>';
+  }
+
+  loaders.watches = function () {
+    api('GET', '/api/watches').then(function (lst) {
+      $('#watch-list').innerHTML = lst.reverse().map(renderWatch).join('') || '<p class="muted">没有监控</p>';
+    }).catch(function (e) { $('#watch-msg').textContent = e.message; });
+  };
+
+  $('#watch-form').onsubmit = function (e) {
+    e.preventDefault();
+    $('#watch-msg').textContent = '';
+    var rules = $('#watch-skus').value.split(',').map(function (id) {
+      return {
+        id: id.trim(),
+        area: $('#watch-area').value.trim(),
+        below: parseFloat($('#watch-below').value) || 0,
+        drop_percent: parseFloat($('#watch-drop').value) || 0,
+        restock: $('#watch-restock').checked
+      };
+    }).filter(function (r) { return r.id; });
+
+    api('POST', '/api/watches', JSON.stringify(rules))
+      .then(loaders.watches)
+      .catch(function (e) { $('#watch-msg').textContent = e.message; });
+  };
+
+  $('#watch-list').onclick = function (e) {
+    var id = e.target.dataset.stop;
+    if (id) {
+      api('DELETE', '/api/watches/' + id).then(loaders.watches).catch(function (e) { alert(e.message); });
+    }
+  };
+
+  // cart and order
+
+  loaders.cart = function () {
+    $('#cart-msg').textContent = '';
+    api('GET', '/api/cart?account=' + account()).then(function (items) {
+      $('#cart-table tbody').innerHTML = items.map(function (item) {
+        return '<tr><td>' + (item.selected ? '+' : '-') + '</td><td>' + esc(item.id) + '</td><td>' + item.count +
+          '</td><td>' + esc(item.price) + '</td><td>' + esc(item.total) + '</td><td class="name">' + esc(item.name) + '</td></tr>';
+      }).join('');
+    }).catch(function (e) { $('#cart-msg').textContent = e.message; });
+  };
+
+  var orderFields = [
+    ['ware_price', '总金额'], ['cash_back', '返现'], ['ship_price', '运费'], ['service_price', '服务费'],
+    ['coupon_price', '商品优惠'], ['freight_price', '运费优惠'], ['payment', '应付总额'],
+    ['phone', '收货人'], ['addr', '寄送至']
+  ];
+
+  loaders.order = function () {
+    $('#order-msg').textContent = '';
+    api('GET', '/api/order?account=' + account()).then(function (o) {
+      $('#order-info').innerHTML = orderFields.map(function (f) {
+        return '<dt>' + f[1] + '</dt><dd>' + esc(o[f[0]]) + '</dd>';
+      }).join('');
+    }).catch(function (e) { $('#order-msg').textContent = e.message; });
+  };
+
+  $('#cart-btn').onclick = loaders.cart;
+  $('#order-btn').onclick = loaders.order;
+
+  // history
+
+  var svgNS = 'http://www.w3.org/2000/svg';
+
+  function svg(tag, attrs, text) {
+    var el = document.createElementNS(svgNS, tag);
+    Object.keys(attrs).forEach(function (k) { el.setAttribute(k, attrs[k]); });
+    if (text !== undefined) {
+      el.textContent = text;
+    }
+    return el;
+  }
+
+  // drawChart draw the price timeline as steps, the price keeps until the next change
+  function drawChart(h) {
+    var chart = $('#chart');
+    chart.innerHTML = '';
+    if (!h.prices.length) {
+      return;
+    }
+
+    var W = 800, H = 300, L = 60, R = 10, T = 10, B = 30;
+    var t0 = new Date(h.prices[0].time).getTime();
+    var t1 = Math.max(new Date(h.to).getTime(), t0 + 1);
+    var lo = h.low_price, hi = h.high_price;
+    if (hi === lo) {
+      lo = lo * 0.9;
+      hi = hi * 1.1 || 1;
+    }
+
+    var x = function (t) { return L + (t - t0) / (t1 - t0) * (W - L - R); };
+    var y = function (p) { return T + (hi - p) / (hi - lo) * (H - T - B); };
+
+    var d = '';
+    h.prices.forEach(function (p, i) {
+      var px = x(new Date(p.time).getTime()), py = y(p.price);
+      d += (i === 0 ? 'M' : 'H' + px.toFixed(1) + 'V') + (i === 0 ? px.toFixed(1) + ',' + py.toFixed(1) : py.toFixed(1));
+    });
+    d += 'H' + x(t1).toFixed(1);
+
+    chart.appendChild(svg('line', { 'class': 'axis', x1: L, y1: H - B, x2: W - R, y2: H - B }));
+    chart.appendChild(svg('line', { 'class': 'axis', x1: L, y1: T, x2: L, y2: H - B }));
+    chart.appendChild(svg('text', { x: 4, y: y(hi) + 4 }, hi.toFixed(2)));
+    chart.appendChild(svg('text', { x: 4, y: y(lo) + 4 }, lo.toFixed(2)));
+    chart.appendChild(svg('text', { x: L, y: H - 8 }, new Date(t0).toLocaleDateString()));
+    chart.appendChild(svg('text', { x: W - R - 80, y: H - 8 }, new Date(t1).toLocaleDateString()));
+    chart.appendChild(svg('path', { 'class': 'line', d: d }));
+  }
+
+  function renderHistory(h) {
+    $('#history-stats').innerHTML = '<p>记录: ' + time(h.from) + ' ~ ' + time(h.to) + '</p><p>最低 ' +
+      price(h.low_price) + ' (' + time(h.low_at) + ')，最高 ' + price(h.high_price) + '，最近 ' + price(h.last_price) + '</p>';
+    drawChart(h);
+
+    $('#history-areas').innerHTML = h.areas.map(function (a) {
+      var hours = [];
+      a.restock_hours.forEach(function (n, hour) {
+        if (n > 0) {
+          hours.push(hour + '时 ' + n + '次');
+        }
+      });
+      return '<div class="card"><h3>地区 ' + esc(a.area) + '</h3><p>有货 ' +
+        (a.in_stock * 100 / a.samples).toFixed(1) + '% (' + a.in_stock + '/' + a.samples + ')，到货 ' +
+        a.restocks.length + ' 次</p>' + (hours.length ? '<p>到货时段: ' + hours.join(', ') + '</p>' : '') + '</div>';
+    }).join('');
+  }
+
+  loaders.history = function () {
+    api('GET', '/api/history').then(function (skus) {
+      var sel = $('#history-sku'), cur = sel.value;
+      sel.innerHTML = skus.map(function (s) { return '<option>' + esc(s) + '</option>'; }).join('');
+      if (cur) {
+        sel.value = cur;
+      }
+    }).catch(function (e) { $('#history-msg').textContent = e.message; });
+  };
+
+  $('#history-form').onsubmit = function (e) {
+    e.preventDefault();
+    $('#history-msg').textContent = '';
+    var sku = $('#history-sku').value;
+    if (!sku) {
+      return;
+    }
+    api('GET', '/api/history?sku=' + encodeURIComponent(sku) + '&days=' + ($('#history-days').value || 0))
+      .then(renderHistory)
+      .catch(function (e) { $('#history-msg').textContent = e.message; });
+  };
+
+  // live status of login, rushes and watches
+  setInterval(function () {
+    if (current === 'login' || current === 'rushes' || current === 'watches') {
+      loaders[current]();
+    }
+  }, 2000);
+
+  show(location.hash.slice(1) || 'login');
+})();
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// guard protect the API from the web pages visited by the user, which can
+// send requests to the local server too:
+//
+//   - the Host must be a loopback name or the address listened, against
+//     DNS rebinding, any Host allowed with Token
+//   - the Origin, if any, must be the server itself
+//   - POST must be application/json, so that no cross-site form or simple
+//     request gets through without the CORS preflight
+//   - with Token, the API and metrics require "Authorization: Bearer <Token>"
+//
+func (s *Server) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowedHost(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q not allowed, set the token to serve other hosts", r.Host))
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				writeError(w, http.StatusForbidden, fmt.Errorf("origin %q not allowed", origin))
+				return
+			}
+		}
+
+		if r.Method == http.MethodPost {
+			if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be application/json"))
+				return
+			}
+		}
+
+		if s.Token != "" && (strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/metrics") {
+			auth := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing bearer token"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost check the Host of the request, see guard
+//
+func (s *Server) allowedHost(host string) bool {
+	if s.Token != "" {
+		return true
+	}
+
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = strings.Trim(host, "[]")
+	}
+	if strings.EqualFold(name, "localhost") {
+		return true
+	}
+	if ip := net.ParseIP(name); ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	// the address listened explicitly, such as the LAN address
+	listened, _, err := net.SplitHostPort(s.addr)
+	if err != nil || listened == "" {
+		return false
+	}
+	if ip := net.ParseIP(listened); ip != nil && ip.IsUnspecified() {
+		return false
+	}
+	return strings.EqualFold(name, listened)
+}
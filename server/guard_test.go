@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	cases := []struct {
+		name   string
+		token  string
+		addr   string // listened
+		method string
+		path   string
+		host   string
+		header map[string]string
+		want   int
+	}{
+		{"loopback", "", "127.0.0.1:8080", "GET", "/api/sessions", "127.0.0.1:8080", nil, http.StatusOK},
+		{"localhost", "", "127.0.0.1:8080", "GET", "/api/sessions", "LocalHost:8080", nil, http.StatusOK},
+		{"ipv6 loopback", "", "[::1]:8080", "GET", "/api/sessions", "[::1]:8080", nil, http.StatusOK},
+		{"rebinding host", "", "127.0.0.1:8080", "GET", "/api/sessions", "evil.example.com:8080", nil, http.StatusForbidden},
+		{"listened address", "", "192.168.1.2:8080", "GET", "/", "192.168.1.2:8080", nil, http.StatusOK},
+		{"unspecified address", "", "0.0.0.0:8080", "GET", "/", "192.168.1.2:8080", nil, http.StatusForbidden},
+		{"same origin", "", "127.0.0.1:8080", "POST", "/api/rushes", "127.0.0.1:8080",
+			map[string]string{"Origin": "http://127.0.0.1:8080", "Content-Type": "application/json"}, http.StatusOK},
+		{"foreign origin", "", "127.0.0.1:8080", "GET", "/api/sessions", "127.0.0.1:8080",
+			map[string]string{"Origin": "http://evil.example.com"}, http.StatusForbidden},
+		{"null origin", "", "127.0.0.1:8080", "GET", "/api/sessions", "127.0.0.1:8080",
+			map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"json with charset", "", "127.0.0.1:8080", "POST", "/api/login", "127.0.0.1:8080",
+			map[string]string{"Content-Type": "application/json; charset=utf-8"}, http.StatusOK},
+		{"form post", "", "127.0.0.1:8080", "POST", "/api/login", "127.0.0.1:8080",
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"text post", "", "127.0.0.1:8080", "POST", "/api/rushes", "127.0.0.1:8080",
+			map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"post without type", "", "127.0.0.1:8080", "POST", "/api/rushes", "127.0.0.1:8080", nil, http.StatusUnsupportedMediaType},
+		{"delete without type", "", "127.0.0.1:8080", "DELETE", "/api/rushes/1", "127.0.0.1:8080", nil, http.StatusOK},
+		{"token missing", "s3cret", ":8080", "GET", "/api/sessions", "127.0.0.1:8080", nil, http.StatusUnauthorized},
+		{"token wrong", "s3cret", ":8080", "GET", "/api/sessions", "127.0.0.1:8080",
+			map[string]string{"Authorization": "Bearer s3cre"}, http.StatusUnauthorized},
+		{"token not bearer", "s3cret", ":8080", "GET", "/api/sessions", "127.0.0.1:8080",
+			map[string]string{"Authorization": "s3cret"}, http.StatusUnauthorized},
+		{"token ok", "s3cret", ":8080", "GET", "/api/sessions", "jd.example.com",
+			map[string]string{"Authorization": "Bearer s3cret"}, http.StatusOK},
+		{"metrics without token", "s3cret", ":8080", "GET", "/metrics", "jd.example.com", nil, http.StatusUnauthorized},
+		{"dashboard without token", "s3cret", ":8080", "GET", "/", "jd.example.com", nil, http.StatusOK},
+		{"foreign origin with token", "s3cret", ":8080", "GET", "/api/sessions", "jd.example.com",
+			map[string]string{"Origin": "http://evil.example.com", "Authorization": "Bearer s3cret"}, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		s := &Server{Token: c.token, addr: c.addr}
+		h := s.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req := httptest.NewRequest(c.method, "http://"+c.host+c.path, nil)
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != c.want {
+			t.Errorf("%s: got %d, want %d: %s", c.name, rec.Code, c.want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,725 @@
+// Package server keep the JingDong sessions logged in, and drive them by a
+// local HTTP/JSON API:
+//
+//   GET    /api/sessions                    sessions and the login state
+//   GET    /api/login?account=              login state of the account
+//   POST   /api/login?account=&force=1      start to login, force to scan again
+//   GET    /api/login/qr?account=           the QR code image to scan
+//   GET    /api/cart?account=               goods in the shopping cart
+//   GET    /api/order?account=              order preview of the goods selected
+//   POST   /api/rushes?policy=&strategy=    start a rush, the JSON plan as body
+//   GET    /api/rushes                      all the rushes with live status
+//   GET    /api/rushes/<id>                 one rush
+//   DELETE /api/rushes/<id>                 cancel the rush
+//   POST   /api/watches                     start to watch, the rules as body
+//   GET    /api/watches                     all the watches with latest states
+//   GET    /api/watches/<id>                one watch
+//   DELETE /api/watches/<id>                stop the watch
+//   GET    /api/history?sku=&days=          price and stock history of the sku
+//   GET    /metrics                         metrics of the sessions for Prometheus
+//
+// The dashboard is served at /, with all the assets compiled in.
+//
+// The requests from other web pages are rejected, see guard, and the API
+// requires the bearer token if Token set. The read-only endpoints respond
+// 404 for the accounts never logged in, only POST /api/login creates the
+// session of an account.
+//
+// Errors are returned as {"error": "..."} with the HTTP status code.
+//
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monotone/go-jd/core"
+)
+
+// Login states of session
+//
+const (
+	LoginUnknown = "unknown"      // not checked yet
+	LoggingIn    = "logging_in"   // checking the cookies or loading the QR code
+	WaitingScan  = "waiting_scan" // the QR code is ready to scan
+	LoggedIn     = "logged_in"
+	LoginFailed  = "failed"
+	LoginExpired = "expired" // found invalid by keep alive
+)
+
+// Rush states
+//
+const (
+	RushRunning  = "running"
+	RushDone     = "done"
+	RushCanceled = "canceled"
+)
+
+// maxRushes is the count of rushes kept, finished ones are dropped first
+const maxRushes = 100
+
+// maxWatches is the count of watches kept, stopped ones are dropped first
+const maxWatches = 100
+
+// Session is the login state of one account
+//
+type Session struct {
+	Account string    `json:"account"`
+	State   string    `json:"state"`
+	QRImage string    `json:"qr_image,omitempty"` // URL of the QR code while WaitingScan
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"` // last time the state known
+
+	jd      *core.JingDong
+	sub     *core.Subscription
+	metrics *core.Subscription
+	qrImage string // file path of the QR code
+	mu      sync.Mutex
+}
+
+// AccountRush is the rush of one account
+//
+type AccountRush struct {
+	Account string           `json:"account"`
+	Status  string           `json:"status"` // success, partial or failure, empty while running
+	Report  *core.RushReport `json:"report"`
+}
+
+// Rush is one plan submitted
+//
+type Rush struct {
+	ID       string         `json:"id"`
+	State    string         `json:"state"`
+	Created  time.Time      `json:"created"`
+	Policy   string         `json:"policy"`
+	Accounts []*AccountRush `json:"accounts"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Server is the daemon holding the sessions and rushes
+//
+type Server struct {
+	Config    core.JDConfig // template of sessions, Account is set for each one
+	KeepAlive time.Duration // interval to check the sessions, default to 10 minutes
+
+	// ConfigOf return the config of the account, for the settings differ
+	// between accounts, Config is used if nil
+	ConfigOf func(account string) core.JDConfig
+
+	// Metrics collect the events of all the sessions, served at /metrics
+	Metrics *core.Metrics
+
+	// Token is the bearer token required by the API and metrics, no auth
+	// if empty, then only the loopback and the address listened allowed
+	// as Host
+	Token string
+
+	addr     string // the address listened
+	mu       sync.Mutex
+	sessions map[string]*Session
+	rushes   []*Rush
+	watches  []*Watch
+	nextID   int
+	stop     chan struct{}
+	closing  sync.Once
+	http     *http.Server
+}
+
+// New create the server, the sessions are created when used
+//
+func New(config core.JDConfig) *Server {
+	config.NoQRViewer = true
+	return &Server{
+		Config:    config,
+		KeepAlive: 10 * time.Minute,
+		Metrics:   core.NewMetrics(),
+		sessions:  make(map[string]*Session),
+		rushes:    make([]*Rush, 0),
+		watches:   make([]*Watch, 0),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Handler return the HTTP handler of the API
+//
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", s.handleSessions)
+	mux.HandleFunc("/api/login", s.handleLogin)
+	mux.HandleFunc("/api/login/qr", s.handleQRCode)
+	mux.HandleFunc("/api/cart", s.handleCart)
+	mux.HandleFunc("/api/order", s.handleOrder)
+	mux.HandleFunc("/api/rushes", s.handleRushes)
+	mux.HandleFunc("/api/rushes/", s.handleRush)
+	mux.HandleFunc("/api/watches", s.handleWatches)
+	mux.HandleFunc("/api/watches/", s.handleWatch)
+	mux.HandleFunc("/api/history", s.handleHistory)
+	mux.Handle("/metrics", s.Metrics)
+	mux.Handle("/", dashboard())
+	return s.guard(mux)
+}
+
+// ListenAndServe serve the API on addr until Close
+//
+func (s *Server) ListenAndServe(addr string) error {
+	s.addr = addr
+	s.http = &http.Server{Addr: addr, Handler: s.Handler()}
+	go s.keepAlive()
+
+	s.logf(core.LevelInfo, "控制台: http://%s/", addr)
+	if err := s.http.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// logf log by the Logger of Config, nothing logged if nil
+//
+func (s *Server) logf(level core.Level, format string, args ...interface{}) {
+	if s.Config.Logger != nil {
+		s.Config.Logger.Log(level, fmt.Sprintf(format, args...), nil)
+	}
+}
+
+// Close stop serving, cancel the rushes running and release the sessions
+//
+func (s *Server) Close() {
+	s.closing.Do(s.close)
+}
+
+func (s *Server) close() {
+	close(s.stop)
+	if s.http != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s.http.Shutdown(ctx)
+		cancel()
+	}
+
+	s.mu.Lock()
+	rushes := append([]*Rush(nil), s.rushes...)
+	s.mu.Unlock()
+
+	for _, r := range rushes {
+		r.cancel()
+		<-r.done
+	}
+
+	s.mu.Lock()
+	watches := append([]*Watch(nil), s.watches...)
+	s.mu.Unlock()
+
+	for _, w := range watches {
+		s.stopWatch(w)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		sess.sub.Close()
+		sess.metrics.Close()
+		sess.jd.Release()
+	}
+}
+
+// lookup return the session of the account, nil if not exist
+//
+func (s *Server) lookup(account string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[account]
+}
+
+// session return the session of the account, created if not exist
+//
+func (s *Server) session(account string) (*Session, error) {
+	if !core.ValidAccount(account) {
+		return nil, fmt.Errorf("invalid account %q", account)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, exist := s.sessions[account]; exist {
+		return sess, nil
+	}
+
+	config := s.Config
+	if s.ConfigOf != nil {
+		config = s.ConfigOf(account)
+	}
+	config.Account = account
+	config.NoQRViewer = true
+	sess := &Session{Account: account, State: LoginUnknown, jd: core.NewJingDong(config)}
+	sess.sub = sess.jd.Subscribe(16, &core.SessionExpired{})
+	sess.metrics = s.Metrics.Watch(sess.jd)
+	s.sessions[account] = sess
+
+	// the QR code is only known by the event
+	go func() {
+		for e := range sess.sub.C {
+			if e, ok := e.(*core.SessionExpired); ok {
+				sess.mu.Lock()
+				sess.State, sess.qrImage, sess.Checked = WaitingScan, e.QRImage, e.Time
+				sess.mu.Unlock()
+			}
+		}
+	}()
+
+	return sess, nil
+}
+
+// status return a copy of the session state
+//
+func (sess *Session) status() *Session {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	st := &Session{
+		Account: sess.Account,
+		State:   sess.State,
+		Error:   sess.Error,
+		Checked: sess.Checked,
+	}
+	if sess.State == WaitingScan {
+		st.QRImage = "/api/login/qr?account=" + sess.Account
+	}
+	return st
+}
+
+// setState change the login state
+//
+func (sess *Session) setState(state string, err error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.State, sess.Error, sess.Checked = state, "", time.Now()
+	if err != nil {
+		sess.Error = err.Error()
+	}
+	if state != WaitingScan {
+		sess.qrImage = ""
+	}
+}
+
+// Login start to login the account in background, the current state
+// returned. The cookies are cleaned first if force.
+//
+func (s *Server) Login(account string, force bool) (*Session, error) {
+	sess, err := s.session(account)
+	if err != nil {
+		return nil, err
+	}
+
+	sess.mu.Lock()
+	busy := sess.State == LoggingIn || sess.State == WaitingScan
+	if !busy {
+		sess.State, sess.Error = LoggingIn, ""
+	}
+	sess.mu.Unlock()
+
+	if busy {
+		return sess.status(), nil
+	}
+
+	go func() {
+		if force {
+			if err := sess.jd.Logout(); err != nil {
+				s.logf(core.LevelError, "清除Cookies失败: %+v", err)
+			}
+		}
+		if err := sess.jd.Login(); err != nil {
+			sess.setState(LoginFailed, err)
+			return
+		}
+		sess.setState(LoggedIn, nil)
+	}()
+
+	// mostly the cookies are valid, or the QR code is ready in seconds
+	for i := 0; i < 50; i++ {
+		if st := sess.status(); st.State != LoggingIn {
+			return st, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return sess.status(), nil
+}
+
+// keepAlive check the sessions logged in periodically, so that the cookies
+// are refreshed and the expired ones are known before rushing
+//
+func (s *Server) keepAlive() {
+	ticker := time.NewTicker(s.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		lst := make([]*Session, 0, len(s.sessions))
+		for _, sess := range s.sessions {
+			lst = append(lst, sess)
+		}
+		s.mu.Unlock()
+
+		for _, sess := range lst {
+			if sess.status().State != LoggedIn {
+				continue
+			}
+			if !sess.jd.LoggedIn() {
+				s.logf(core.LevelWarn, "账号 %s 登录已失效", sess.Account)
+				sess.setState(LoginExpired, nil)
+				continue
+			}
+			sess.setState(LoggedIn, nil)
+		}
+	}
+}
+
+// StartRush start to rush the plan in background, the accounts of the plan
+// must be logged in
+//
+func (s *Server) StartRush(plan *core.Plan) (*Rush, error) {
+	accounts := plan.Accounts()
+	sessions := make([]*Session, len(accounts))
+	for i, account := range accounts {
+		if sessions[i] = s.lookup(account); sessions[i] == nil {
+			return nil, fmt.Errorf("账号 %q 未登录", account)
+		}
+		if st := sessions[i].status(); st.State != LoggedIn {
+			return nil, fmt.Errorf("账号 %q 未登录: %s", account, st.State)
+		}
+	}
+
+	if plan.Policy == "" {
+		plan.Policy = core.PolicyAll
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Rush{
+		State:    RushRunning,
+		Created:  time.Now(),
+		Policy:   plan.Policy,
+		Accounts: make([]*AccountRush, len(accounts)),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	for i, account := range accounts {
+		sess := sessions[i]
+		sub := plan.ForAccount(account)
+		ar := &AccountRush{Account: account, Report: core.NewRushReport(sub, sess.jd.AutoSubmit)}
+		r.Accounts[i] = ar
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess.jd.Rush(ctx, sub, ar.Report)
+			ar.Report.Log(sess.jd.Logger)
+		}()
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	r.ID = strconv.Itoa(s.nextID)
+	s.rushes = append(s.rushes, r)
+	s.prune()
+	s.mu.Unlock()
+
+	go func() {
+		wg.Wait()
+		s.mu.Lock()
+		r.State = RushDone
+		if ctx.Err() != nil {
+			r.State = RushCanceled
+		}
+		s.mu.Unlock()
+		cancel()
+		close(r.done)
+	}()
+
+	return r, nil
+}
+
+// prune drop the oldest finished rushes beyond maxRushes, s.mu held
+//
+func (s *Server) prune() {
+	for i := 0; len(s.rushes) > maxRushes && i < len(s.rushes); {
+		if s.rushes[i].State == RushRunning {
+			i++
+			continue
+		}
+		s.rushes = append(s.rushes[:i], s.rushes[i+1:]...)
+	}
+}
+
+// rush return the rush by ID, nil if not found
+//
+func (s *Server) rush(ID string) *Rush {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.rushes {
+		if r.ID == ID {
+			return r
+		}
+	}
+	return nil
+}
+
+// snapshot return a copy of the rush with the live reports
+//
+func (s *Server) snapshot(r *Rush) *Rush {
+	s.mu.Lock()
+	c := &Rush{ID: r.ID, State: r.State, Created: r.Created, Policy: r.Policy}
+	s.mu.Unlock()
+
+	c.Accounts = make([]*AccountRush, len(r.Accounts))
+	for i, ar := range r.Accounts {
+		report := ar.Report.Snapshot()
+		c.Accounts[i] = &AccountRush{Account: ar.Account, Report: report}
+		if !report.End.IsZero() {
+			c.Accounts[i].Status = report.Status().String()
+		}
+	}
+	return c
+}
+
+// writeJSON write v as the JSON response
+//
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError write the error as the JSON response
+//
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// allow check the request method, 405 responded if not allowed
+//
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+// known return the session of the account in the request, 404 responded
+// if the account never logged in
+//
+func (s *Server) known(w http.ResponseWriter, r *http.Request) *Session {
+	account := r.URL.Query().Get("account")
+	sess := s.lookup(account)
+	if sess == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown account %q, POST /api/login first", account))
+	}
+	return sess
+}
+
+// loggedIn return the session of the account in the request, 404
+// responded if unknown, 409 if not logged in
+//
+func (s *Server) loggedIn(w http.ResponseWriter, r *http.Request) *Session {
+	sess := s.known(w, r)
+	if sess == nil {
+		return nil
+	}
+	if st := sess.status(); st.State != LoggedIn {
+		writeError(w, http.StatusConflict, fmt.Errorf("账号 %q 未登录: %s", sess.Account, st.State))
+		return nil
+	}
+	return sess
+}
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	s.mu.Lock()
+	lst := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		lst = append(lst, sess)
+	}
+	s.mu.Unlock()
+
+	states := make([]*Session, len(lst))
+	for i, sess := range lst {
+		states[i] = sess.status()
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	q := r.URL.Query()
+	if r.Method == http.MethodGet {
+		if sess := s.known(w, r); sess != nil {
+			writeJSON(w, http.StatusOK, sess.status())
+		}
+		return
+	}
+
+	force, _ := strconv.ParseBool(q.Get("force"))
+	st, err := s.Login(q.Get("account"), force)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	sess := s.known(w, r)
+	if sess == nil {
+		return
+	}
+	sess.mu.Lock()
+	filename := sess.qrImage
+	sess.mu.Unlock()
+
+	if filename == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no QR code to scan, POST /api/login first"))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeFile(w, r, filename)
+}
+
+func (s *Server) handleCart(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	sess := s.loggedIn(w, r)
+	if sess == nil {
+		return
+	}
+
+	items, err := sess.jd.CartItems()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	sess := s.loggedIn(w, r)
+	if sess == nil {
+		return
+	}
+
+	order, err := sess.jd.OrderPreview()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+func (s *Server) handleRushes(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		rushes := append([]*Rush(nil), s.rushes...)
+		s.mu.Unlock()
+
+		lst := make([]*Rush, len(rushes))
+		for i, rush := range rushes {
+			lst[i] = s.snapshot(rush)
+		}
+		writeJSON(w, http.StatusOK, lst)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	plan, err := core.ParsePlanAs(data, core.PlanJSON)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if policy := r.URL.Query().Get("policy"); policy != "" {
+		if !core.ValidPolicy(policy) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid policy %q, expect all, any or split", policy))
+			return
+		}
+		plan.Policy = policy
+	}
+	if strategy := r.URL.Query().Get("strategy"); strategy != "" {
+		if !core.ValidStrategy(strategy) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid strategy %q, expect cart or monitor", strategy))
+			return
+		}
+		plan.Strategy = strategy
+	}
+
+	rush, err := s.StartRush(plan)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s.snapshot(rush))
+}
+
+func (s *Server) handleRush(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	rush := s.rush(strings.TrimPrefix(r.URL.Path, "/api/rushes/"))
+	if rush == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("rush not found"))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		rush.cancel()
+		// wait a moment, so that the state responded is mostly canceled
+		select {
+		case <-rush.done:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	writeJSON(w, http.StatusOK, s.snapshot(rush))
+}
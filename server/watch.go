@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monotone/go-jd/core"
+)
+
+// Watch states
+//
+const (
+	WatchRunning = "running"
+	WatchStopped = "stopped"
+)
+
+// Watch is one group of rules watched, see core.Watcher
+//
+type Watch struct {
+	ID      string            `json:"id"`
+	State   string            `json:"state"`
+	Created time.Time         `json:"created"`
+	States  []core.WatchState `json:"states"`
+
+	watcher *core.Watcher
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// StartWatch start to watch the rules in background, no login required
+//
+func (s *Server) StartWatch(rules []*core.WatchRule) (*Watch, error) {
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules to watch")
+	}
+	for _, r := range rules {
+		if _, err := strconv.ParseUint(r.ID, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid sku %q", r.ID)
+		}
+	}
+
+	sess, err := s.session("")
+	if err != nil {
+		return nil, err
+	}
+	w := &Watch{
+		State:   WatchRunning,
+		Created: time.Now(),
+		watcher: core.NewWatcher(sess.jd, rules),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	w.ID = strconv.Itoa(s.nextID)
+	s.watches = append(s.watches, w)
+	s.pruneWatches()
+	s.mu.Unlock()
+
+	go func() {
+		w.watcher.Run(w.stop)
+		s.mu.Lock()
+		w.State = WatchStopped
+		s.mu.Unlock()
+		close(w.done)
+	}()
+
+	return w, nil
+}
+
+// pruneWatches drop the oldest stopped watches beyond maxWatches, s.mu held
+//
+func (s *Server) pruneWatches() {
+	for i := 0; len(s.watches) > maxWatches && i < len(s.watches); {
+		if s.watches[i].State == WatchRunning {
+			i++
+			continue
+		}
+		s.watches = append(s.watches[:i], s.watches[i+1:]...)
+	}
+}
+
+// watch return the watch by ID, nil if not found
+//
+func (s *Server) watch(ID string) *Watch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range s.watches {
+		if w.ID == ID {
+			return w
+		}
+	}
+	return nil
+}
+
+// watchSnapshot return a copy of the watch with the latest states
+//
+func (s *Server) watchSnapshot(w *Watch) *Watch {
+	s.mu.Lock()
+	c := &Watch{ID: w.ID, State: w.State, Created: w.Created}
+	s.mu.Unlock()
+
+	c.States = w.watcher.States()
+	return c
+}
+
+func (s *Server) handleWatches(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		watches := append([]*Watch(nil), s.watches...)
+		s.mu.Unlock()
+
+		lst := make([]*Watch, len(watches))
+		for i, watch := range watches {
+			lst[i] = s.watchSnapshot(watch)
+		}
+		writeJSON(w, http.StatusOK, lst)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var rules []*core.WatchRule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	watch, err := s.StartWatch(rules)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s.watchSnapshot(watch))
+}
+
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	watch := s.watch(strings.TrimPrefix(r.URL.Path, "/api/watches/"))
+	if watch == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("watch not found"))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		s.stopWatch(watch)
+	}
+	writeJSON(w, http.StatusOK, s.watchSnapshot(watch))
+}
+
+// stopWatch stop the watch and wait it exit
+//
+func (s *Server) stopWatch(w *Watch) {
+	s.mu.Lock()
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	s.mu.Unlock()
+	<-w.done
+}
+
+// handleHistory list the sku recorded, or the summary of one sku:
+//
+//   GET /api/history
+//   GET /api/history?sku=2567304&days=30
+//
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	if s.Config.History == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("history disabled"))
+		return
+	}
+
+	q := r.URL.Query()
+	sku := q.Get("sku")
+	if sku == "" {
+		writeJSON(w, http.StatusOK, s.Config.History.SKUs())
+		return
+	}
+
+	var since time.Time
+	if days, _ := strconv.Atoi(q.Get("days")); days > 0 {
+		since = time.Now().AddDate(0, 0, -days)
+	}
+
+	lst, err := s.Config.History.Query(sku, since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, core.Summarize(sku, lst))
+}
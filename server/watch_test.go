@@ -0,0 +1,34 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPruneWatches(t *testing.T) {
+	s := &Server{}
+	for i := 0; i < maxWatches+10; i++ {
+		state := WatchStopped
+		if i%2 == 0 {
+			state = WatchRunning
+		}
+		s.watches = append(s.watches, &Watch{ID: strconv.Itoa(i), State: state})
+		s.pruneWatches()
+	}
+
+	if len(s.watches) != maxWatches {
+		t.Fatalf("got %d watches, want %d", len(s.watches), maxWatches)
+	}
+	running := 0
+	for _, w := range s.watches {
+		if w.State == WatchRunning {
+			running++
+		}
+	}
+	if want := (maxWatches + 10) / 2; running != want {
+		t.Errorf("got %d running watches, want %d", running, want)
+	}
+	if last := s.watches[len(s.watches)-1].ID; last != strconv.Itoa(maxWatches+9) {
+		t.Errorf("the newest watch %s dropped", last)
+	}
+}
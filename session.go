@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/monotone/go-jd/core"
+)
+
+// session create the JingDong session of -account, login first if required
+//
+func session(login bool) (*core.JingDong, error) {
+	jd := core.NewJingDong(config(*account, nil))
+	if login {
+		if err := jd.Login(); err != nil {
+			jd.Release()
+			return nil, err
+		}
+	}
+	return jd, nil
+}
+
+// cmdLogin login with the cookies saved, scan the QR code if expired
+//
+func cmdLogin(args []string) int {
+	jd, err := session(true)
+	if err != nil {
+		return fail("登录失败: %s", err)
+	}
+	defer jd.Release()
+
+	nickname := jd.Nickname()
+	printResult(map[string]interface{}{"account": *account, "nickname": nickname}, func(t *table) {
+		t.row("账号", "昵称")
+		t.row(*account, nickname)
+	})
+	return exitSuccess
+}
+
+// cmdLogout clean the cookies of the account
+//
+func cmdLogout(args []string) int {
+	jd, _ := session(false)
+	defer jd.Release()
+
+	if err := jd.Logout(); err != nil {
+		return fail("清除登录信息失败: %s", err)
+	}
+	logf(core.LevelInfo, "已退出登录")
+	return exitSuccess
+}
+
+// cmdWhoami check whether the cookies are valid, exitFailure if not
+//
+func cmdWhoami(args []string) int {
+	jd, _ := session(false)
+	defer jd.Release()
+
+	loggedIn := jd.LoggedIn()
+	nickname := ""
+	if loggedIn {
+		nickname = jd.Nickname()
+	}
+
+	v := map[string]interface{}{"account": *account, "logged_in": loggedIn, "nickname": nickname}
+	if !printResult(v, func(t *table) {
+		t.row("账号", "登录", "昵称")
+		t.row(*account, loggedIn, nickname)
+	}) {
+		if loggedIn {
+			fmt.Printf("已登录: %s\n", nickname)
+		} else {
+			fmt.Println("未登录")
+		}
+	}
+
+	if !loggedIn {
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// cmdCart list, clear the cart, or check only the goods given
+//
+func cmdCart(args []string) int {
+	action := "list"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+
+	jd, err := session(true)
+	if err != nil {
+		return fail("登录失败: %s", err)
+	}
+	defer jd.Release()
+
+	switch action {
+	case "list":
+	case "clear":
+		err = jd.ClearCart()
+	case "select":
+		err = jd.SelectCart(args)
+	default:
+		return fail("未知的购物车操作: %s", action)
+	}
+	if err != nil {
+		return fail("购物车操作失败: %s", err)
+	}
+
+	if outputMode() == outputText {
+		if err = jd.CartDetails(); err != nil {
+			return fail("获取购物车失败: %s", err)
+		}
+		return exitSuccess
+	}
+
+	items, err := jd.CartItems()
+	if err != nil {
+		return fail("获取购物车失败: %s", err)
+	}
+	printResult(items, func(t *table) {
+		t.row("勾选", "编号", "数量", "单价", "总价", "商品")
+		for _, item := range items {
+			t.row(item.Selected, item.ID, item.Count, item.Price, item.Total, item.Name)
+		}
+	})
+	return exitSuccess
+}
+
+// cmdSKU show the details, prices or stock in -area of the goods
+//
+func cmdSKU(args []string) int {
+	if len(args) < 2 {
+		return fail("用法: sku (detail | price | stock) sku...")
+	}
+	action, IDs := args[0], args[1:]
+
+	jd, _ := session(false)
+	defer jd.Release()
+
+	switch action {
+	case "detail":
+		lst := make([]*core.SKUInfo, 0, len(IDs))
+		for _, ID := range IDs {
+			g, err := jd.SKUDetail(ID, []string{*area})
+			if err != nil {
+				return fail("获取商品 %s 详情失败: %s", ID, err)
+			}
+			lst = append(lst, g)
+		}
+		printResult(lst, func(t *table) {
+			t.row("编号", "价格", "库存", "商品", "链接")
+			for _, g := range lst {
+				t.row(g.ID, g.Price, g.StateName, g.Name, g.Link)
+			}
+		})
+	case "price":
+		prices, err := jd.Prices(IDs)
+		if err != nil {
+			return fail("获取商品价格失败: %s", err)
+		}
+		if !printResult(prices, func(t *table) {
+			t.row("编号", "价格")
+			for _, ID := range IDs {
+				t.row(ID, prices[ID])
+			}
+		}) {
+			for _, ID := range IDs {
+				fmt.Printf("%-12s¥%.2f\n", ID, prices[ID])
+			}
+		}
+	case "stock":
+		states, err := jd.StockStates(IDs, *area)
+		if err != nil {
+			return fail("获取商品库存失败: %s", err)
+		}
+		if !printResult(states, func(t *table) {
+			t.row("编号", "状态", "库存")
+			for _, ID := range IDs {
+				if s, ok := states[ID]; ok {
+					t.row(ID, s.State, s.StateName)
+				}
+			}
+		}) {
+			for _, ID := range IDs {
+				if s, ok := states[ID]; ok {
+					fmt.Printf("%-12s%-6s%s\n", ID, s.State, s.StateName)
+				}
+			}
+		}
+	default:
+		return fail("未知的商品操作: %s", action)
+	}
+	return exitSuccess
+}
+
+// cmdOrder preview the order of goods checked in the cart, or submit it
+//
+func cmdOrder(args []string) int {
+	action := "preview"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	jd, err := session(true)
+	if err != nil {
+		return fail("登录失败: %s", err)
+	}
+	defer jd.Release()
+
+	switch action {
+	case "preview":
+		if outputMode() == outputText {
+			if err = jd.OrderInfo(); err != nil {
+				return fail("获取订单信息失败: %s", err)
+			}
+			break
+		}
+
+		o, err := jd.OrderPreview()
+		if err != nil {
+			return fail("获取订单信息失败: %s", err)
+		}
+		printResult(o, func(t *table) {
+			t.row("总金额", o.WarePrice)
+			t.row("返现", o.CashBack)
+			t.row("运费", o.ShipPrice)
+			t.row("服务费", o.ServicePrice)
+			t.row("商品优惠", o.CouponPrice)
+			t.row("运费优惠", o.FreightPrice)
+			t.row("应付总额", o.Payment)
+			t.row("收货人", o.Phone)
+			t.row("寄送至", o.Addr)
+		})
+	case "submit":
+		a := jd.SubmitOrder()
+		printResult(a, func(t *table) {
+			t.row("结果", "订单号", "耗时", "信息")
+			t.row(a.ResultCode, a.OrderID, a.Elapsed, a.Message)
+		})
+		if a.ResultCode != 0 {
+			return exitFailure
+		}
+	default:
+		return fail("未知的订单操作: %s", action)
+	}
+	return exitSuccess
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/monotone/go-jd/core"
+)
+
+// cmdWatch watch the goods until interrupted, nothing bought
+//
+func cmdWatch(args []string) int {
+	gs, err := loadPlan(args)
+	if err != nil {
+		return fail("无效的商品计划: %s", err)
+	}
+
+	store := openHistory()
+	jd := core.NewJingDong(config(*account, store))
+
+	if *metrics != "" {
+		m := core.NewMetrics()
+		defer m.Watch(jd).Close()
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		srv := &http.Server{Addr: *metrics, Handler: mux}
+		defer srv.Close()
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				logf(core.LevelError, "监控指标接口启动失败: %s", err)
+			}
+		}()
+		logf(core.LevelInfo, "监控指标: http://%s/metrics", *metrics)
+	}
+
+	rules := make([]*core.WatchRule, 0, len(gs.Targets))
+	for _, p := range gs.Targets {
+		areas := p.Areas
+		if len(areas) == 0 {
+			areas = []string{*area}
+		}
+		for _, a := range areas {
+			rule := &core.WatchRule{ID: p.ID, Area: a, DropPercent: *drop, Restock: *restock}
+			if limit := p.UnitLimit(); limit != math.MaxFloat64 {
+				rule.Below = limit
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	stop := make(chan struct{})
+	onSignal(func() {
+		close(stop)
+	})
+
+	w := core.NewWatcher(jd, rules)
+	w.Run(stop)
+	jd.Release()
+	if store != nil {
+		store.Close()
+	}
+
+	states := w.States()
+	if !printResult(states, func(t *table) {
+		t.row("编号", "地区", "价格", "最低", "库存", "变化", "商品")
+		for _, s := range states {
+			t.row(s.ID, s.Area, s.Price, s.LowPrice, s.StateName, s.Changes, s.Name)
+		}
+	}) {
+		for _, s := range states {
+			logf(core.LevelInfo, "%-12s%-20s¥%-10.2f最低 ¥%-10.2f%-6s%s", s.ID, s.Area, s.Price, s.LowPrice, s.StateName, s.Name)
+		}
+	}
+	return exitSuccess
+}